@@ -0,0 +1,10 @@
+// Package assets embeds the files the binary can't run without, the rest of
+// the directory is copied into the image by the Dockerfile.
+package assets
+
+import "embed"
+
+// FS holds the default watermark, see config.DefaultWatermarkImage
+//
+//go:embed watermark60.png
+var FS embed.FS
@@ -0,0 +1,128 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"codiewuploader/internal/hook_handlers"
+	"codiewuploader/internal/log"
+
+	tushandler "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// AuthorizeUploads wraps the tusd handler, which is already mounted with the
+// base path stripped. Hooks only see the creation of an upload, so requests to
+// an existing upload (PATCH, HEAD, GET, DELETE) are checked here: the
+// Upload-Token must belong to the user who created the upload. The errors are
+// sent before tusd sees the request, so they carry its CORS headers here.
+//
+// The owner never changes after creation, so it is cached per upload and the
+// PATCH requests of a resumable upload don't read the info file before tusd
+// reads it again.
+func AuthorizeUploads(next http.Handler, auth *hook_handlers.AuthHandler, store tushandler.DataStore, cors *tushandler.CorsConfig) http.Handler {
+	owners := newOwnerCache(ownerCacheSize)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := r.Method
+		// tusd поддерживает подмену метода через заголовок, проверяем итоговый
+		if override := r.Header.Get("X-HTTP-Method-Override"); method == http.MethodPost && override != "" {
+			method = override
+		}
+
+		id := strings.Trim(r.URL.Path, "/")
+
+		// Создание проверяется в pre-create хуке, preflight идет без токена
+		if method == http.MethodPost || method == http.MethodOptions || id == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		owner, err := owners.get(r.Context(), store, id)
+		if err != nil {
+			setCorsHeaders(w, r, cors)
+			uploadLookupError(w, err)
+			return
+		}
+
+		if reason := auth.AuthorizeOwner(r.Context(), r.Header.Get("Upload-Token"), owner); reason != "" {
+			status := http.StatusUnauthorized
+			if reason == hook_handlers.ReasonForeignUpload {
+				status = http.StatusForbidden
+			}
+
+			// Без CORS заголовков браузер не покажет клиенту причину отказа
+			setCorsHeaders(w, r, cors)
+			http.Error(w, hook_handlers.ErrInvalidToken+": "+string(reason), status)
+			return
+		}
+
+		if method == http.MethodDelete {
+			owners.remove(id)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ownerCacheSize bounds the owner cache, it is cleared when full
+const ownerCacheSize = 10000
+
+type ownerCache struct {
+	size int
+
+	mu     sync.Mutex
+	owners map[string]string
+}
+
+func newOwnerCache(size int) *ownerCache {
+	return &ownerCache{size: size, owners: make(map[string]string)}
+}
+
+// get returns the owner of the upload, reading its info on a cache miss
+func (c *ownerCache) get(ctx context.Context, store tushandler.DataStore, id string) (string, error) {
+	c.mu.Lock()
+	owner, ok := c.owners[id]
+	c.mu.Unlock()
+	if ok {
+		return owner, nil
+	}
+
+	upload, err := store.GetUpload(ctx, id)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := upload.GetInfo(ctx)
+	if err != nil {
+		return "", err
+	}
+	owner = info.MetaData[hook_handlers.OwnerMetaKey]
+
+	c.mu.Lock()
+	if len(c.owners) >= c.size {
+		clear(c.owners)
+	}
+	c.owners[id] = owner
+	c.mu.Unlock()
+
+	return owner, nil
+}
+
+func (c *ownerCache) remove(id string) {
+	c.mu.Lock()
+	delete(c.owners, id)
+	c.mu.Unlock()
+}
+
+func uploadLookupError(w http.ResponseWriter, err error) {
+	if errors.Is(err, tushandler.ErrNotFound) {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+
+	log.Stderr.Printf("Unable to load upload info: %s", err)
+	http.Error(w, "unable to load upload", http.StatusInternalServerError)
+}
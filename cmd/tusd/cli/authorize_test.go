@@ -0,0 +1,178 @@
+package cli
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	appconfig "codiewuploader/internal/config"
+	"codiewuploader/internal/hook_handlers"
+
+	"github.com/form3tech-oss/jwt-go"
+	tushandler "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// fakeStore keeps only the info of the uploads, the wrapped handler never
+// reaches the data.
+type fakeStore struct {
+	uploads map[string]tushandler.FileInfo
+	lookups int
+}
+
+type fakeUpload struct {
+	tushandler.Upload
+	info tushandler.FileInfo
+}
+
+func (u fakeUpload) GetInfo(context.Context) (tushandler.FileInfo, error) {
+	return u.info, nil
+}
+
+func (s *fakeStore) NewUpload(context.Context, tushandler.FileInfo) (tushandler.Upload, error) {
+	panic("not used")
+}
+
+func (s *fakeStore) GetUpload(_ context.Context, id string) (tushandler.Upload, error) {
+	s.lookups++
+
+	info, ok := s.uploads[id]
+	if !ok {
+		return nil, tushandler.ErrNotFound
+	}
+
+	return fakeUpload{info: info}, nil
+}
+
+func testUploadToken(t *testing.T, sub string) string {
+	t.Helper()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": sub,
+		"exp": float64(time.Now().Add(time.Hour).Unix()),
+	}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func newTestAuthorizeUploads(t *testing.T) (http.Handler, *fakeStore, *[]string) {
+	t.Helper()
+
+	store := &fakeStore{uploads: map[string]tushandler.FileInfo{
+		"upl1": {ID: "upl1", MetaData: tushandler.MetaData{hook_handlers.OwnerMetaKey: "u1"}},
+		"upl2": {ID: "upl2"},
+	}}
+	auth := hook_handlers.NewAuthHandler(appconfig.AppConfig{JwtSecrets: []string{"secret"}})
+
+	var served []string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = append(served, r.Method+" "+r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return AuthorizeUploads(next, auth, store, nil), store, &served
+}
+
+func TestAuthorizeUploads(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		override   string
+		path       string
+		owner      string
+		wantStatus int
+	}{
+		{name: "head", method: http.MethodHead, path: "/upl1", owner: "u1", wantStatus: http.StatusNoContent},
+		{name: "patch", method: http.MethodPatch, path: "/upl1", owner: "u1", wantStatus: http.StatusNoContent},
+		{name: "get", method: http.MethodGet, path: "/upl1", owner: "u1", wantStatus: http.StatusNoContent},
+		{name: "delete", method: http.MethodDelete, path: "/upl1", owner: "u1", wantStatus: http.StatusNoContent},
+		{name: "foreign patch", method: http.MethodPatch, path: "/upl1", owner: "u2", wantStatus: http.StatusForbidden},
+		{name: "foreign head", method: http.MethodHead, path: "/upl1", owner: "u2", wantStatus: http.StatusForbidden},
+		{name: "foreign delete", method: http.MethodDelete, path: "/upl1", owner: "u2", wantStatus: http.StatusForbidden},
+		{name: "no token", method: http.MethodPatch, path: "/upl1", wantStatus: http.StatusUnauthorized},
+		{name: "upload without owner", method: http.MethodPatch, path: "/upl2", owner: "u1", wantStatus: http.StatusForbidden},
+		{name: "unknown upload", method: http.MethodPatch, path: "/missing", owner: "u1", wantStatus: http.StatusNotFound},
+		{name: "override to patch", method: http.MethodPost, override: http.MethodPatch, path: "/upl1", owner: "u2", wantStatus: http.StatusForbidden},
+		{name: "override to delete", method: http.MethodPost, override: http.MethodDelete, path: "/upl1", owner: "u1", wantStatus: http.StatusNoContent},
+		{name: "create", method: http.MethodPost, path: "/", wantStatus: http.StatusNoContent},
+		{name: "preflight", method: http.MethodOptions, path: "/upl1", wantStatus: http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _, served := newTestAuthorizeUploads(t)
+
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.owner != "" {
+				r.Header.Set("Upload-Token", testUploadToken(t, tt.owner))
+			}
+			if tt.override != "" {
+				r.Header.Set("X-HTTP-Method-Override", tt.override)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if passed := len(*served) == 1; passed != (tt.wantStatus == http.StatusNoContent) {
+				t.Errorf("served = %v, want the request passed only when allowed", *served)
+			}
+			if tt.wantStatus == http.StatusForbidden && !strings.Contains(w.Body.String(), string(hook_handlers.ReasonForeignUpload)) {
+				t.Errorf("body = %q, want the reason", w.Body)
+			}
+		})
+	}
+}
+
+func TestAuthorizeUploadsCachesOwner(t *testing.T) {
+	h, store, _ := newTestAuthorizeUploads(t)
+	token := testUploadToken(t, "u1")
+
+	request := func(method string) int {
+		r := httptest.NewRequest(method, "/upl1", nil)
+		r.Header.Set("Upload-Token", token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for _, method := range []string{http.MethodHead, http.MethodPatch, http.MethodPatch} {
+		if code := request(method); code != http.StatusNoContent {
+			t.Fatalf("%s = %d, want allowed", method, code)
+		}
+	}
+	if store.lookups != 1 {
+		t.Errorf("lookups = %d, want the owner read once", store.lookups)
+	}
+
+	// После удаления загрузки владелец из кэша не используется
+	request(http.MethodDelete)
+	delete(store.uploads, "upl1")
+	if code := request(http.MethodHead); code != http.StatusNotFound {
+		t.Errorf("HEAD after delete = %d, want 404", code)
+	}
+}
+
+func TestOwnerCacheBounded(t *testing.T) {
+	store := &fakeStore{uploads: map[string]tushandler.FileInfo{}}
+	for _, id := range []string{"a", "b", "c"} {
+		store.uploads[id] = tushandler.FileInfo{ID: id}
+	}
+
+	cache := newOwnerCache(2)
+	for _, id := range []string{"a", "b", "c"} {
+		if _, err := cache.get(context.Background(), store, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(cache.owners) > 2 {
+		t.Errorf("cache size = %d, want at most 2", len(cache.owners))
+	}
+}
@@ -0,0 +1,67 @@
+package cli
+
+import (
+	"net/http"
+
+	tushandler "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// HandleCors registers a GET endpoint together with its preflight, both
+// answered with the same CORS settings as the tusd handler, so a browser
+// client can read the responses of our own endpoints too.
+func HandleCors(mux *http.ServeMux, cors *tushandler.CorsConfig, pattern string, handler http.Handler) {
+	handler = WithCors(cors, handler)
+
+	mux.Handle("GET "+pattern, handler)
+	mux.Handle("OPTIONS "+pattern, handler)
+}
+
+// WithCors checks the origin and sets the CORS headers the way tusd does.
+// Preflight requests are answered here and never reach the handler.
+func WithCors(cors *tushandler.CorsConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !setCorsHeaders(w, r, cors) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		if r.Method == http.MethodOptions {
+			// 200, а не 204: старые браузеры не принимают 204 на preflight
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setCorsHeaders adds the CORS headers for the request origin. It reports
+// false if the origin isn't allowed.
+func setCorsHeaders(w http.ResponseWriter, r *http.Request, cors *tushandler.CorsConfig) bool {
+	origin := r.Header.Get("Origin")
+	if cors == nil || cors.Disable || origin == "" {
+		return true
+	}
+
+	if !cors.AllowOrigin.MatchString(origin) {
+		return false
+	}
+
+	header := w.Header()
+	header.Set("Access-Control-Allow-Origin", origin)
+	header.Set("Vary", "Origin")
+
+	if cors.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if r.Method == http.MethodOptions {
+		header.Set("Access-Control-Allow-Methods", cors.AllowMethods)
+		header.Set("Access-Control-Allow-Headers", cors.AllowHeaders)
+		header.Set("Access-Control-Max-Age", cors.MaxAge)
+	} else {
+		header.Set("Access-Control-Expose-Headers", cors.ExposeHeaders)
+	}
+
+	return true
+}
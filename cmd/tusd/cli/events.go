@@ -0,0 +1,140 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"codiewuploader/internal/events"
+	"codiewuploader/internal/hook_handlers"
+	"codiewuploader/internal/log"
+	"codiewuploader/internal/status"
+
+	"github.com/form3tech-oss/jwt-go"
+	tushandler "github.com/tus/tusd/v2/pkg/handler"
+)
+
+// eventsHeartbeat keeps the stream alive behind proxies which close idle connections
+const eventsHeartbeat = 15 * time.Second
+
+func SetupEvents(mux *http.ServeMux, hookHandler *hook_handlers.Handler, cors *tushandler.CorsConfig) {
+	HandleCors(mux, cors, "/events/entity/{entityId}", EventsHandler(hookHandler))
+}
+
+// entityEvents is what the events stream needs from the hook handler
+type entityEvents interface {
+	Auth() *hook_handlers.AuthHandler
+	AuthorizeEntity(ctx context.Context, token string, claims jwt.MapClaims, entityId string) (bool, error)
+	Events() *events.Broker
+	Status() *status.Store
+}
+
+// EventsHandler streams the upload progress and the processing stages of the
+// user's uploads into the entity as Server-Sent Events. The stream starts with
+// a snapshot event holding the current status of the uploads.
+//
+// The token is only read from the Upload-Token or the Authorization: Bearer
+// header, never from the URL which ends up in access logs. Browsers need an
+// EventSource implementation able to send headers.
+func EventsHandler(hookHandler entityEvents) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("Upload-Token")
+		if token == "" {
+			token, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+
+		claims, reason := hookHandler.Auth().Authenticate(r.Context(), token)
+		if reason != "" {
+			http.Error(w, hook_handlers.ErrInvalidToken+": "+string(reason), http.StatusUnauthorized)
+			return
+		}
+		userId, _ := claims["sub"].(string)
+		if userId == "" {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+		entityId := r.PathValue("entityId")
+
+		// Доступ к сущности проверяем до подписки, иначе события уже пошли бы в буфер
+		allowed, err := hookHandler.AuthorizeEntity(r.Context(), token, claims, entityId)
+		if err != nil {
+			log.Stderr.Printf("Entity authorization failed for %s: %s", entityId, err)
+			http.Error(w, "Unable to check access to the entity", http.StatusServiceUnavailable)
+			return
+		}
+		if !allowed {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+
+		rc := http.NewResponseController(w)
+
+		// Подписываемся до снимка, чтобы не потерять события между ними
+		subscription := hookHandler.Events().Subscribe(entityId, events.DefaultBuffer)
+		defer subscription.Close()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		snapshot := entityStatusResponse{EntityId: entityId, Uploads: []status.Upload{}}
+		for _, upload := range hookHandler.Status().Entity(entityId) {
+			if upload.UserId == userId {
+				snapshot.Uploads = append(snapshot.Uploads, upload)
+			}
+		}
+		if err := writeEvent(w, "snapshot", 0, snapshot); err != nil {
+			return
+		}
+		rc.Flush()
+
+		heartbeat := time.NewTicker(eventsHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+					return
+				}
+				rc.Flush()
+
+			case event, ok := <-subscription.Events:
+				if !ok {
+					return
+				}
+				// Загрузки других пользователей в ту же сущность не показываем
+				if event.UserId != userId {
+					continue
+				}
+				if err := writeEvent(w, event.Type, event.Id, event); err != nil {
+					return
+				}
+				rc.Flush()
+			}
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, eventType string, id uint64, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	if id != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, data)
+
+	return err
+}
@@ -0,0 +1,198 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	appconfig "codiewuploader/internal/config"
+	"codiewuploader/internal/events"
+	"codiewuploader/internal/hook_handlers"
+	"codiewuploader/internal/model"
+	"codiewuploader/internal/status"
+
+	"github.com/form3tech-oss/jwt-go"
+)
+
+// fakeEntityEvents allows the entities listed for the user. Each check
+// publishes an event, a stream subscribed before the check would receive it.
+type fakeEntityEvents struct {
+	auth     *hook_handlers.AuthHandler
+	broker   *events.Broker
+	statuses *status.Store
+	allowed  map[string]string
+	err      error
+}
+
+func (f *fakeEntityEvents) Auth() *hook_handlers.AuthHandler { return f.auth }
+func (f *fakeEntityEvents) Events() *events.Broker           { return f.broker }
+func (f *fakeEntityEvents) Status() *status.Store            { return f.statuses }
+
+func (f *fakeEntityEvents) AuthorizeEntity(_ context.Context, _ string, claims jwt.MapClaims, entityId string) (bool, error) {
+	f.broker.Publish(events.Event{Type: events.TypeCreated, UploadId: "during-check", EntityId: entityId, UserId: claims["sub"].(string)})
+
+	if f.err != nil {
+		return false, f.err
+	}
+
+	return f.allowed[entityId] == claims["sub"], nil
+}
+
+func newTestEvents(t *testing.T) (*httptest.Server, *fakeEntityEvents) {
+	t.Helper()
+
+	statuses, err := status.Open(status.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeEntityEvents{
+		auth:     hook_handlers.NewAuthHandler(appconfig.AppConfig{JwtSecrets: []string{"secret"}}),
+		broker:   events.NewBroker(),
+		statuses: statuses,
+		allowed:  map[string]string{"e1": "u1"},
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/events/entity/{entityId}", EventsHandler(f))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server, f
+}
+
+type sseEvent struct {
+	name string
+	data string
+}
+
+// readEvent reads the next event of the stream, comments are skipped
+func readEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+
+	var event sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case line == "" && event.name != "":
+			return event
+		case strings.HasPrefix(line, "event: "):
+			event.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestEventsStream(t *testing.T) {
+	server, f := newTestEvents(t)
+
+	stage := model.StageStatus{Stage: "move", Status: model.StatusRunning}
+	f.statuses.Set("upl1", status.Owner{UserId: "u1", EntityId: "e1"}, stage)
+	f.statuses.Set("upl2", status.Owner{UserId: "u2", EntityId: "e1"}, stage)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/events/entity/e1", nil)
+	req.Header.Set("Authorization", "Bearer "+testUploadToken(t, "u1"))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("response = %d %s, want the event stream", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	stream := bufio.NewReader(res.Body)
+
+	snapshot := readEvent(t, stream)
+	var uploads entityStatusResponse
+	if err := json.Unmarshal([]byte(snapshot.data), &uploads); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.name != "snapshot" || len(uploads.Uploads) != 1 || uploads.Uploads[0].UploadId != "upl1" {
+		t.Fatalf("snapshot = %+v, want only the user's upload", snapshot)
+	}
+
+	// Снимок отправлен после подписки, события уже доходят
+	f.broker.Publish(events.Event{Type: events.TypeProgress, UploadId: "upl2", EntityId: "e1", UserId: "u2", Offset: 5})
+	f.broker.Publish(events.Event{Type: events.TypeProgress, UploadId: "upl1", EntityId: "e1", UserId: "u1", Offset: 10})
+
+	progress := readEvent(t, stream)
+	var event events.Event
+	if err := json.Unmarshal([]byte(progress.data), &event); err != nil {
+		t.Fatal(err)
+	}
+	// Событие, опубликованное во время проверки доступа, до стрима не доходит
+	if progress.name != events.TypeProgress || event.UploadId != "upl1" || event.Offset != 10 {
+		t.Errorf("event = %s %+v, want the progress of the user's upload only", progress.name, event)
+	}
+}
+
+func TestEventsAccess(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		header     string
+		token      string
+		query      bool
+		err        error
+		wantStatus int
+	}{
+		{name: "upload token", path: "/events/entity/e1", header: "Upload-Token", token: "u1", wantStatus: http.StatusOK},
+		{name: "no token", path: "/events/entity/e1", wantStatus: http.StatusUnauthorized},
+		// Токен в URL попадает в логи, его не принимаем
+		{name: "query token", path: "/events/entity/e1", token: "u1", query: true, wantStatus: http.StatusUnauthorized},
+		{name: "not a bearer token", path: "/events/entity/e1", header: "Authorization", token: "u1", wantStatus: http.StatusUnauthorized},
+		{name: "foreign entity", path: "/events/entity/e2", header: "Upload-Token", token: "u1", wantStatus: http.StatusForbidden},
+		{name: "other user", path: "/events/entity/e1", header: "Upload-Token", token: "u2", wantStatus: http.StatusForbidden},
+		{name: "authorizer down", path: "/events/entity/e1", header: "Upload-Token", token: "u1", err: errors.New("unreachable"), wantStatus: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, f := newTestEvents(t)
+			f.err = tt.err
+
+			path := tt.path
+			if tt.query {
+				path += "?token=" + testUploadToken(t, tt.token)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+path, nil)
+			if tt.header != "" {
+				value := testUploadToken(t, tt.token)
+				if tt.header == "Authorization" {
+					// Authorization принимается только со схемой Bearer
+					value = "Token " + value
+				}
+				req.Header.Set(tt.header, value)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -55,6 +55,8 @@ var Flags struct {
 	GrpcHooksRetry                   int
 	GrpcHooksBackoff                 time.Duration
 	EnabledHooks                     []hooks.HookType
+	HooksOrderString                 string
+	HooksOrder                       []string
 	ProgressHooksInterval            time.Duration
 	ShowVersion                      bool
 	ExposeMetrics                    bool
@@ -146,6 +148,7 @@ func ParseFlags() {
 	fs.AddGroup("General hook options", func(f *flag.FlagSet) {
 		f.StringVar(&Flags.EnabledHooksString, "hooks-enabled-events", "pre-create,post-create,post-receive,post-terminate,post-finish", "Comma separated list of enabled hook events (e.g. post-create,post-finish). Leave empty to enable default events")
 		f.DurationVar(&Flags.ProgressHooksInterval, "progress-hooks-interval", 1*time.Second, "Interval at which the post-receive progress hooks are emitted for each active upload")
+		f.StringVar(&Flags.HooksOrderString, "hooks-order", "internal,file,http,grpc,plugin", "Comma separated order in which the built-in handlers (internal) and the file, http, grpc and plugin hooks are invoked")
 	})
 
 	fs.AddGroup("File hook options", func(f *flag.FlagSet) {
@@ -192,6 +195,7 @@ func ParseFlags() {
 	fs.Parse()
 
 	SetEnabledHooks()
+	SetHooksOrder()
 
 	if Flags.FileHooksDir != "" {
 		Flags.FileHooksDir, _ = filepath.Abs(Flags.FileHooksDir)
@@ -0,0 +1,85 @@
+package cli
+
+import (
+	"strings"
+
+	"codiewuploader/internal/hook_handlers"
+	"codiewuploader/internal/log"
+
+	"github.com/tus/tusd/v2/pkg/hooks"
+	"github.com/tus/tusd/v2/pkg/hooks/file"
+	"github.com/tus/tusd/v2/pkg/hooks/grpc"
+	"github.com/tus/tusd/v2/pkg/hooks/http"
+	"github.com/tus/tusd/v2/pkg/hooks/plugin"
+	"golang.org/x/exp/slices"
+)
+
+// hookNames are the valid entries of the -hooks-order flag
+var hookNames = []string{hook_handlers.InternalHooks, "file", "http", "grpc", "plugin"}
+
+// getExternalHooks creates the tusd hook handlers enabled by the -hooks-*
+// flags, keyed by their name in the -hooks-order flag.
+func getExternalHooks() map[string]hooks.HookHandler {
+	external := make(map[string]hooks.HookHandler)
+
+	if Flags.FileHooksDir != "" {
+		log.Stdout.Printf("Using '%s' for hooks", Flags.FileHooksDir)
+		external["file"] = &file.FileHook{
+			Directory: Flags.FileHooksDir,
+		}
+	}
+
+	if Flags.HttpHooksEndpoint != "" {
+		log.Stdout.Printf("Using '%s' as the endpoint for hooks", Flags.HttpHooksEndpoint)
+
+		var forwardHeaders []string
+		for _, header := range strings.Split(Flags.HttpHooksForwardHeaders, ",") {
+			if header = strings.TrimSpace(header); header != "" {
+				forwardHeaders = append(forwardHeaders, header)
+			}
+		}
+
+		external["http"] = &http.HttpHook{
+			Endpoint:       Flags.HttpHooksEndpoint,
+			MaxRetries:     Flags.HttpHooksRetry,
+			Backoff:        Flags.HttpHooksBackoff,
+			ForwardHeaders: forwardHeaders,
+		}
+	}
+
+	if Flags.GrpcHooksEndpoint != "" {
+		log.Stdout.Printf("Using '%s' as the endpoint for gRPC hooks", Flags.GrpcHooksEndpoint)
+		external["grpc"] = &grpc.GrpcHook{
+			Endpoint:   Flags.GrpcHooksEndpoint,
+			MaxRetries: Flags.GrpcHooksRetry,
+			Backoff:    Flags.GrpcHooksBackoff,
+		}
+	}
+
+	if Flags.PluginHookPath != "" {
+		log.Stdout.Printf("Using '%s' to load plugin for hooks", Flags.PluginHookPath)
+		external["plugin"] = &plugin.PluginHook{
+			Path: Flags.PluginHookPath,
+		}
+	}
+
+	return external
+}
+
+// SetHooksOrder parses the -hooks-order flag
+func SetHooksOrder() {
+	Flags.HooksOrder = nil
+
+	for _, name := range strings.Split(Flags.HooksOrderString, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		if !slices.Contains(hookNames, name) {
+			log.Stderr.Fatalf("Unknown hook in -hooks-order flag: %s", name)
+		}
+
+		Flags.HooksOrder = append(Flags.HooksOrder, name)
+	}
+}
@@ -0,0 +1,114 @@
+package cli
+
+import (
+	"codiewuploader/internal/composer"
+	"codiewuploader/internal/utils"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tus/tusd/v2/pkg/s3store"
+)
+
+// Alternate image formats produced by MoveHandler, in order of preference
+var listAlternateFormats = []struct {
+	contentType string
+	ext         string
+}{
+	{"image/avif", ".avif"},
+	{"image/webp", ".webp"},
+}
+
+func SetupList(mux *http.ServeMux, resultBucket string) {
+	mux.Handle("/list/{bucket}/{recordId}/{filename}", ListHandler(resultBucket))
+}
+
+// ListHandler proxies objects from the result bucket, the other buckets (the
+// swamp and the quarantine) are never served. For JPEG/PNG images the best
+// alternate format accepted by the client is served instead.
+func ListHandler(resultBucket string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		urlPath := strings.TrimPrefix(r.URL.Path, "/list/")
+		parts := strings.SplitN(urlPath, "/", 3)
+
+		if len(parts) < 3 {
+			http.Error(w, "Invalid URL", http.StatusBadRequest)
+			return
+		}
+
+		bucket := parts[0]
+		recordId := parts[1]
+		filename := parts[2]
+
+		if resultBucket == "" || bucket != resultBucket {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+
+		listObject(w, r, bucket, recordId, filename)
+	}
+}
+
+func listObject(w http.ResponseWriter, r *http.Request, bucket, recordId, filename string) {
+
+	service := composer.Composer.Core.(s3store.S3Store).Service
+	key := fmt.Sprintf("%s/%s", recordId, filename)
+
+	res, servedKey := getAlternateObject(r.Context(), service, bucket, key, r.Header.Get("Accept"))
+	if res == nil {
+		var err error
+		res, err = service.GetObject(r.Context(), &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+
+		if err != nil {
+			http.Error(w, "Invalid data in s3", http.StatusBadRequest)
+			return
+		}
+		servedKey = key
+	}
+	defer res.Body.Close()
+
+	contentType, contentDisposition := utils.FilterContentType(aws.ToString(res.ContentType), path.Base(servedKey))
+
+	headers := w.Header()
+	headers.Add("Content-Type", contentType)
+	headers.Add("Content-Disposition", contentDisposition)
+	headers.Add("Vary", "Accept")
+	w.WriteHeader(http.StatusOK)
+
+	io.Copy(w, res.Body)
+}
+
+// getAlternateObject returns the first alternate format of the image which the
+// client accepts and which exists in the bucket, or nil.
+func getAlternateObject(ctx context.Context, service s3store.S3API, bucket, key, accept string) (*s3.GetObjectOutput, string) {
+	switch strings.ToLower(path.Ext(key)) {
+	case ".jpg", ".jpeg", ".png":
+	default:
+		return nil, ""
+	}
+
+	for _, format := range listAlternateFormats {
+		if !utils.AcceptsMediaType(accept, format.contentType) {
+			continue
+		}
+
+		altKey := strings.TrimSuffix(key, path.Ext(key)) + format.ext
+		res, err := service.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(altKey),
+		})
+		if err == nil {
+			return res, altKey
+		}
+	}
+
+	return nil, ""
+}
@@ -1,7 +1,11 @@
 package cli
 
 import (
+	"codiewuploader/internal/events"
+	"codiewuploader/internal/hook_handlers"
+	"codiewuploader/internal/jobqueue"
 	"codiewuploader/internal/log"
+	"codiewuploader/internal/quota"
 	"net/http"
 
 	"github.com/tus/tusd/v2/pkg/handler"
@@ -22,6 +26,15 @@ func SetupMetrics(mux *http.ServeMux, handler *handler.Handler) {
 	prometheus.MustRegister(hooks.MetricsHookErrorsTotal)
 	prometheus.MustRegister(hooks.MetricsHookInvocationsTotal)
 	prometheus.MustRegister(prometheuscollector.New(handler.Metrics))
+	prometheus.MustRegister(hook_handlers.MetricsSwampReclaimedBytes)
+	prometheus.MustRegister(hook_handlers.MetricsAuthRejectionsTotal)
+	prometheus.MustRegister(hook_handlers.MetricsQuarantinedTotal)
+	prometheus.MustRegister(hook_handlers.MetricsAntivirusSizeLimitTotal)
+	prometheus.MustRegister(hook_handlers.MetricsAsyncQueueLength)
+	prometheus.MustRegister(hook_handlers.MetricsAsyncQueueOverflowTotal)
+	prometheus.MustRegister(jobqueue.MetricsJobsTotal)
+	prometheus.MustRegister(quota.MetricsQuotaUsage)
+	prometheus.MustRegister(events.MetricsEventsDroppedTotal)
 
 	log.Stdout.Printf("Using %s as the metrics path.\n", Flags.MetricsPath)
 	mux.Handle(Flags.MetricsPath, promhttp.Handler())
@@ -0,0 +1,80 @@
+package cli
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"codiewuploader/internal/hook_handlers"
+	"codiewuploader/internal/log"
+	"codiewuploader/internal/quota"
+
+	tushandler "github.com/tus/tusd/v2/pkg/handler"
+)
+
+type quotaResponse struct {
+	Scope  string       `json:"scope"`
+	Id     string       `json:"id"`
+	Usage  quota.Usage  `json:"usage"`
+	Limits quota.Limits `json:"limits"`
+}
+
+func SetupQuota(mux *http.ServeMux, hookHandler *hook_handlers.Handler, cors *tushandler.CorsConfig) {
+	HandleCors(mux, cors, "/quota/{scope}/{id}", QuotaHandler(hookHandler))
+}
+
+// QuotaHandler shows the current usage and limits of a user or an entity. A
+// user may only see their own usage and the usage of the entities the entity
+// authorizer lets them access. Without the quota stage there is nothing to
+// show.
+func QuotaHandler(hookHandler *hook_handlers.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scope := r.PathValue("scope")
+		id := r.PathValue("id")
+
+		store := hookHandler.Quota().Store()
+		if store == nil {
+			http.Error(w, "Quotas are disabled", http.StatusNotFound)
+			return
+		}
+
+		if scope != quota.ScopeUser && scope != quota.ScopeEntity {
+			http.Error(w, "Unknown quota scope", http.StatusNotFound)
+			return
+		}
+
+		token := r.Header.Get("Upload-Token")
+		claims, reason := hookHandler.Auth().Authenticate(r.Context(), token)
+		if reason != "" {
+			http.Error(w, hook_handlers.ErrInvalidToken+": "+string(reason), http.StatusUnauthorized)
+			return
+		}
+
+		switch scope {
+		case quota.ScopeUser:
+			if claims["sub"] != id {
+				http.Error(w, "Access denied", http.StatusForbidden)
+				return
+			}
+
+		case quota.ScopeEntity:
+			allowed, err := hookHandler.AuthorizeEntity(r.Context(), token, claims, id)
+			if err != nil {
+				log.Stderr.Printf("Entity authorization failed for %s: %s", id, err)
+				http.Error(w, "Unable to check access to the entity", http.StatusServiceUnavailable)
+				return
+			}
+			if !allowed {
+				http.Error(w, "Access denied", http.StatusForbidden)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(quotaResponse{
+			Scope:  scope,
+			Id:     id,
+			Usage:  store.Usage(scope, id),
+			Limits: store.Limits(scope),
+		})
+	}
+}
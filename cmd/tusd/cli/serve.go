@@ -2,15 +2,9 @@ package cli
 
 import (
 	"codiewuploader/internal/log"
-	"codiewuploader/internal/utils"
 	"context"
 	"crypto/tls"
 	"errors"
-	"fmt"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/tus/tusd/v2/pkg/s3store"
-	"io"
 	"net"
 	"net/http"
 	"os"
@@ -41,10 +35,11 @@ const (
 // is put in place.
 func Serve() {
 	storeComposer := composer.Composer
+	cors := getCorsConfig()
 	config := tushandler.Config{
 		MaxSize:                          Flags.MaxSize,
 		BasePath:                         Flags.Basepath,
-		Cors:                             getCorsConfig(),
+		Cors:                             cors,
 		RespectForwardedHeaders:          Flags.BehindProxy,
 		EnableExperimentalProtocol:       Flags.ExperimentalProtocol,
 		DisableDownload:                  Flags.DisableDownload,
@@ -58,7 +53,11 @@ func Serve() {
 
 	var err error
 
-	hookHandler := hook_handlers.NewHandler(Flags.S3Endpoint)
+	hookHandler := hook_handlers.NewHandler(Flags.S3Endpoint, Flags.UploadDir)
+	if err := hookHandler.UseOrder(Flags.HooksOrder, getExternalHooks()); err != nil {
+		log.Stderr.Fatalf("Invalid hooks order: %s", err)
+	}
+
 	handler, err := hooks.NewHandlerWithHooks(&config, hookHandler, Flags.EnabledHooks)
 
 	var enabledHooksString []string
@@ -74,6 +73,8 @@ func Serve() {
 
 	log.Stdout.Printf("Supported tus extensions: %s\n", handler.SupportedExtensions())
 
+	uploads := AuthorizeUploads(handler, hookHandler.Auth(), storeComposer.Core, cors)
+
 	basepath := Flags.Basepath
 	address := ""
 
@@ -91,7 +92,7 @@ func Serve() {
 	if basepath == "/" {
 		// If the basepath is set to the root path, only install the tusd handler
 		// and do not show a greeting.
-		mux.Handle("/", http.StripPrefix("/", handler))
+		mux.Handle("/", http.StripPrefix("/", uploads))
 	} else {
 		// If a custom basepath is defined, we show a greeting at the root path...
 		if Flags.ShowGreeting {
@@ -103,8 +104,8 @@ func Serve() {
 		basepathWithoutSlash := strings.TrimSuffix(basepath, "/")
 		basepathWithSlash := basepathWithoutSlash + "/"
 
-		mux.Handle(basepathWithSlash, http.StripPrefix(basepathWithSlash, handler))
-		mux.Handle(basepathWithoutSlash, http.StripPrefix(basepathWithoutSlash, handler))
+		mux.Handle(basepathWithSlash, http.StripPrefix(basepathWithSlash, uploads))
+		mux.Handle(basepathWithoutSlash, http.StripPrefix(basepathWithoutSlash, uploads))
 	}
 
 	if Flags.ExposeMetrics {
@@ -124,40 +125,10 @@ func Serve() {
 		w.Write([]byte("Maks"))
 	}))
 
-	mux.Handle("/list/{bucket}/{recordId}/{filename}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		path := strings.TrimPrefix(r.URL.Path, "/list/")
-		parts := strings.SplitN(path, "/", 3)
-
-		if len(parts) < 3 {
-			http.Error(w, "Invalid URL", http.StatusBadRequest)
-			return
-		}
-
-		bucket := parts[0]
-		recordId := parts[1]
-		filename := parts[2]
-
-		res, err := composer.Composer.Core.(s3store.S3Store).Service.GetObject(context.Background(), &s3.GetObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(fmt.Sprintf("%s/%s", recordId, filename)),
-		})
-
-		if err != nil {
-			http.Error(w, "Invalid data in s3", http.StatusBadRequest)
-			return
-		}
-
-		contentType, contentDisposition := utils.FilterContentType(*res.ContentType, filename)
-
-		headers := w.Header()
-		headers.Add("Content-Type", contentType)
-		headers.Add("Content-Disposition", contentDisposition)
-		w.WriteHeader(http.StatusOK)
-
-		io.Copy(w, res.Body)
-		res.Body.Close()
-	}))
+	SetupList(mux, hookHandler.ResultBucket())
+	SetupQuota(mux, hookHandler, cors)
+	SetupStatus(mux, hookHandler, cors)
+	SetupEvents(mux, hookHandler, cors)
 
 	var listener net.Listener
 	if Flags.HttpSock != "" {
@@ -330,6 +301,8 @@ func getCorsConfig() *tushandler.CorsConfig {
 	config.Disable = Flags.DisableCors
 	config.AllowCredentials = true
 	config.MaxAge = Flags.CorsMaxAge
+	// Токен нужен на всех запросах к загрузке, не только на создании
+	config.AllowHeaders += ", Upload-Token"
 
 	var err error
 	config.AllowOrigin, err = regexp.Compile(Flags.CorsAllowOrigin)
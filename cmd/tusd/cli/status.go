@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"codiewuploader/internal/hook_handlers"
+	"codiewuploader/internal/status"
+
+	tushandler "github.com/tus/tusd/v2/pkg/handler"
+)
+
+type entityStatusResponse struct {
+	EntityId string          `json:"entityId"`
+	Uploads  []status.Upload `json:"uploads"`
+}
+
+func SetupStatus(mux *http.ServeMux, hookHandler *hook_handlers.Handler, cors *tushandler.CorsConfig) {
+	HandleCors(mux, cors, "/status/{uploadId}", StatusHandler(hookHandler))
+	HandleCors(mux, cors, "/status/entity/{entityId}", EntityStatusHandler(hookHandler))
+}
+
+// StatusHandler shows the processing stages of an upload. Only the owner of
+// the upload may see them.
+func StatusHandler(hookHandler *hook_handlers.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, reason := hookHandler.Auth().Authenticate(r.Context(), r.Header.Get("Upload-Token"))
+		if reason != "" {
+			http.Error(w, hook_handlers.ErrInvalidToken+": "+string(reason), http.StatusUnauthorized)
+			return
+		}
+
+		// Клиент знает полный tus id "uploadId+multipartId", статус хранится по uploadId
+		uploadId, _, _ := strings.Cut(r.PathValue("uploadId"), "+")
+
+		// Чужую загрузку не отличаем от несуществующей
+		upload, ok := hookHandler.Status().Get(uploadId)
+		if !ok || claims["sub"] != upload.UserId {
+			http.Error(w, "Upload status not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(upload)
+	}
+}
+
+// EntityStatusHandler lists the processing stages of the entity's uploads
+// made by the user, the recently updated first.
+func EntityStatusHandler(hookHandler *hook_handlers.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, reason := hookHandler.Auth().Authenticate(r.Context(), r.Header.Get("Upload-Token"))
+		if reason != "" {
+			http.Error(w, hook_handlers.ErrInvalidToken+": "+string(reason), http.StatusUnauthorized)
+			return
+		}
+
+		entityId := r.PathValue("entityId")
+
+		// Загрузки других пользователей в ту же сущность не показываем
+		uploads := []status.Upload{}
+		for _, upload := range hookHandler.Status().Entity(entityId) {
+			if claims["sub"] == upload.UserId {
+				uploads = append(uploads, upload)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entityStatusResponse{
+			EntityId: entityId,
+			Uploads:  uploads,
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package clamd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// DefaultChunkSize is the INSTREAM chunk size, clamd reads chunks of any size
+// up to its StreamMaxLength.
+const DefaultChunkSize = 64 << 10
+
+var ErrSizeLimit = errors.New("clamd: stream size limit exceeded")
+
+// Result of a scan. Signature is the name of the detected malware.
+type Result struct {
+	Infected  bool
+	Signature string
+}
+
+// Client talks to clamd over TCP ("tcp", "127.0.0.1:3310") or a unix socket
+// ("unix", "/run/clamav/clamd.ctl").
+type Client struct {
+	Network   string
+	Address   string
+	Timeout   time.Duration
+	ChunkSize int
+}
+
+// Ping checks that clamd answers.
+func (c *Client) Ping(ctx context.Context) error {
+	reply, err := c.command(ctx, "zPING\x00", nil)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("clamd: unexpected ping reply %q", reply)
+	}
+
+	return nil
+}
+
+// Scan streams the content to clamd with the INSTREAM command.
+func (c *Client) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	reply, err := c.command(ctx, "zINSTREAM\x00", r)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return parseReply(reply)
+}
+
+func (c *Client) command(ctx context.Context, cmd string, stream io.Reader) (string, error) {
+	dialer := net.Dialer{Timeout: c.Timeout}
+	conn, err := dialer.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := io.WriteString(conn, cmd); err != nil {
+		return "", err
+	}
+
+	var writeErr error
+	if stream != nil {
+		writeErr = c.writeChunks(conn, stream)
+	}
+
+	// clamd отвечает и закрывает соединение, если поток превысил лимит, поэтому
+	// ответ читаем даже после ошибки записи
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if reply == "" && writeErr != nil {
+		return "", writeErr
+	}
+	if err != nil && !(errors.Is(err, io.EOF) && reply != "") {
+		return "", err
+	}
+
+	return strings.TrimRight(reply, "\x00\n"), nil
+}
+
+// writeChunks sends the stream as length-prefixed chunks, a zero length ends it
+func (c *Client) writeChunks(w io.Writer, r io.Reader) error {
+	size := c.ChunkSize
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+
+	buf := make([]byte, 4+size)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, err := w.Write(buf[:4+n]); err != nil {
+				return fmt.Errorf("clamd: %w", err)
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// parseReply understands "stream: OK", "stream: <signature> FOUND" and
+// "<message> ERROR".
+func parseReply(reply string) (Result, error) {
+	_, status, _ := strings.Cut(reply, ": ")
+	if status == "" {
+		status = reply
+	}
+
+	switch {
+	case status == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(status, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(status, " FOUND")}, nil
+	case strings.Contains(reply, "size limit exceeded"):
+		return Result{}, ErrSizeLimit
+	default:
+		return Result{}, fmt.Errorf("clamd: unexpected reply %q", reply)
+	}
+}
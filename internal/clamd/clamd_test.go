@@ -0,0 +1,216 @@
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// fakeServer is a clamd answering a single connection: it records the command
+// and the INSTREAM chunks and replies with reply(stream).
+type fakeServer struct {
+	listener net.Listener
+	done     chan struct{}
+
+	command string
+	chunks  []int
+	stream  []byte
+	err     error
+}
+
+func newFakeServer(t *testing.T, maxLength int, reply func(stream []byte) string) *fakeServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := &fakeServer{listener: listener, done: make(chan struct{})}
+	go s.serve(maxLength, reply)
+
+	return s
+}
+
+func (s *fakeServer) serve(maxLength int, reply func(stream []byte) string) {
+	defer close(s.done)
+
+	conn, err := s.listener.Accept()
+	if err != nil {
+		s.err = err
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	s.command, s.err = r.ReadString(0)
+	if s.err != nil || s.command != "zINSTREAM\x00" {
+		io.WriteString(conn, reply(nil)+"\x00")
+		return
+	}
+
+	for {
+		var size uint32
+		if s.err = binary.Read(r, binary.BigEndian, &size); s.err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		s.chunks = append(s.chunks, int(size))
+
+		chunk := make([]byte, size)
+		if _, s.err = io.ReadFull(r, chunk); s.err != nil {
+			return
+		}
+		s.stream = append(s.stream, chunk...)
+
+		if maxLength > 0 && len(s.stream) > maxLength {
+			// Как clamd: отвечаем сразу, остаток потока уже не нужен
+			io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\x00")
+			io.Copy(io.Discard, r)
+			return
+		}
+	}
+
+	io.WriteString(conn, reply(s.stream)+"\x00")
+}
+
+func (s *fakeServer) client() *Client {
+	return &Client{
+		Network:   "tcp",
+		Address:   s.listener.Addr().String(),
+		Timeout:   time.Second,
+		ChunkSize: 4,
+	}
+}
+
+func TestScanFraming(t *testing.T) {
+	server := newFakeServer(t, 0, func(stream []byte) string {
+		return "stream: OK"
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	content := []byte("0123456789")
+	result, err := server.client().Scan(ctx, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	<-server.done
+
+	if server.err != nil {
+		t.Fatalf("server: %v", server.err)
+	}
+	if server.command != "zINSTREAM\x00" {
+		t.Errorf("command = %q, want zINSTREAM", server.command)
+	}
+	if want := []int{4, 4, 2}; !slices.Equal(server.chunks, want) {
+		t.Errorf("chunks = %v, want %v", server.chunks, want)
+	}
+	if !bytes.Equal(server.stream, content) {
+		t.Errorf("stream = %q, want %q", server.stream, content)
+	}
+	if result.Infected {
+		t.Errorf("result = %+v, want clean", result)
+	}
+}
+
+func TestScanReplies(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxLength int
+		reply     string
+		content   string
+		want      Result
+		wantErr   error
+	}{
+		{
+			name:    "clean",
+			reply:   "stream: OK",
+			content: "hello",
+		},
+		{
+			name:    "infected",
+			reply:   "stream: Eicar-Test-Signature FOUND",
+			content: "X5O!P%@AP",
+			want:    Result{Infected: true, Signature: "Eicar-Test-Signature"},
+		},
+		{
+			name:      "size limit",
+			maxLength: 8,
+			content:   strings.Repeat("a", 64),
+			wantErr:   ErrSizeLimit,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer(t, tt.maxLength, func([]byte) string { return tt.reply })
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			result, err := server.client().Scan(ctx, strings.NewReader(tt.content))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if result != tt.want {
+				t.Errorf("result = %+v, want %+v", result, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseReply(t *testing.T) {
+	tests := []struct {
+		reply   string
+		want    Result
+		wantErr bool
+	}{
+		{reply: "stream: OK", want: Result{}},
+		{reply: "OK", want: Result{}},
+		{reply: "stream: Win.Test.EICAR_HDB-1 FOUND", want: Result{Infected: true, Signature: "Win.Test.EICAR_HDB-1"}},
+		{reply: "INSTREAM size limit exceeded. ERROR", wantErr: true},
+		{reply: "stream: Can't allocate memory ERROR", wantErr: true},
+		{reply: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.reply, func(t *testing.T) {
+			result, err := parseReply(tt.reply)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if result != tt.want {
+				t.Errorf("result = %+v, want %+v", result, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseReply("INSTREAM size limit exceeded. ERROR"); !errors.Is(err, ErrSizeLimit) {
+		t.Errorf("size limit reply: err = %v, want ErrSizeLimit", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	server := newFakeServer(t, 0, func([]byte) string { return "PONG" })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := server.client().Ping(ctx); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+}
@@ -1,6 +1,12 @@
 package config
 
-import "time"
+import (
+	"codiewuploader/internal/quota"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type S3ClientConfig struct {
 	S3Bucket                     string
@@ -18,8 +24,185 @@ type S3ClientConfig struct {
 }
 
 type AppConfig struct {
-	JwtSecret  string
+	JwtSecrets       []string
+	JwtJwks          string
+	JwtJwksCacheTTL  time.Duration
+	JwtAudience      []string
+	JwtIssuer        string
+	JwtClockSkew     time.Duration
+	JwtRequireExpiry bool
+
+	EntityAuthMode    string
+	EntityAuthClaim   string
+	EntityAuthURL     string
+	EntityAuthTimeout time.Duration
+	EntityAuthStub    string
+
+	MetadataSchema MetadataSchema
+	// MetadataMerge maps a metadata key to its merge policy when several
+	// stages change it in one hook
+	MetadataMerge map[string]string
+
+	// QuarantineBucket keeps rejected and infected uploads, it must be a
+	// bucket of its own
+	QuarantineBucket string
+	QuarantinePrefix string
+
+	ClamdNetwork          string
+	ClamdAddress          string
+	ClamdTimeout          time.Duration
+	ClamdDialTimeout      time.Duration
+	ClamdFailOpen         bool
+	ClamdQuarantinePrefix string
+	// ClamdSizeLimitAction is what happens to a file above the clamd stream
+	// limit: ClamdSizeLimitReject stops it, ClamdSizeLimitSkip lets it pass
+	// unscanned
+	ClamdSizeLimitAction string
+
+	QuotaFile           string
+	QuotaUser           quota.Limits
+	QuotaEntity         quota.Limits
+	QuotaReservationTTL time.Duration
+
 	S3Endpoint string
 
 	ResultBucket string
+
+	FfmpegPath    string
+	FfprobePath   string
+	FfmpegTimeout time.Duration
+	VideoPreset   string
+
+	Renditions  []Rendition
+	JpegQuality int
+
+	ImageLimits  ImageLimits
+	ImageWorkers int
+	ImageFormats []string
+
+	Watermarks WatermarkConfig
+
+	SwampCleanupDryRun bool
+
+	AsyncWorkers      int
+	AsyncQueueSize    int
+	AsyncQueueTimeout time.Duration
+	StatusDir         string
+	StatusMaxAge      time.Duration
+
+	JobsDir        string
+	JobWorkers     int
+	JobMaxAttempts int
+	JobBackoff     time.Duration
+	JobMaxBackoff  time.Duration
+}
+
+// Rendition is a named target width for resized image copies
+type Rendition struct {
+	Name  string
+	Width int
 }
+
+// ImageLimits bound the images accepted for decoding, zero means no limit.
+type ImageLimits struct {
+	MaxWidth      int
+	MaxHeight     int
+	MaxMegapixels float64
+	// FormatMegapixels overrides MaxMegapixels per decoder format (png, gif, heic...)
+	FormatMegapixels map[string]float64
+}
+
+// ParseFormatLimits parses a list like "png:40,gif:10" into megapixels per format
+func ParseFormatLimits(value string) (map[string]float64, error) {
+	limits := make(map[string]float64)
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		format, megapixels, ok := strings.Cut(item, ":")
+		if !ok || format == "" {
+			return nil, fmt.Errorf("invalid format limit %q, expected format:megapixels", item)
+		}
+
+		mp, err := strconv.ParseFloat(megapixels, 64)
+		if err != nil || mp <= 0 {
+			return nil, fmt.Errorf("invalid megapixels in format limit %q", item)
+		}
+
+		limits[strings.ToLower(format)] = mp
+	}
+
+	return limits, nil
+}
+
+// ParseRenditions parses a list like "thumb:320,card:800,full:1920"
+func ParseRenditions(value string) ([]Rendition, error) {
+	var renditions []Rendition
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, width, ok := strings.Cut(item, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid rendition %q, expected name:width", item)
+		}
+
+		w, err := strconv.Atoi(width)
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("invalid width in rendition %q", item)
+		}
+
+		renditions = append(renditions, Rendition{Name: name, Width: w})
+	}
+
+	return renditions, nil
+}
+
+// Merge policies for a metadata key changed by several stages in one hook
+const (
+	// MergeLast keeps the value of the last stage
+	MergeLast = "last"
+	// MergeFirst keeps the value of the first stage, later changes are ignored
+	MergeFirst = "first"
+	// MergeAppend joins the distinct values with a comma
+	MergeAppend = "append"
+	// MergeReject fails the hook when the stages disagree
+	MergeReject = "reject"
+)
+
+// ParseMergePolicies parses a list like "userId:first,tags:append"
+func ParseMergePolicies(value string) (map[string]string, error) {
+	policies := make(map[string]string)
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		key, policy, ok := strings.Cut(item, ":")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid merge policy %q, expected key:policy", item)
+		}
+
+		switch policy {
+		case MergeLast, MergeFirst, MergeAppend, MergeReject:
+			policies[key] = policy
+		default:
+			return nil, fmt.Errorf("unknown merge policy %q for key %s", policy, key)
+		}
+	}
+
+	return policies, nil
+}
+
+const (
+	ClamdSizeLimitReject = "reject"
+	ClamdSizeLimitSkip   = "skip"
+)
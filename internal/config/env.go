@@ -0,0 +1,78 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Env reads typed env vars. An unset or empty var gives the fallback, an
+// invalid one is collected and returned by Err, so a typo stops the startup
+// instead of silently running with the default.
+type Env struct {
+	errs []error
+}
+
+// Err returns all invalid env vars read so far
+func (e *Env) Err() error {
+	return errors.Join(e.errs...)
+}
+
+func (e *Env) fail(key, value string, err error) {
+	e.errs = append(e.errs, fmt.Errorf("invalid %s %q: %w", key, value, err))
+}
+
+// String returns the value of the env var or fallback if it's unset or empty.
+func (e *Env) String(key, fallback string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+
+	return fallback
+}
+
+// Duration parses the env var as time.Duration.
+func (e *Env) Duration(key string, fallback time.Duration) time.Duration {
+	return parseEnv(e, key, fallback, time.ParseDuration)
+}
+
+// Int parses the env var as int.
+func (e *Env) Int(key string, fallback int) int {
+	return parseEnv(e, key, fallback, strconv.Atoi)
+}
+
+// Bool parses the env var as bool.
+func (e *Env) Bool(key string, fallback bool) bool {
+	return parseEnv(e, key, fallback, strconv.ParseBool)
+}
+
+// Int64 parses the env var as int64.
+func (e *Env) Int64(key string, fallback int64) int64 {
+	return parseEnv(e, key, fallback, func(value string) (int64, error) {
+		return strconv.ParseInt(value, 10, 64)
+	})
+}
+
+// Float parses the env var as float64.
+func (e *Env) Float(key string, fallback float64) float64 {
+	return parseEnv(e, key, fallback, func(value string) (float64, error) {
+		return strconv.ParseFloat(value, 64)
+	})
+}
+
+func parseEnv[T any](e *Env, key string, fallback T, parse func(string) (T, error)) T {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	val, err := parse(value)
+	if err != nil {
+		e.fail(key, value, err)
+		return fallback
+	}
+
+	return val
+}
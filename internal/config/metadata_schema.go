@@ -0,0 +1,89 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// MediaTypeRule lists what may be uploaded under a mediatype.
+type MediaTypeRule struct {
+	// FileTypes are the allowed filetype values, "image/*" allows the whole
+	// family. Empty allows any filetype.
+	FileTypes []string `json:"fileTypes"`
+	// Extensions are the allowed filename extensions with the dot, case
+	// insensitive. Empty allows any extension.
+	Extensions []string `json:"extensions"`
+}
+
+// FilenameRule restricts the filename. Path separators and control
+// characters are never allowed.
+type FilenameRule struct {
+	MaxLength int `json:"maxLength"`
+	// Pattern is an optional regular expression the whole filename must match.
+	Pattern string `json:"pattern"`
+}
+
+// MetadataSchema describes the upload metadata accepted in pre-create.
+type MetadataSchema struct {
+	// Required keys must be present and non-empty.
+	Required []string `json:"required"`
+	// IdPattern is the regular expression for the entity id.
+	IdPattern   string   `json:"idPattern"`
+	RecordTypes []string `json:"recordTypes"`
+	// DefaultRecordType is set when the client sends no recordType, so
+	// older clients still get their files moved.
+	DefaultRecordType string `json:"defaultRecordType"`
+	// MediaTypes maps the allowed mediatype values to their rules.
+	MediaTypes map[string]MediaTypeRule `json:"mediaTypes"`
+	Filename   FilenameRule             `json:"filename"`
+}
+
+// DefaultMetadataSchema accepts what MoveHandler and the converters can handle.
+func DefaultMetadataSchema() MetadataSchema {
+	return MetadataSchema{
+		Required:          []string{"id", "filename", "mediatype"},
+		IdPattern:         `^[A-Za-z0-9_-]{1,64}$`,
+		RecordTypes:       []string{"single", "multi"},
+		DefaultRecordType: "single",
+		MediaTypes: map[string]MediaTypeRule{
+			"image": {
+				FileTypes:  []string{"image/jpeg", "image/png", "image/heic", "image/heif"},
+				Extensions: []string{".jpg", ".jpeg", ".png", ".heic", ".heif"},
+			},
+			"video": {
+				FileTypes: []string{"video/*"},
+			},
+			"document": {
+				FileTypes:  []string{"application/pdf"},
+				Extensions: []string{".pdf"},
+			},
+		},
+		Filename: FilenameRule{MaxLength: 255},
+	}
+}
+
+// LoadMetadataSchema reads the schema from a JSON file, fields missing in the
+// file keep their defaults.
+func LoadMetadataSchema(path string) (MetadataSchema, error) {
+	schema := DefaultMetadataSchema()
+	if path == "" {
+		return schema, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return schema, err
+	}
+
+	// Типы из файла заменяют дефолтные целиком, а не дополняют их
+	schema.MediaTypes = nil
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return schema, fmt.Errorf("invalid metadata schema %s: %w", path, err)
+	}
+	if schema.MediaTypes == nil {
+		schema.MediaTypes = DefaultMetadataSchema().MediaTypes
+	}
+
+	return schema, nil
+}
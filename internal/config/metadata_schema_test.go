@@ -0,0 +1,51 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadMetadataSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schema.json")
+	file := `{"required": ["id", "recordType"], "mediaTypes": {"image": {"fileTypes": ["image/png"]}}}`
+	if err := os.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	schema, err := LoadMetadataSchema(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(schema.Required) != 2 || schema.Required[1] != "recordType" {
+		t.Errorf("required = %v, want the file's keys", schema.Required)
+	}
+	if len(schema.MediaTypes) != 1 {
+		t.Errorf("media types = %v, want only the file's types", schema.MediaTypes)
+	}
+	// Не заданные в файле поля остаются по умолчанию
+	if schema.DefaultRecordType != "single" || schema.IdPattern == "" || schema.Filename.MaxLength != 255 {
+		t.Errorf("schema = %+v, want the defaults for the missing fields", schema)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"required": "id"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadMetadataSchema(path); err == nil {
+		t.Error("invalid schema accepted")
+	}
+}
+
+func TestDefaultMetadataSchemaRecordType(t *testing.T) {
+	schema := DefaultMetadataSchema()
+
+	for _, key := range schema.Required {
+		if key == "recordType" {
+			t.Error("recordType is required by default")
+		}
+	}
+	if schema.DefaultRecordType != "single" {
+		t.Errorf("default recordType = %q, want single", schema.DefaultRecordType)
+	}
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// StageConfig enables one stage of the hook pipeline.
+type StageConfig struct {
+	// Name of the stage: auth, metadata, entity-auth, quota, content-sniff,
+	// antivirus, heic-converter, ffmpeg-convert or move.
+	Name string `json:"name"`
+	// Hooks the stage subscribes to, e.g. ["post-finish"]. Empty subscribes to
+	// all hooks the stage supports.
+	Hooks []string `json:"hooks"`
+	// Async stages run in the background worker pool, their results are only
+	// reported through the status API and they can't stop the upload.
+	// Consecutive async stages run in order as one job. Not allowed for
+	// pre-create and pre-finish.
+	Async bool `json:"async"`
+	// Options override the env configuration for this stage only, the keys
+	// depend on the stage.
+	Options json.RawMessage `json:"options"`
+}
+
+// PipelineConfig lists the stages in the order they are invoked.
+type PipelineConfig struct {
+	Stages []StageConfig `json:"stages"`
+}
+
+// DefaultPipelineConfig is the built-in chain with every stage enabled.
+func DefaultPipelineConfig() PipelineConfig {
+	names := []string{
+		"auth",
+		"metadata",
+		"entity-auth",
+		// Квоты резервируются последними из pre-create проверок, чтобы отказ после них не оставлял резерв
+		"quota",
+		// Проверка содержимого первой из post-finish: дальше идет уже определенный тип
+		"content-sniff",
+		"antivirus",
+		"heic-converter",
+		// Видео конвертируем до переноса: после него MoveHandler чистит исходник в болоте
+		"ffmpeg-convert",
+		"move",
+	}
+
+	cfg := PipelineConfig{}
+	for _, name := range names {
+		cfg.Stages = append(cfg.Stages, StageConfig{Name: name})
+	}
+
+	return cfg
+}
+
+// LoadPipelineConfig reads the pipeline from a JSON or, by the .yaml/.yml
+// extension, a YAML file. Without a file the default pipeline is used.
+func LoadPipelineConfig(path string) (PipelineConfig, error) {
+	if path == "" {
+		return DefaultPipelineConfig(), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return PipelineConfig{}, err
+	}
+
+	// YAML переводим в JSON: опции стадий и Duration разбираются только из JSON
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if data, err = yaml.YAMLToJSON(data); err != nil {
+			return PipelineConfig{}, fmt.Errorf("invalid pipeline config %s: %w", path, err)
+		}
+	}
+
+	var cfg PipelineConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("invalid pipeline config %s: %w", path, err)
+	}
+	if len(cfg.Stages) == 0 {
+		return cfg, fmt.Errorf("pipeline config %s has no stages", path)
+	}
+
+	return cfg, nil
+}
+
+// Duration is a time.Duration written as "30s" or "5m" in the configs.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
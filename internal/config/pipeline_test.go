@@ -0,0 +1,109 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadPipelineConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		wantErr bool
+	}{
+		{
+			name: "json",
+			file: "pipeline.json",
+			content: `{"stages": [
+				{"name": "auth"},
+				{"name": "antivirus", "hooks": ["post-finish"], "async": true, "options": {"address": "clamd:3310", "timeout": "30s"}}
+			]}`,
+		},
+		{
+			name: "yaml",
+			file: "pipeline.yaml",
+			content: `
+stages:
+  - name: auth
+  - name: antivirus
+    hooks: [post-finish]
+    async: true
+    options:
+      address: clamd:3310
+      timeout: 30s
+`,
+		},
+		{
+			name: "yml",
+			file: "pipeline.YML",
+			content: `
+stages:
+  - name: auth
+  - name: antivirus
+    hooks: ["post-finish"]
+    async: true
+    options: {address: "clamd:3310", timeout: "30s"}
+`,
+		},
+		{name: "invalid json", file: "pipeline.json", content: `{"stages": [`, wantErr: true},
+		{name: "invalid yaml", file: "pipeline.yaml", content: "stages:\n  - name: [auth", wantErr: true},
+		// Без расширения .yaml файл читается как JSON
+		{name: "yaml without extension", file: "pipeline", content: "stages:\n  - name: auth\n", wantErr: true},
+		{name: "no stages", file: "pipeline.yaml", content: "stages: []\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := LoadPipelineConfig(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if len(cfg.Stages) != 2 || cfg.Stages[0].Name != "auth" {
+				t.Fatalf("stages = %+v, want auth and antivirus", cfg.Stages)
+			}
+			antivirus := cfg.Stages[1]
+			if antivirus.Name != "antivirus" || !antivirus.Async || len(antivirus.Hooks) != 1 || antivirus.Hooks[0] != "post-finish" {
+				t.Errorf("antivirus stage = %+v", antivirus)
+			}
+
+			// Опции стадии остаются JSON и в YAML файле
+			var options struct {
+				Address string   `json:"address"`
+				Timeout Duration `json:"timeout"`
+			}
+			if err := json.Unmarshal(antivirus.Options, &options); err != nil {
+				t.Fatalf("options %s: %v", antivirus.Options, err)
+			}
+			if options.Address != "clamd:3310" || time.Duration(options.Timeout) != 30*time.Second {
+				t.Errorf("options = %+v", options)
+			}
+		})
+	}
+}
+
+func TestLoadPipelineConfigDefault(t *testing.T) {
+	cfg, err := LoadPipelineConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Stages) != len(DefaultPipelineConfig().Stages) || cfg.Stages[0].Name != "auth" {
+		t.Errorf("stages = %+v, want the default pipeline", cfg.Stages)
+	}
+
+	if _, err := LoadPipelineConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("missing file accepted")
+	}
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// DefaultWatermarkImage is the watermark embedded into the binary, used when no
+// profiles are configured.
+const DefaultWatermarkImage = "embed:watermark60.png"
+
+// WatermarkProfile describes how a watermark is placed on an image.
+type WatermarkProfile struct {
+	// Image is a file path or "embed:<name>" for the assets embedded into the binary.
+	// An empty image disables the watermark.
+	Image string `json:"image"`
+	// Opacity from 0 to 1, defaults to 1.
+	Opacity float64 `json:"opacity"`
+	// Anchor is one of center, top-left, top, top-right, left, right,
+	// bottom-left, bottom, bottom-right. Defaults to center.
+	Anchor string `json:"anchor"`
+	// Margin from the image edges as a fraction of the shorter side.
+	Margin float64 `json:"margin"`
+	// Scale of the watermark relative to the ScaleBy side of the image, defaults to 1.
+	Scale float64 `json:"scale"`
+	// ScaleBy is "width" (default) or "height".
+	ScaleBy string `json:"scaleBy"`
+	// Tile repeats the watermark over the whole image, Anchor is ignored.
+	Tile bool `json:"tile"`
+}
+
+// WatermarkConfig holds the named watermark profiles and the rules to pick one.
+type WatermarkConfig struct {
+	// Default is the profile used when neither the upload nor the bucket selects one.
+	Default string `json:"default"`
+	// Buckets maps a result bucket to its profile.
+	Buckets map[string]string `json:"buckets"`
+	// Selectable lists the profiles an upload may request with the watermark
+	// metadata key. Profiles without an image, like "none", can't be listed:
+	// a client mustn't be able to drop the watermark.
+	Selectable []string                    `json:"selectable"`
+	Profiles   map[string]WatermarkProfile `json:"profiles"`
+}
+
+// DefaultWatermarkConfig keeps the original behaviour: the 60% watermark
+// stretched to the full width and centred vertically.
+func DefaultWatermarkConfig() WatermarkConfig {
+	return WatermarkConfig{
+		Default:    "default",
+		Selectable: []string{"default"},
+		Profiles: map[string]WatermarkProfile{
+			"default": {Image: DefaultWatermarkImage, Opacity: 1, Anchor: "center", Scale: 1, ScaleBy: "width"},
+			"none":    {},
+		},
+	}
+}
+
+// LoadWatermarkConfig reads the profiles from a JSON file. The "default" and
+// "none" profiles are always available unless the file redefines them.
+func LoadWatermarkConfig(path string) (WatermarkConfig, error) {
+	cfg := DefaultWatermarkConfig()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+
+	var fileCfg WatermarkConfig
+	if err := json.Unmarshal(data, &fileCfg); err != nil {
+		return cfg, fmt.Errorf("invalid watermark profiles %s: %w", path, err)
+	}
+
+	for name, profile := range fileCfg.Profiles {
+		cfg.Profiles[name] = profile
+	}
+	if fileCfg.Default != "" {
+		cfg.Default = fileCfg.Default
+	}
+	cfg.Buckets = fileCfg.Buckets
+	if fileCfg.Selectable != nil {
+		cfg.Selectable = fileCfg.Selectable
+	}
+
+	if _, ok := cfg.Profiles[cfg.Default]; !ok {
+		return cfg, fmt.Errorf("default watermark profile %q is not defined", cfg.Default)
+	}
+	for bucket, name := range cfg.Buckets {
+		if _, ok := cfg.Profiles[name]; !ok {
+			return cfg, fmt.Errorf("watermark profile %q for bucket %s is not defined", name, bucket)
+		}
+	}
+	for _, name := range cfg.Selectable {
+		profile, ok := cfg.Profiles[name]
+		if !ok {
+			return cfg, fmt.Errorf("selectable watermark profile %q is not defined", name)
+		}
+		if profile.Image == "" {
+			return cfg, fmt.Errorf("watermark profile %q has no image and can't be selectable", name)
+		}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadWatermarkConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		wantErr string
+		check   func(t *testing.T, cfg WatermarkConfig)
+	}{
+		{
+			name: "profiles merged with the built-in ones",
+			file: `{"default": "corner", "buckets": {"rent_result": "corner"}, "selectable": ["default", "corner"],
+				"profiles": {"corner": {"image": "embed:watermark60.png", "anchor": "bottom-right", "scale": 0.2}}}`,
+			check: func(t *testing.T, cfg WatermarkConfig) {
+				if cfg.Default != "corner" || cfg.Buckets["rent_result"] != "corner" {
+					t.Errorf("config = %+v, want corner by default and for the bucket", cfg)
+				}
+				for _, name := range []string{"default", "none", "corner"} {
+					if _, ok := cfg.Profiles[name]; !ok {
+						t.Errorf("profile %q is missing", name)
+					}
+				}
+			},
+		},
+		{
+			name: "selectable kept without the key",
+			file: `{"profiles": {"corner": {"image": "a.png"}}}`,
+			check: func(t *testing.T, cfg WatermarkConfig) {
+				if len(cfg.Selectable) != 1 || cfg.Selectable[0] != "default" {
+					t.Errorf("selectable = %v, want only default", cfg.Selectable)
+				}
+			},
+		},
+		{name: "unknown default", file: `{"default": "missing"}`, wantErr: "default watermark profile"},
+		{name: "unknown bucket profile", file: `{"buckets": {"b": "missing"}}`, wantErr: "for bucket b"},
+		{name: "unknown selectable", file: `{"selectable": ["missing"]}`, wantErr: "selectable watermark profile"},
+		{name: "selectable none", file: `{"selectable": ["default", "none"]}`, wantErr: "can't be selectable"},
+		{name: "selectable without image", file: `{"selectable": ["blank"], "profiles": {"blank": {"opacity": 1}}}`, wantErr: "can't be selectable"},
+		{name: "broken json", file: `{"profiles": `, wantErr: "invalid watermark profiles"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "watermarks.json")
+			if err := os.WriteFile(path, []byte(tt.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := LoadWatermarkConfig(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
+
+func TestLoadWatermarkConfigDefault(t *testing.T) {
+	cfg, err := LoadWatermarkConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Profiles[cfg.Default].Image != DefaultWatermarkImage {
+		t.Errorf("default profile = %+v, want the embedded watermark", cfg.Profiles[cfg.Default])
+	}
+	for _, name := range cfg.Selectable {
+		if cfg.Profiles[name].Image == "" {
+			t.Errorf("profile %q without image is selectable", name)
+		}
+	}
+}
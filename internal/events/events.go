@@ -0,0 +1,133 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"codiewuploader/internal/model"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Event types. Stage events carry the new status of a processing stage, e.g.
+// heic-converter done means converted, move done means watermarked and moved.
+const (
+	TypeCreated    = "created"
+	TypeProgress   = "progress"
+	TypeFinished   = "finished"
+	TypeTerminated = "terminated"
+	TypeStage      = "stage"
+)
+
+// DefaultBuffer is the number of events a subscriber may lag behind before
+// new events are dropped for it
+const DefaultBuffer = 64
+
+var MetricsEventsDroppedTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "tusd_events_dropped_total",
+		Help: "Total number of events not delivered to a subscriber which didn't keep up.",
+	},
+)
+
+// Event is an upload or processing event of an entity. UserId is only used
+// to filter the events per subscriber and isn't sent.
+type Event struct {
+	Id       uint64             `json:"id"`
+	Type     string             `json:"type"`
+	UploadId string             `json:"uploadId"`
+	EntityId string             `json:"entityId"`
+	UserId   string             `json:"-"`
+	Offset   int64              `json:"offset,omitempty"`
+	Size     int64              `json:"size,omitempty"`
+	Stage    *model.StageStatus `json:"stage,omitempty"`
+	Time     time.Time          `json:"time"`
+}
+
+// Subscription receives the events of one entity until it's closed
+type Subscription struct {
+	Events <-chan Event
+
+	broker   *Broker
+	entityId string
+	events   chan Event
+}
+
+// Close stops the delivery, Events is closed afterwards
+func (s *Subscription) Close() {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+
+	subs := s.broker.subs[s.entityId]
+	if _, ok := subs[s]; !ok {
+		return
+	}
+
+	delete(subs, s)
+	if len(subs) == 0 {
+		delete(s.broker.subs, s.entityId)
+	}
+	close(s.events)
+}
+
+// Broker fans the events out to the subscribers of the entity. Publishing
+// never blocks: a subscriber with a full buffer misses the event.
+type Broker struct {
+	mu   sync.Mutex
+	seq  uint64
+	subs map[string]map[*Subscription]struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		subs: make(map[string]map[*Subscription]struct{}),
+	}
+}
+
+func (b *Broker) Subscribe(entityId string, buffer int) *Subscription {
+	if buffer < 1 {
+		buffer = DefaultBuffer
+	}
+
+	events := make(chan Event, buffer)
+	s := &Subscription{
+		Events:   events,
+		broker:   b,
+		entityId: entityId,
+		events:   events,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subs[entityId] == nil {
+		b.subs[entityId] = make(map[*Subscription]struct{})
+	}
+	b.subs[entityId][s] = struct{}{}
+
+	return s
+}
+
+// Publish sends the event to the subscribers of its entity
+func (b *Broker) Publish(event Event) {
+	if event.EntityId == "" {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	event.Id = b.seq
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	for s := range b.subs[event.EntityId] {
+		select {
+		case s.events <- event:
+		default:
+			MetricsEventsDroppedTotal.Inc()
+		}
+	}
+}
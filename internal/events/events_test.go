@@ -0,0 +1,106 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// received takes the events already delivered to the subscription
+func received(s *Subscription) []Event {
+	var events []Event
+	for {
+		select {
+		case event, ok := <-s.Events:
+			if !ok {
+				return events
+			}
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestPublishFansOut(t *testing.T) {
+	b := NewBroker()
+
+	first := b.Subscribe("e1", 8)
+	second := b.Subscribe("e1", 8)
+	other := b.Subscribe("e2", 8)
+	defer first.Close()
+	defer second.Close()
+	defer other.Close()
+
+	b.Publish(Event{Type: TypeCreated, UploadId: "upl1", EntityId: "e1"})
+	b.Publish(Event{Type: TypeProgress, UploadId: "upl1", EntityId: "e1", Offset: 10})
+	// Событие без сущности некому доставить
+	b.Publish(Event{Type: TypeCreated, UploadId: "upl2"})
+
+	for name, s := range map[string]*Subscription{"first": first, "second": second} {
+		events := received(s)
+		if len(events) != 2 || events[0].Type != TypeCreated || events[1].Type != TypeProgress {
+			t.Fatalf("%s: events = %+v, want created and progress", name, events)
+		}
+		if events[0].Id == 0 || events[1].Id <= events[0].Id {
+			t.Errorf("%s: ids = %d, %d, want increasing", name, events[0].Id, events[1].Id)
+		}
+		if events[0].Time.IsZero() {
+			t.Errorf("%s: event without time", name)
+		}
+	}
+
+	if events := received(other); len(events) != 0 {
+		t.Errorf("other entity got %+v", events)
+	}
+}
+
+func TestPublishDropsForSlowSubscriber(t *testing.T) {
+	b := NewBroker()
+
+	slow := b.Subscribe("e1", 1)
+	fast := b.Subscribe("e1", 8)
+	defer slow.Close()
+	defer fast.Close()
+
+	before := testutil.ToFloat64(MetricsEventsDroppedTotal)
+	for i := 0; i < 3; i++ {
+		b.Publish(Event{Type: TypeProgress, EntityId: "e1", Offset: int64(i)})
+	}
+
+	if events := received(slow); len(events) != 1 || events[0].Offset != 0 {
+		t.Errorf("slow subscriber got %+v, want only the first event", events)
+	}
+	if events := received(fast); len(events) != 3 {
+		t.Errorf("fast subscriber got %d events, want all 3", len(events))
+	}
+	if got := testutil.ToFloat64(MetricsEventsDroppedTotal) - before; got != 2 {
+		t.Errorf("dropped counter grew by %v, want 2", got)
+	}
+}
+
+func TestSubscriptionClose(t *testing.T) {
+	b := NewBroker()
+
+	closed := b.Subscribe("e1", 8)
+	open := b.Subscribe("e1", 8)
+	defer open.Close()
+
+	closed.Close()
+	// Повторное закрытие ничего не ломает
+	closed.Close()
+
+	if _, ok := <-closed.Events; ok {
+		t.Error("events of a closed subscription aren't closed")
+	}
+
+	b.Publish(Event{Type: TypeFinished, EntityId: "e1"})
+	if events := received(open); len(events) != 1 {
+		t.Errorf("open subscriber got %+v, want the event", events)
+	}
+
+	open.Close()
+	if len(b.subs) != 0 {
+		t.Errorf("subscribers left: %v", b.subs)
+	}
+}
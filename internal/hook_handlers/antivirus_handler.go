@@ -0,0 +1,286 @@
+package hook_handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"codiewuploader/internal/clamd"
+	appConfig "codiewuploader/internal/config"
+	"codiewuploader/internal/jobqueue"
+	"codiewuploader/internal/model"
+	"codiewuploader/internal/status"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tus/tusd/v2/pkg/handler"
+	"github.com/tus/tusd/v2/pkg/hooks"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	antivirusStage   = "antivirus"
+	antivirusJobKind = "antivirus"
+)
+
+// AntivirusHandler streams finished uploads to clamd before anything reaches
+// the public bucket. Infected files are quarantined and the move is blocked.
+// A failed scan is retried in the background and the following stages are
+// resumed once the file is clean. The stage is off unless CLAMD_ADDRESS is
+// set.
+type AntivirusHandler struct {
+	config   appConfig.AppConfig
+	s3Client *s3.Client
+	client   *clamd.Client
+
+	// queue — повторные проверки после ошибок clamd или S3
+	queue *jobqueue.Queue
+
+	// status — проверка может закончиться в фоне, поэтому статус пишем сами
+	status *status.Store
+
+	// resume запускает стадии после этой, когда повторная проверка прошла
+	resume func(req hooks.HookRequest)
+}
+
+func NewAntivirusHandler(config appConfig.AppConfig, statuses *status.Store) *AntivirusHandler {
+	g := &AntivirusHandler{
+		config: config,
+		status: statuses,
+	}
+
+	if config.ClamdAddress != "" {
+		g.s3Client = InitS3Client(config)
+		g.client = &clamd.Client{
+			Network: config.ClamdNetwork,
+			Address: config.ClamdAddress,
+			Timeout: config.ClamdDialTimeout,
+		}
+	}
+
+	return g
+}
+
+// antivirusJob is what a retried scan needs to resume the upload. The HTTP
+// request with its tokens and cookies is not kept, the job file lies on disk
+// until the scan passes or dies.
+type antivirusJob struct {
+	UploadId string            `json:"uploadId"`
+	Size     int64             `json:"size"`
+	MetaData handler.MetaData  `json:"metaData"`
+	Storage  map[string]string `json:"storage"`
+}
+
+func newAntivirusJob(req hooks.HookRequest) antivirusJob {
+	upload := req.Event.Upload
+
+	return antivirusJob{
+		UploadId: upload.ID,
+		Size:     upload.Size,
+		MetaData: upload.MetaData,
+		Storage:  upload.Storage,
+	}
+}
+
+// request rebuilds the post-finish hook the following stages are resumed with
+func (j antivirusJob) request() hooks.HookRequest {
+	return hooks.HookRequest{
+		Type: hooks.HookPostFinish,
+		Event: handler.HookEvent{Upload: handler.FileInfo{
+			ID:       j.UploadId,
+			Size:     j.Size,
+			MetaData: j.MetaData,
+			Storage:  j.Storage,
+		}},
+	}
+}
+
+// reportsStatus: статус повторной проверки обновляет задача из очереди
+func (g *AntivirusHandler) reportsStatus() {}
+
+func (g *AntivirusHandler) Setup() error {
+	log.Println("AntivirusHandler.Setup setup")
+
+	if g.client == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.config.ClamdTimeout)
+	defer cancel()
+
+	if err := g.client.Ping(ctx); err != nil {
+		slog.Warn("clamd is not reachable", "address", g.config.ClamdAddress, "err", err.Error())
+	}
+
+	queue, err := jobqueue.New(jobqueue.Config{
+		Dir:         filepath.Join(g.config.JobsDir, antivirusJobKind),
+		Workers:     g.config.JobWorkers,
+		MaxAttempts: g.config.JobMaxAttempts,
+		BaseBackoff: g.config.JobBackoff,
+		MaxBackoff:  g.config.JobMaxBackoff,
+	}, g.runJob)
+	if err != nil {
+		return fmt.Errorf("unable to create antivirus queue: %w", err)
+	}
+	g.queue = queue
+	g.queue.Start(context.Background())
+
+	return nil
+}
+
+func (g *AntivirusHandler) InvokeHook(req hooks.HookRequest) (res hooks.HookResponse, err error) {
+	if g.client == nil {
+		return res, nil
+	}
+
+	uploadId, _ := splitIds(req.Event.Upload.ID)
+
+	result, err := g.check(req)
+	if err != nil {
+		slog.Error("Antivirus scan failed", "uploadId", uploadId, "err", err.Error())
+		if g.config.ClamdFailOpen {
+			g.report(req, &res, model.StageStatus{Status: model.StatusSkipped, Error: err.Error()})
+			return res, nil
+		}
+
+		// Непроверенный файл в публичный бакет не пускаем: останавливаемся до
+		// повторной проверки, она сама продолжит обработку
+		res.StopUpload = true
+
+		added, qErr := g.queue.Enqueue(antivirusJobKind+"-"+uploadId, antivirusJobKind, newAntivirusJob(req))
+		if qErr != nil {
+			slog.Error("Antivirus retry enqueue failed", "uploadId", uploadId, "err", qErr.Error())
+			g.report(req, &res, model.StageStatus{Status: model.StatusFailed, Error: err.Error()})
+			return res, nil
+		}
+
+		pending := model.StageStatus{Status: model.StatusPending, Error: "scan failed, retry queued: " + err.Error()}
+		if !added {
+			// Повтор уже в очереди, его статус не трогаем
+			pending.Respond(&res, antivirusStage)
+			return res, nil
+		}
+		g.report(req, &res, pending)
+		return res, nil
+	}
+
+	g.report(req, &res, result)
+	if result.Status == model.StatusQuarantined || result.Status == model.StatusRejected {
+		res.StopUpload = true
+	}
+
+	return res, nil
+}
+
+// runJob повторяет проверку и, если файл можно пускать дальше, запускает
+// следующие стадии
+func (g *AntivirusHandler) runJob(ctx context.Context, job jobqueue.Job) error {
+	var payload antivirusJob
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return jobqueue.Permanent(err)
+	}
+	if payload.UploadId == "" {
+		return jobqueue.Permanent(errors.New("antivirus job without upload id"))
+	}
+	req := payload.request()
+
+	uploadId, _ := splitIds(req.Event.Upload.ID)
+	g.store(req, model.StageStatus{Status: model.StatusRunning})
+
+	result, err := g.check(req)
+	if err != nil {
+		// До последней попытки задача еще ждет повтора
+		current := model.StatusPending
+		if job.Attempts+1 >= g.config.JobMaxAttempts {
+			current = model.StatusFailed
+		}
+		g.store(req, model.StageStatus{Status: current, Error: err.Error()})
+
+		return err
+	}
+
+	g.store(req, result)
+
+	if result.Status == model.StatusDone || result.Status == model.StatusSkipped {
+		slog.Info("Antivirus retry passed, resuming", "uploadId", uploadId, "status", result.Status)
+		if g.resume != nil {
+			g.resume(req)
+		}
+	}
+
+	return nil
+}
+
+// check scans the upload and quarantines it when infected. Only errors worth
+// a retry are returned, a file above the clamd limit is handled by
+// ClamdSizeLimitAction.
+func (g *AntivirusHandler) check(req hooks.HookRequest) (model.StageStatus, error) {
+	uploadId, _ := splitIds(req.Event.Upload.ID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.config.ClamdTimeout)
+	defer cancel()
+
+	result, err := g.scan(ctx, uploadId)
+	if errors.Is(err, clamd.ErrSizeLimit) {
+		MetricsAntivirusSizeLimitTotal.WithLabelValues(g.config.ClamdSizeLimitAction).Inc()
+		if g.config.ClamdSizeLimitAction == appConfig.ClamdSizeLimitSkip {
+			slog.Warn("Upload too large for clamd, passed unscanned", "uploadId", uploadId)
+			return model.StageStatus{Status: model.StatusSkipped, Error: "file exceeds the clamd size limit, not scanned"}, nil
+		}
+
+		slog.Warn("Upload too large for clamd, rejected", "uploadId", uploadId)
+		return model.StageStatus{Status: model.StatusRejected, Error: "file exceeds the clamd size limit"}, nil
+	}
+	if err != nil {
+		return model.StageStatus{}, err
+	}
+
+	if !result.Infected {
+		return model.StageStatus{Status: model.StatusDone}, nil
+	}
+
+	reason := fmt.Sprintf("infected: %s", result.Signature)
+	key, err := quarantine(ctx, g.s3Client, g.config, g.config.ClamdQuarantinePrefix, uploadId, model.QuarantineReport{
+		UploadId:     uploadId,
+		Stage:        antivirusStage,
+		Reason:       reason,
+		DeclaredType: req.Event.Upload.MetaData["filetype"],
+		DetectedType: req.Event.Upload.MetaData[DetectedTypeMetaKey],
+		MetaData:     req.Event.Upload.MetaData,
+	})
+	if err != nil {
+		slog.Error("Quarantine failed", "uploadId", uploadId, "key", key, "err", err.Error())
+	}
+
+	slog.Warn("Infected upload quarantined", "uploadId", uploadId, "signature", result.Signature)
+	return model.StageStatus{Status: model.StatusQuarantined, Error: reason, Output: key}, nil
+}
+
+func (g *AntivirusHandler) scan(ctx context.Context, key string) (clamd.Result, error) {
+	obj, err := g.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(SwampDir),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return clamd.Result{}, err
+	}
+	defer obj.Body.Close()
+
+	return g.client.Scan(ctx, obj.Body)
+}
+
+// report stores the stage outcome and returns it as the hook response
+func (g *AntivirusHandler) report(req hooks.HookRequest, res *hooks.HookResponse, status model.StageStatus) {
+	g.store(req, status)
+	status.Respond(res, antivirusStage)
+}
+
+func (g *AntivirusHandler) store(req hooks.HookRequest, stageStatus model.StageStatus) {
+	uploadId, _ := splitIds(req.Event.Upload.ID)
+	stageStatus.Stage = antivirusStage
+
+	setStageStatus(g.status, uploadId, uploadOwner(req.Event.Upload.MetaData), stageStatus)
+}
@@ -0,0 +1,111 @@
+package hook_handlers
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"codiewuploader/internal/status"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"github.com/tus/tusd/v2/pkg/hooks"
+)
+
+// closedAddress returns a TCP address nobody listens on
+func closedAddress(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	return addr
+}
+
+func TestAntivirusRetryJobKeepsNoRequest(t *testing.T) {
+	s3, cfg := newFakeS3(t)
+	s3.put(SwampDir, "upl1", []byte("file"), "image/jpeg")
+
+	cfg.ClamdNetwork = "tcp"
+	cfg.ClamdAddress = closedAddress(t)
+	cfg.ClamdDialTimeout = time.Second
+	cfg.ClamdTimeout = 2 * time.Second
+	cfg.JobsDir = t.TempDir()
+	cfg.JobMaxAttempts = 3
+	cfg.JobBackoff = time.Hour
+
+	statuses, err := status.Open(status.Config{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := NewAntivirusHandler(cfg, statuses)
+	if g.client.Timeout != time.Second {
+		t.Errorf("dial timeout = %s, want CLAMD_DIAL_TIMEOUT", g.client.Timeout)
+	}
+	if err := g.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := hooks.HookRequest{
+		Type: hooks.HookPostFinish,
+		Event: handler.HookEvent{
+			Upload: handler.FileInfo{
+				ID:       "upl1+multipart",
+				Size:     4,
+				MetaData: handler.MetaData{"id": "e1", OwnerMetaKey: "u1", "filename": "a.jpg"},
+				Storage:  map[string]string{"Key": "upl1"},
+			},
+			HTTPRequest: handler.HTTPRequest{
+				Method: http.MethodPatch,
+				Header: http.Header{
+					"Upload-Token":  []string{"secret-token"},
+					"Authorization": []string{"Bearer secret-token"},
+					"Cookie":        []string{"session=secret-cookie"},
+				},
+			},
+		},
+	}
+
+	res, err := g.InvokeHook(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.StopUpload {
+		t.Fatal("unscanned upload wasn't stopped")
+	}
+
+	data, err := os.ReadFile(filepath.Join(cfg.JobsDir, antivirusJobKind, "pending", "antivirus-upl1.json"))
+	if err != nil {
+		t.Fatalf("retry job: %v", err)
+	}
+	for _, secret := range []string{"secret-token", "secret-cookie", "Upload-Token"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("job file contains %q: %s", secret, data)
+		}
+	}
+
+	var job struct {
+		Payload antivirusJob `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &job); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed := job.Payload.request()
+	upload := resumed.Event.Upload
+	if resumed.Type != hooks.HookPostFinish || upload.ID != "upl1+multipart" || upload.Size != 4 {
+		t.Errorf("resumed request = %+v, want the post-finish of the upload", resumed)
+	}
+	if upload.MetaData["id"] != "e1" || upload.MetaData[OwnerMetaKey] != "u1" || upload.Storage["Key"] != "upl1" {
+		t.Errorf("resumed upload = %+v, want its metadata and storage", upload)
+	}
+}
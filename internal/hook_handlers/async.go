@@ -0,0 +1,147 @@
+package hook_handlers
+
+import (
+	"maps"
+	"time"
+
+	"codiewuploader/internal/model"
+
+	"github.com/tus/tusd/v2/pkg/hooks"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+)
+
+// asyncPool runs the async stages off the request path with a bounded number
+// of workers. When the queue is full the caller waits up to timeout and then
+// the job is rejected, so a backlog neither grows without bounds nor blocks
+// the hook goroutine with the work itself.
+type asyncPool struct {
+	workers int
+	timeout time.Duration
+	jobs    chan func()
+}
+
+func newAsyncPool(workers, queueSize int, timeout time.Duration) *asyncPool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &asyncPool{
+		workers: workers,
+		timeout: timeout,
+		jobs:    make(chan func(), queueSize),
+	}
+}
+
+func (p *asyncPool) start() {
+	for i := 0; i < p.workers; i++ {
+		go func() {
+			for job := range p.jobs {
+				MetricsAsyncQueueLength.Set(float64(len(p.jobs)))
+				job()
+			}
+		}()
+	}
+}
+
+// submit queues the job, false means the queue stayed full and the job was
+// dropped.
+func (p *asyncPool) submit(job func()) bool {
+	select {
+	case p.jobs <- job:
+		MetricsAsyncQueueLength.Set(float64(len(p.jobs)))
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	select {
+	case p.jobs <- job:
+		MetricsAsyncQueueLength.Set(float64(len(p.jobs)))
+		return true
+	case <-timer.C:
+		MetricsAsyncQueueOverflowTotal.Inc()
+		return false
+	}
+}
+
+// asyncGroup returns the consecutive async stages starting at i, they run as
+// one job in order, so e.g. the HEIC conversion is still done before the move.
+func (g *Handler) asyncGroup(i int) []*stage {
+	var group []*stage
+	for ; i < len(g.handlers); i++ {
+		s, ok := g.handlers[i].(*stage)
+		if !ok || !s.async {
+			break
+		}
+		group = append(group, s)
+	}
+
+	return group
+}
+
+// runAsync queues the group with a snapshot of the request, the stage results
+// only go to the status store.
+func (g *Handler) runAsync(group []*stage, req hooks.HookRequest) {
+	var subscribed []*stage
+	for _, s := range group {
+		if slices.Contains(s.hooks, req.Type) {
+			subscribed = append(subscribed, s)
+		}
+	}
+	if len(subscribed) == 0 {
+		return
+	}
+
+	// Синхронные стадии после группы продолжают менять мету, поэтому берем копию
+	req.Event.Upload.MetaData = maps.Clone(req.Event.Upload.MetaData)
+	req.Event.Upload.Storage = maps.Clone(req.Event.Upload.Storage)
+
+	for _, s := range subscribed {
+		g.reportStatus(req, s, model.StageStatus{Stage: s.name, Status: model.StatusPending})
+	}
+
+	uploadId, _ := splitIds(req.Event.Upload.ID)
+
+	accepted := g.async.submit(func() {
+		merge := newResponseMerge(g.config.MetadataMerge, &req.Event.Upload)
+
+		for i, s := range subscribed {
+			g.reportStatus(req, s, model.StageStatus{Stage: s.name, Status: model.StatusRunning})
+
+			subRes, err := s.handler.InvokeHook(req)
+			if err != nil {
+				slog.Error("Async stage failed", "stage", s.name, "hook", req.Type, "uploadId", uploadId, "err", err.Error())
+				subRes.HTTPResponse.StatusCode = 500
+				subRes.HTTPResponse.Body = err.Error()
+				subRes.StopUpload = true
+			}
+
+			result := stageResult(s.name, subRes)
+			g.reportStatus(req, s, result)
+
+			if err := merge.add(s.name, subRes, &req.Event.Upload); err != nil {
+				slog.Error("Conflicting stage responses", "uploadId", uploadId, "err", err.Error())
+				subRes.StopUpload = true
+			}
+
+			if subRes.RejectUpload || subRes.StopUpload {
+				for _, rest := range subscribed[i+1:] {
+					g.reportStatus(req, rest, model.StageStatus{Stage: rest.name, Status: restStatus(result)})
+				}
+				return
+			}
+		}
+	})
+	if accepted {
+		return
+	}
+
+	// Стадии не запускаем в горутине хука, статус показывает, что их пропустили
+	slog.Error("Async queue is full, stages dropped", "hook", req.Type, "uploadId", uploadId, "stages", len(subscribed))
+	for _, s := range subscribed {
+		g.reportStatus(req, s, model.StageStatus{Stage: s.name, Status: model.StatusFailed, Error: "async queue is full"})
+	}
+}
@@ -0,0 +1,141 @@
+package hook_handlers
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"codiewuploader/internal/events"
+	"codiewuploader/internal/model"
+	"codiewuploader/internal/status"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tus/tusd/v2/pkg/handler"
+	"github.com/tus/tusd/v2/pkg/hooks"
+)
+
+func TestAsyncPoolRunsJobs(t *testing.T) {
+	pool := newAsyncPool(2, 10, time.Second)
+	pool.start()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	ran := 0
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		if !pool.submit(func() {
+			defer wg.Done()
+			mu.Lock()
+			ran++
+			mu.Unlock()
+		}) {
+			t.Fatal("job rejected by a free pool")
+		}
+	}
+	wg.Wait()
+
+	if ran != 5 {
+		t.Errorf("ran %d jobs, want 5", ran)
+	}
+}
+
+func TestAsyncPoolRejectsWhenFull(t *testing.T) {
+	// Без воркеров очередь на один элемент заполняется первой задачей
+	pool := newAsyncPool(1, 1, 10*time.Millisecond)
+	if !pool.submit(func() {}) {
+		t.Fatal("job rejected by an empty queue")
+	}
+
+	before := testutil.ToFloat64(MetricsAsyncQueueOverflowTotal)
+	ran := false
+	if pool.submit(func() { ran = true }) {
+		t.Fatal("job accepted by a full queue")
+	}
+	if ran {
+		t.Error("rejected job ran on the caller's goroutine")
+	}
+	if got := testutil.ToFloat64(MetricsAsyncQueueOverflowTotal) - before; got != 1 {
+		t.Errorf("overflow counter grew by %v, want 1", got)
+	}
+}
+
+func TestAsyncPoolWaitsForRoom(t *testing.T) {
+	pool := newAsyncPool(1, 1, time.Second)
+	pool.submit(func() {})
+
+	// Очередь освобождается, пока submit ждет
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		pool.start()
+	}()
+
+	done := make(chan struct{})
+	if !pool.submit(func() { close(done) }) {
+		t.Fatal("job rejected though the queue freed up in time")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("queued job didn't run")
+	}
+}
+
+func TestRunAsyncReportsDroppedStages(t *testing.T) {
+	statuses, err := status.Open(status.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invoked := false
+	async := &stage{
+		name:  "heic-converter",
+		hooks: []hooks.HookType{hooks.HookPostFinish},
+		async: true,
+		handler: hookFunc(func(req hooks.HookRequest) (hooks.HookResponse, error) {
+			invoked = true
+			return hooks.HookResponse{}, nil
+		}),
+	}
+
+	g := &Handler{
+		async:    newAsyncPool(1, 1, 10*time.Millisecond),
+		status:   statuses,
+		events:   events.NewBroker(),
+		handlers: []hooks.HookHandler{async},
+	}
+	// Воркеры не запущены, единственное место в очереди уже занято
+	g.async.submit(func() {})
+
+	req := hooks.HookRequest{
+		Type: hooks.HookPostFinish,
+		Event: handler.HookEvent{Upload: handler.FileInfo{
+			ID:       "upl1+multipart",
+			MetaData: handler.MetaData{"id": "e1", OwnerMetaKey: "u1"},
+		}},
+	}
+	if _, err := g.InvokeHook(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if invoked {
+		t.Error("dropped stage ran on the hook goroutine")
+	}
+
+	upload, ok := statuses.Get("upl1")
+	if !ok || len(upload.Stages) != 1 {
+		t.Fatalf("status = %+v, want the dropped stage", upload)
+	}
+	if got := upload.Stages[0]; got.Stage != "heic-converter" || got.Status != model.StatusFailed {
+		t.Errorf("stage status = %+v, want failed", got)
+	}
+}
+
+// hookFunc turns a function into a hooks.HookHandler
+type hookFunc func(req hooks.HookRequest) (hooks.HookResponse, error)
+
+func (f hookFunc) Setup() error { return nil }
+
+func (f hookFunc) InvokeHook(req hooks.HookRequest) (hooks.HookResponse, error) {
+	return f(req)
+}
@@ -1,71 +1,327 @@
 package hook_handlers
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
 	"fmt"
 	"github.com/form3tech-oss/jwt-go"
 	"github.com/tus/tusd/v2/pkg/hooks"
+	"golang.org/x/exp/slog"
 	"log"
+	"strings"
+	"time"
 
 	appconfig "codiewuploader/internal/config"
 )
 
 var ErrInvalidToken = "Invalid upload token"
 
+// OwnerMetaKey keeps the sub of the user who created the upload
+const OwnerMetaKey = "userId"
+
+// RejectReason tells why the upload token was not accepted
+type RejectReason string
+
+const (
+	ReasonMissingToken        RejectReason = "missing_token"
+	ReasonMalformedToken      RejectReason = "malformed_token"
+	ReasonUnexpectedAlgorithm RejectReason = "unexpected_algorithm"
+	ReasonInvalidSignature    RejectReason = "invalid_signature"
+	ReasonUnknownKey          RejectReason = "unknown_key"
+	ReasonMissingExpiry       RejectReason = "missing_expiry"
+	ReasonExpired             RejectReason = "token_expired"
+	ReasonNotYetValid         RejectReason = "token_not_yet_valid"
+	ReasonIssuedInFuture      RejectReason = "token_issued_in_future"
+	ReasonInvalidAudience     RejectReason = "invalid_audience"
+	ReasonInvalidIssuer       RejectReason = "invalid_issuer"
+	ReasonMissingSubject      RejectReason = "missing_subject"
+	ReasonForeignUpload       RejectReason = "foreign_upload"
+	ReasonEntityForbidden     RejectReason = "entity_forbidden"
+)
+
+var (
+	errUnexpectedAlgorithm = errors.New("unexpected signing method")
+	errUnknownKey          = errors.New("no verification key for the token")
+	errInvalidSignature    = errors.New("signature is invalid")
+)
+
 type AuthHandler struct {
 	config appconfig.AppConfig
+	// secrets are all HMAC secrets valid at the moment, several during rotation
+	secrets [][]byte
+	// keys are the RSA/ECDSA public keys from the JWKS, nil if it's not set
+	keys *keySet
 }
 
 func NewAuthHandler(config appconfig.AppConfig) *AuthHandler {
-	return &AuthHandler{
+	g := &AuthHandler{
 		config: config,
 	}
+
+	for _, secret := range config.JwtSecrets {
+		g.secrets = append(g.secrets, []byte(secret))
+	}
+
+	if config.JwtJwks != "" {
+		g.keys = newKeySet(config.JwtJwks, config.JwtJwksCacheTTL)
+	}
+
+	return g
 }
 
 func (g *AuthHandler) Setup() error {
 	log.Println("AuthHandler.Setup setup")
+
+	if len(g.secrets) == 0 && g.keys == nil {
+		slog.Warn("No JWT secret or JWKS configured, all upload tokens will be rejected")
+	}
+
+	if g.keys != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if err := g.keys.refresh(ctx, false); err != nil {
+			// Провайдер может быть недоступен при старте, ключи догрузятся по первому токену
+			if !g.keys.isRemote() {
+				return err
+			}
+			slog.Warn("Unable to load JWKS, will retry on demand", "source", g.config.JwtJwks, "err", err.Error())
+		}
+	}
+
 	return nil
 }
 
 func (g *AuthHandler) InvokeHook(req hooks.HookRequest) (res hooks.HookResponse, err error) {
-	if req.Type != hooks.HookPreCreate {
-		return res, nil
-	}
-
 	uploadToken, ok2 := req.Event.HTTPRequest.Header["Upload-Token"]
 	if !ok2 || len(uploadToken) < 1 {
-		g.errorResponse(&res)
+		g.errorResponse(&res, ReasonMissingToken)
 		return res, nil
 	}
 
-	token, err := parseToken(uploadToken[0], []byte(g.config.JwtSecret))
-	if err != nil || token == nil {
-		g.errorResponse(&res)
+	claims, reason := g.Authenticate(hookContext(req), uploadToken[0])
+	if reason != "" {
+		g.errorResponse(&res, reason)
 		return res, nil
 	}
 
-	claims, _ := token.Claims.(jwt.MapClaims)
-	userId, ok := claims["sub"]
-	if !ok || userId == "" {
-		g.errorResponse(&res)
-		return res, nil
+	// Привязываем загрузку к создателю, значение от клиента перезаписываем
+	res.ChangeFileInfo.MetaData = map[string]string{
+		OwnerMetaKey: claims["sub"].(string),
 	}
 
 	return res, nil
 }
 
-func (g *AuthHandler) errorResponse(res *hooks.HookResponse) {
+// AuthorizeOwner checks the token of a request to an existing upload, its sub
+// must match the owner bound to the upload at creation.
+func (g *AuthHandler) AuthorizeOwner(ctx context.Context, input, owner string) RejectReason {
+	claims, reason := g.Authenticate(ctx, input)
+	if reason == "" && (owner == "" || claims["sub"] != owner) {
+		reason = ReasonForeignUpload
+	}
+
+	if reason != "" {
+		MetricsAuthRejectionsTotal.WithLabelValues(string(reason)).Inc()
+	}
+
+	return reason
+}
+
+// Authenticate verifies the token signature and its registered claims, the
+// allowed clock skew applies to exp, nbf and iat. An empty reason means the
+// token is valid. The context bounds a JWKS refresh caused by an unknown kid.
+func (g *AuthHandler) Authenticate(ctx context.Context, input string) (jwt.MapClaims, RejectReason) {
+	if input == "" {
+		return nil, ReasonMissingToken
+	}
+
+	claims, err := g.parseToken(ctx, input)
+	if err != nil {
+		switch {
+		case errors.Is(err, errUnexpectedAlgorithm):
+			return nil, ReasonUnexpectedAlgorithm
+		case errors.Is(err, errUnknownKey):
+			return nil, ReasonUnknownKey
+		case errors.Is(err, errInvalidSignature):
+			return nil, ReasonInvalidSignature
+		default:
+			return nil, ReasonMalformedToken
+		}
+	}
+
+	if reason := g.validateClaims(claims, time.Now()); reason != "" {
+		return nil, reason
+	}
+
+	return claims, ""
+}
+
+func (g *AuthHandler) validateClaims(claims jwt.MapClaims, now time.Time) RejectReason {
+	skew := g.config.JwtClockSkew
+
+	exp, ok := timeClaim(claims, "exp")
+	if !ok && g.config.JwtRequireExpiry {
+		return ReasonMissingExpiry
+	}
+	if ok && now.After(exp.Add(skew)) {
+		return ReasonExpired
+	}
+
+	if nbf, ok := timeClaim(claims, "nbf"); ok && now.Add(skew).Before(nbf) {
+		return ReasonNotYetValid
+	}
+
+	if iat, ok := timeClaim(claims, "iat"); ok && now.Add(skew).Before(iat) {
+		return ReasonIssuedInFuture
+	}
+
+	if len(g.config.JwtAudience) > 0 && !hasAudience(claims, g.config.JwtAudience) {
+		return ReasonInvalidAudience
+	}
+
+	if g.config.JwtIssuer != "" {
+		if iss, _ := claims["iss"].(string); iss != g.config.JwtIssuer {
+			return ReasonInvalidIssuer
+		}
+	}
+
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return ReasonMissingSubject
+	}
+
+	return ""
+}
+
+func (g *AuthHandler) errorResponse(res *hooks.HookResponse, reason RejectReason) {
+	MetricsAuthRejectionsTotal.WithLabelValues(string(reason)).Inc()
+
 	res.HTTPResponse.StatusCode = 401
-	res.HTTPResponse.Body = ErrInvalidToken
+	res.HTTPResponse.Body = fmt.Sprintf("%s: %s", ErrInvalidToken, reason)
 	res.RejectUpload = true
 }
 
-func parseToken(input string, secretKey []byte) (*jwt.Token, error) {
-	token, _ := jwt.Parse(input, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+// parseToken checks the signature only, claims are validated by the caller
+// to take the clock skew into account. The token is verified against every
+// candidate key, so rotated secrets and keys stay valid until removed.
+func (g *AuthHandler) parseToken(ctx context.Context, input string) (jwt.MapClaims, error) {
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+
+	claims := jwt.MapClaims{}
+	token, parts, err := parser.ParseUnverified(input, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := g.verificationKeys(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	signingString := strings.Join(parts[0:2], ".")
+	for _, key := range keys {
+		if err := token.Method.Verify(signingString, parts[2], key); err == nil {
+			return claims, nil
+		}
+	}
+
+	return nil, errInvalidSignature
+}
+
+// verificationKeys picks the keys by the token algorithm: HMAC tokens are
+// checked with the secrets only and RSA/ECDSA ones with the JWKS keys, so a
+// public key can never be used as an HMAC secret.
+func (g *AuthHandler) verificationKeys(ctx context.Context, token *jwt.Token) ([]interface{}, error) {
+	var keys []interface{}
+
+	switch method := token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		for _, secret := range g.secrets {
+			keys = append(keys, secret)
+		}
+
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+		if g.keys == nil {
+			return nil, fmt.Errorf("%w: %s", errUnexpectedAlgorithm, method.Alg())
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		for _, key := range g.keys.lookup(ctx, kid) {
+			if key.alg != "" && key.alg != method.Alg() {
+				continue
+			}
+
+			switch key.key.(type) {
+			case *rsa.PublicKey:
+				if _, ok := method.(*jwt.SigningMethodECDSA); ok {
+					continue
+				}
+			case *ecdsa.PublicKey:
+				if _, ok := method.(*jwt.SigningMethodECDSA); !ok {
+					continue
+				}
+			}
+
+			keys = append(keys, key.key)
+		}
+
+	default:
+		return nil, fmt.Errorf("%w: %v", errUnexpectedAlgorithm, token.Header["alg"])
+	}
+
+	if len(keys) == 0 {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+			return nil, fmt.Errorf("%w: %s", errUnexpectedAlgorithm, token.Method.Alg())
+		}
+		return nil, errUnknownKey
+	}
+
+	return keys, nil
+}
+
+// hookContext is the context of the request which fired the hook
+func hookContext(req hooks.HookRequest) context.Context {
+	if req.Event.Context == nil {
+		return context.Background()
+	}
+
+	return req.Event.Context
+}
+
+func timeClaim(claims jwt.MapClaims, name string) (time.Time, bool) {
+	switch value := claims[name].(type) {
+	case float64:
+		return time.Unix(int64(value), 0), true
+	case int64:
+		return time.Unix(value, 0), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// hasAudience accepts both a single string and an array in the aud claim
+func hasAudience(claims jwt.MapClaims, allowed []string) bool {
+	var audiences []string
+	switch aud := claims["aud"].(type) {
+	case string:
+		audiences = []string{aud}
+	case []interface{}:
+		for _, item := range aud {
+			if s, ok := item.(string); ok {
+				audiences = append(audiences, s)
+			}
 		}
-		return secretKey, nil
-	})
+	}
+
+	for _, aud := range audiences {
+		for _, want := range allowed {
+			if aud == want {
+				return true
+			}
+		}
+	}
 
-	return token, nil
+	return false
 }
@@ -0,0 +1,169 @@
+package hook_handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+
+	appConfig "codiewuploader/internal/config"
+	"codiewuploader/internal/model"
+	"codiewuploader/internal/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tus/tusd/v2/pkg/handler"
+	"github.com/tus/tusd/v2/pkg/hooks"
+	"golang.org/x/exp/slog"
+)
+
+const contentSniffStage = "content-sniff"
+
+// DetectedTypeMetaKey holds the type detected from the content
+const DetectedTypeMetaKey = "detectedType"
+
+// preferredExtensions fixes the filename when its extension doesn't match the
+// detected type
+var preferredExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"image/heic":      ".heic",
+	"image/heif":      ".heif",
+	"image/avif":      ".avif",
+	"video/mp4":       ".mp4",
+	"video/quicktime": ".mov",
+	"video/webm":      ".webm",
+	"video/avi":       ".avi",
+	"application/pdf": ".pdf",
+}
+
+// ContentSniffHandler detects the real content type of a finished upload by
+// its magic bytes. Uploads whose content doesn't fit their mediatype are
+// quarantined and the pipeline is stopped, otherwise the detected type
+// replaces the client's filetype for the following handlers.
+type ContentSniffHandler struct {
+	config   appConfig.AppConfig
+	s3Client *s3.Client
+}
+
+func NewContentSniffHandler(config appConfig.AppConfig) *ContentSniffHandler {
+	return &ContentSniffHandler{
+		config:   config,
+		s3Client: InitS3Client(config),
+	}
+}
+
+func (g *ContentSniffHandler) Setup() error {
+	log.Println("ContentSniffHandler.Setup setup")
+	return nil
+}
+
+func (g *ContentSniffHandler) InvokeHook(req hooks.HookRequest) (res hooks.HookResponse, err error) {
+	meta := req.Event.Upload.MetaData
+	uploadId, _ := splitIds(req.Event.Upload.ID)
+	ctx := context.Background()
+
+	head, err := g.readHead(ctx, uploadId)
+	if err != nil {
+		// Без проверки дальше не пускаем, файл остается в болоте
+		slog.Error("Content sniffing failed", "uploadId", uploadId, "err", err.Error())
+		model.StageStatus{Status: model.StatusFailed, Error: err.Error()}.Respond(&res, contentSniffStage)
+		res.StopUpload = true
+		return res, nil
+	}
+
+	detected := utils.DetectContentType(head)
+	declared := meta["filetype"]
+	mediaType := meta["mediatype"]
+
+	if reason := g.mismatch(mediaType, detected); reason != "" {
+		key, err := quarantine(ctx, g.s3Client, g.config, g.config.QuarantinePrefix, uploadId, model.QuarantineReport{
+			UploadId:     uploadId,
+			Stage:        contentSniffStage,
+			Reason:       reason,
+			DeclaredType: declared,
+			DetectedType: detected,
+			MetaData:     meta,
+		})
+		if err != nil {
+			slog.Error("Quarantine failed", "uploadId", uploadId, "key", key, "err", err.Error())
+		}
+
+		slog.Warn("Upload quarantined", "uploadId", uploadId, "declared", declared, "detected", detected, "reason", reason)
+		model.StageStatus{Status: model.StatusQuarantined, Error: reason, Output: key}.Respond(&res, contentSniffStage)
+		res.StopUpload = true
+		return res, nil
+	}
+
+	model.StageStatus{Status: model.StatusDone, Output: detected}.Respond(&res, contentSniffStage)
+
+	changes := handler.MetaData{DetectedTypeMetaKey: detected}
+	if !strings.EqualFold(declared, detected) {
+		slog.Info("Declared filetype differs from content", "uploadId", uploadId, "declared", declared, "detected", detected)
+		changes["filetype"] = detected
+	}
+
+	if filename := meta["filename"]; filename != "" {
+		if fixed := fixExtension(filename, detected); fixed != filename {
+			changes["filename"] = fixed
+		}
+	}
+
+	res.ChangeFileInfo.MetaData = changes
+
+	return res, nil
+}
+
+// mismatch returns why the detected type isn't acceptable for the mediatype,
+// the allowed types come from the metadata schema.
+func (g *ContentSniffHandler) mismatch(mediaType, detected string) string {
+	if utils.IsExecutableType(detected) {
+		return fmt.Sprintf("executable content %s", detected)
+	}
+
+	rule, ok := g.config.MetadataSchema.MediaTypes[mediaType]
+	if !ok || len(rule.FileTypes) == 0 {
+		return ""
+	}
+
+	if !matchFileType(rule.FileTypes, detected) {
+		return fmt.Sprintf("content %s is not allowed for mediatype %s", detected, mediaType)
+	}
+
+	return ""
+}
+
+// readHead fetches the first bytes of the upload, enough for the magic bytes.
+func (g *ContentSniffHandler) readHead(ctx context.Context, key string) ([]byte, error) {
+	obj, err := g.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(SwampDir),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", utils.SniffLength-1)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+
+	return io.ReadAll(obj.Body)
+}
+
+// fixExtension replaces the extension which doesn't belong to the detected
+// type, e.g. photo.png with JPEG content becomes photo.jpg.
+func fixExtension(filename, contentType string) string {
+	want, ok := preferredExtensions[contentType]
+	if !ok {
+		return filename
+	}
+
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == want || (want == ".jpg" && ext == ".jpeg") {
+		return filename
+	}
+
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + want
+}
@@ -0,0 +1,222 @@
+package hook_handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	appconfig "codiewuploader/internal/config"
+
+	"github.com/form3tech-oss/jwt-go"
+	"github.com/tus/tusd/v2/pkg/hooks"
+	"golang.org/x/exp/slog"
+)
+
+// EntityAccess is the question asked to an EntityAuthorizer: may the user
+// attach a file of the media type to the entity.
+type EntityAccess struct {
+	UserId    string `json:"userId"`
+	EntityId  string `json:"entityId"`
+	MediaType string `json:"mediaType"`
+
+	Token  string        `json:"-"`
+	Claims jwt.MapClaims `json:"-"`
+}
+
+// EntityAuthorizer decides whether the user owns the target entity. An error
+// means the decision couldn't be made and the upload is rejected as well.
+type EntityAuthorizer interface {
+	Authorize(ctx context.Context, access EntityAccess) (bool, error)
+}
+
+// AllowAllAuthorizer keeps the old behaviour, any user may upload to any
+// entity. Only used with ENTITY_AUTH_MODE=none.
+type AllowAllAuthorizer struct{}
+
+func (AllowAllAuthorizer) Authorize(context.Context, EntityAccess) (bool, error) {
+	return true, nil
+}
+
+// ClaimAuthorizer allows the entities listed in a token claim, either an array
+// of ids or a single id.
+type ClaimAuthorizer struct {
+	Claim string
+}
+
+func (a ClaimAuthorizer) Authorize(_ context.Context, access EntityAccess) (bool, error) {
+	switch value := access.Claims[a.Claim].(type) {
+	case string:
+		return value == access.EntityId, nil
+	case []interface{}:
+		for _, item := range value {
+			if id, ok := item.(string); ok && id == access.EntityId {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// HttpAuthorizer asks our backend: the access is POSTed as JSON with the
+// upload token as a bearer, 2xx allows, 403 and 404 deny.
+type HttpAuthorizer struct {
+	URL    string
+	Client *http.Client
+}
+
+func (a HttpAuthorizer) Authorize(ctx context.Context, access EntityAccess) (bool, error) {
+	body, err := json.Marshal(access)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+access.Token)
+
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, nil
+	case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("entity authorization callback: unexpected status %d", resp.StatusCode)
+	}
+}
+
+// StaticAuthorizer is a local stub for tests and development: a fixed list of
+// entities per user, "*" allows every entity.
+type StaticAuthorizer struct {
+	Entities map[string][]string
+}
+
+// ParseStaticAuthorizer reads the stub rules in the form "user=ent1|ent2,user2=*"
+func ParseStaticAuthorizer(value string) (StaticAuthorizer, error) {
+	a := StaticAuthorizer{Entities: make(map[string][]string)}
+
+	for _, rule := range splitList(value) {
+		user, entities, ok := strings.Cut(rule, "=")
+		if !ok || user == "" || entities == "" {
+			return a, fmt.Errorf("invalid entity rule %q, expected user=entity|entity", rule)
+		}
+		a.Entities[user] = append(a.Entities[user], strings.Split(entities, "|")...)
+	}
+
+	return a, nil
+}
+
+func (a StaticAuthorizer) Authorize(_ context.Context, access EntityAccess) (bool, error) {
+	for _, id := range a.Entities[access.UserId] {
+		if id == "*" || id == access.EntityId {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// NewEntityAuthorizer builds the authorizer selected by ENTITY_AUTH_MODE. The
+// check is only disabled with an explicit "none": since the entity check was
+// added an unset ENTITY_AUTH_MODE means "claim", so deployments which relied
+// on the open behaviour must set ENTITY_AUTH_MODE=none or issue tokens with
+// the ENTITY_AUTH_CLAIM claim.
+func NewEntityAuthorizer(config appconfig.AppConfig) (EntityAuthorizer, error) {
+	switch config.EntityAuthMode {
+	case "none":
+		return AllowAllAuthorizer{}, nil
+	case "claim":
+		return ClaimAuthorizer{Claim: config.EntityAuthClaim}, nil
+	case "http":
+		if config.EntityAuthURL == "" {
+			return nil, fmt.Errorf("ENTITY_AUTH_URL is required for the http entity authorization")
+		}
+		return HttpAuthorizer{URL: config.EntityAuthURL, Client: &http.Client{Timeout: config.EntityAuthTimeout}}, nil
+	case "stub":
+		return ParseStaticAuthorizer(config.EntityAuthStub)
+	default:
+		return nil, fmt.Errorf("unknown entity authorization mode %q", config.EntityAuthMode)
+	}
+}
+
+// EntityAuthHandler checks in pre-create that the user may attach files to
+// the entity from the upload meta, MoveHandler later writes into {entityId}/.
+type EntityAuthHandler struct {
+	config     appconfig.AppConfig
+	auth       *AuthHandler
+	authorizer EntityAuthorizer
+}
+
+// NewEntityAuthHandler uses the authorizer shared with the HTTP endpoints, so
+// both decide the same way.
+func NewEntityAuthHandler(config appconfig.AppConfig, auth *AuthHandler, authorizer EntityAuthorizer) *EntityAuthHandler {
+	return &EntityAuthHandler{
+		config:     config,
+		auth:       auth,
+		authorizer: authorizer,
+	}
+}
+
+func (g *EntityAuthHandler) Setup() error {
+	log.Println("EntityAuthHandler.Setup setup")
+
+	return nil
+}
+
+func (g *EntityAuthHandler) InvokeHook(req hooks.HookRequest) (res hooks.HookResponse, err error) {
+	entityId := req.Event.Upload.MetaData["id"]
+	if entityId == "" {
+		return res, nil
+	}
+
+	// Токен уже проверил AuthHandler, здесь нужны только его claims
+	token := req.Event.HTTPRequest.Header.Get("Upload-Token")
+	claims, reason := g.auth.Authenticate(hookContext(req), token)
+	if reason != "" {
+		g.auth.errorResponse(&res, reason)
+		return res, nil
+	}
+
+	access := EntityAccess{
+		UserId:    claims["sub"].(string),
+		EntityId:  entityId,
+		MediaType: req.Event.Upload.MetaData["mediatype"],
+		Token:     token,
+		Claims:    claims,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.config.EntityAuthTimeout)
+	defer cancel()
+
+	allowed, err := g.authorizer.Authorize(ctx, access)
+	if err != nil {
+		slog.Error("Entity authorization failed", "userId", access.UserId, "entityId", entityId, "err", err.Error())
+		res.HTTPResponse.StatusCode = 503
+		res.HTTPResponse.Body = "Unable to check access to the entity"
+		res.RejectUpload = true
+		return res, nil
+	}
+
+	if !allowed {
+		MetricsAuthRejectionsTotal.WithLabelValues(string(ReasonEntityForbidden)).Inc()
+		res.HTTPResponse.StatusCode = 403
+		res.HTTPResponse.Body = fmt.Sprintf("Access to entity %s denied", entityId)
+		res.RejectUpload = true
+		return res, nil
+	}
+
+	return res, nil
+}
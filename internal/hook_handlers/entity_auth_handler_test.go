@@ -0,0 +1,239 @@
+package hook_handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	appconfig "codiewuploader/internal/config"
+
+	"github.com/form3tech-oss/jwt-go"
+	"github.com/tus/tusd/v2/pkg/handler"
+	"github.com/tus/tusd/v2/pkg/hooks"
+)
+
+func signTestToken(t *testing.T, secret string, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func entityAuthRequest(token, entityId string) hooks.HookRequest {
+	return hooks.HookRequest{
+		Type: hooks.HookPreCreate,
+		Event: handler.HookEvent{
+			Upload: handler.FileInfo{MetaData: handler.MetaData{"id": entityId, "mediatype": "image"}},
+			HTTPRequest: handler.HTTPRequest{
+				Header: http.Header{"Upload-Token": []string{token}},
+			},
+		},
+	}
+}
+
+func TestClaimAuthorizer(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		entity string
+		want   bool
+	}{
+		{name: "single id", claims: jwt.MapClaims{"entities": "e1"}, entity: "e1", want: true},
+		{name: "other single id", claims: jwt.MapClaims{"entities": "e2"}, entity: "e1", want: false},
+		{name: "listed", claims: jwt.MapClaims{"entities": []interface{}{"e0", "e1"}}, entity: "e1", want: true},
+		{name: "not listed", claims: jwt.MapClaims{"entities": []interface{}{"e0", "e2"}}, entity: "e1", want: false},
+		{name: "non-string items", claims: jwt.MapClaims{"entities": []interface{}{1.0, true}}, entity: "1", want: false},
+		{name: "no claim", claims: jwt.MapClaims{"sub": "u1"}, entity: "e1", want: false},
+		{name: "number claim", claims: jwt.MapClaims{"entities": 1.0}, entity: "1", want: false},
+	}
+
+	authorizer := ClaimAuthorizer{Claim: "entities"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, err := authorizer.Authorize(context.Background(), EntityAccess{EntityId: tt.entity, Claims: tt.claims})
+			if err != nil {
+				t.Fatalf("Authorize: %v", err)
+			}
+			if allowed != tt.want {
+				t.Errorf("allowed = %v, want %v", allowed, tt.want)
+			}
+		})
+	}
+}
+
+func TestHttpAuthorizer(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		want    bool
+		wantErr bool
+	}{
+		{name: "ok", status: http.StatusOK, want: true},
+		{name: "no content", status: http.StatusNoContent, want: true},
+		{name: "forbidden", status: http.StatusForbidden, want: false},
+		{name: "not found", status: http.StatusNotFound, want: false},
+		{name: "unauthorized", status: http.StatusUnauthorized, wantErr: true},
+		{name: "server error", status: http.StatusInternalServerError, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got EntityAccess
+			var authorization, method string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				method = r.Method
+				authorization = r.Header.Get("Authorization")
+				if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+					t.Errorf("decode body: %v", err)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			authorizer := HttpAuthorizer{URL: server.URL, Client: server.Client()}
+			access := EntityAccess{UserId: "u1", EntityId: "e1", MediaType: "image", Token: "token"}
+
+			allowed, err := authorizer.Authorize(context.Background(), access)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if allowed != tt.want {
+				t.Errorf("allowed = %v, want %v", allowed, tt.want)
+			}
+
+			if method != http.MethodPost {
+				t.Errorf("method = %s, want POST", method)
+			}
+			if authorization != "Bearer token" {
+				t.Errorf("Authorization = %q, want the upload token", authorization)
+			}
+			if got.UserId != "u1" || got.EntityId != "e1" || got.MediaType != "image" {
+				t.Errorf("body = %+v, want the access", got)
+			}
+		})
+	}
+}
+
+func TestHttpAuthorizerTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	authorizer := HttpAuthorizer{URL: server.URL, Client: &http.Client{Timeout: 50 * time.Millisecond}}
+
+	allowed, err := authorizer.Authorize(context.Background(), EntityAccess{EntityId: "e1"})
+	if err == nil || allowed {
+		t.Fatalf("allowed = %v, err = %v, want a timeout error", allowed, err)
+	}
+}
+
+func TestNewEntityAuthorizer(t *testing.T) {
+	tests := []struct {
+		mode    string
+		url     string
+		want    EntityAuthorizer
+		wantErr bool
+	}{
+		{mode: "claim", want: ClaimAuthorizer{Claim: "entities"}},
+		{mode: "none", want: AllowAllAuthorizer{}},
+		{mode: "", wantErr: true},
+		{mode: "http", wantErr: true},
+		{mode: "unknown", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			authorizer, err := NewEntityAuthorizer(appconfig.AppConfig{
+				EntityAuthMode:  tt.mode,
+				EntityAuthClaim: "entities",
+				EntityAuthURL:   tt.url,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && authorizer != tt.want {
+				t.Errorf("authorizer = %#v, want %#v", authorizer, tt.want)
+			}
+		})
+	}
+}
+
+func TestEntityAuthHandler(t *testing.T) {
+	valid := jwt.MapClaims{"sub": "u1", "exp": float64(time.Now().Add(time.Hour).Unix())}
+
+	tests := []struct {
+		name        string
+		token       string
+		entity      string
+		status      int
+		unreachable bool
+		wantStatus  int
+		wantCalled  bool
+	}{
+		{name: "allowed", entity: "e1", status: http.StatusNoContent, wantCalled: true},
+		{name: "denied", entity: "e1", status: http.StatusForbidden, wantStatus: http.StatusForbidden, wantCalled: true},
+		{name: "unknown entity", entity: "e1", status: http.StatusNotFound, wantStatus: http.StatusForbidden, wantCalled: true},
+		{name: "authorizer error", entity: "e1", status: http.StatusInternalServerError, wantStatus: http.StatusServiceUnavailable, wantCalled: true},
+		{name: "authorizer unreachable", entity: "e1", unreachable: true, wantStatus: http.StatusServiceUnavailable},
+		{name: "invalid token", token: "broken", entity: "e1", status: http.StatusNoContent, wantStatus: http.StatusUnauthorized},
+		{name: "no entity", entity: "", status: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called bool
+			var got EntityAccess
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				json.NewDecoder(r.Body).Decode(&got)
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+			if tt.unreachable {
+				server.Close()
+			}
+
+			config := appconfig.AppConfig{
+				JwtSecrets:        []string{"secret"},
+				EntityAuthMode:    "http",
+				EntityAuthURL:     server.URL,
+				EntityAuthTimeout: time.Second,
+			}
+			authorizer, err := NewEntityAuthorizer(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			g := NewEntityAuthHandler(config, NewAuthHandler(config), authorizer)
+
+			token := tt.token
+			if token == "" {
+				token = signTestToken(t, "secret", valid)
+			}
+
+			res, err := g.InvokeHook(entityAuthRequest(token, tt.entity))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.HTTPResponse.StatusCode != tt.wantStatus || res.RejectUpload != (tt.wantStatus != 0) {
+				t.Errorf("status = %d, reject = %v, want %d", res.HTTPResponse.StatusCode, res.RejectUpload, tt.wantStatus)
+			}
+			if called != tt.wantCalled {
+				t.Fatalf("authorizer called = %v, want %v", called, tt.wantCalled)
+			}
+			if called && (got.UserId != "u1" || got.EntityId != "e1" || got.MediaType != "image") {
+				t.Errorf("access = %+v, want the user and the entity of the upload", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package hook_handlers
+
+import (
+	"codiewuploader/internal/events"
+	"codiewuploader/internal/model"
+	"codiewuploader/internal/status"
+
+	"github.com/tus/tusd/v2/pkg/hooks"
+)
+
+// uploadEvents maps the tusd hooks to the events sent to the subscribers
+var uploadEvents = map[hooks.HookType]string{
+	hooks.HookPostCreate:    events.TypeCreated,
+	hooks.HookPostReceive:   events.TypeProgress,
+	hooks.HookPostFinish:    events.TypeFinished,
+	hooks.HookPostTerminate: events.TypeTerminated,
+}
+
+// publishUpload sends the upload progress, the post-receive hooks come every
+// -progress-hooks-interval while the upload is running.
+func (g *Handler) publishUpload(req hooks.HookRequest) {
+	eventType, ok := uploadEvents[req.Type]
+	if !ok {
+		return
+	}
+
+	upload := req.Event.Upload
+	uploadId, _ := splitIds(upload.ID)
+
+	g.events.Publish(events.Event{
+		Type:     eventType,
+		UploadId: uploadId,
+		EntityId: upload.MetaData["id"],
+		UserId:   upload.MetaData[OwnerMetaKey],
+		Offset:   upload.Offset,
+		Size:     upload.Size,
+	})
+}
+
+// publishStage sends every stored stage status, so the subscribers see the
+// processing without polling the status API
+func (g *Handler) publishStage(upload status.Upload, stage model.StageStatus) {
+	g.events.Publish(events.Event{
+		Type:     events.TypeStage,
+		UploadId: upload.UploadId,
+		EntityId: upload.EntityId,
+		UserId:   upload.UserId,
+		Stage:    &stage,
+	})
+}
@@ -0,0 +1,210 @@
+package hook_handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// VideoPreset describes the H.264/AAC encoding settings for web playback.
+type VideoPreset struct {
+	X264Preset   string
+	CRF          int
+	MaxHeight    int
+	AudioBitrate string
+}
+
+var videoPresets = map[string]VideoPreset{
+	"fast": {
+		X264Preset:   "veryfast",
+		CRF:          26,
+		MaxHeight:    720,
+		AudioBitrate: "96k",
+	},
+	"default": {
+		X264Preset:   "medium",
+		CRF:          23,
+		MaxHeight:    1080,
+		AudioBitrate: "128k",
+	},
+	"quality": {
+		X264Preset:   "slow",
+		CRF:          20,
+		MaxHeight:    1080,
+		AudioBitrate: "192k",
+	},
+}
+
+type probeStream struct {
+	CodecType string `json:"codec_type"`
+	CodecName string `json:"codec_name"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	PixFmt    string `json:"pix_fmt"`
+}
+
+// shortSide is the height of a landscape frame and the width of a portrait
+// one, the presets limit it so vertical videos keep their resolution.
+func (s probeStream) shortSide() int {
+	return min(s.Width, s.Height)
+}
+
+type probeResult struct {
+	Streams []probeStream `json:"streams"`
+	Format  struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+	} `json:"format"`
+}
+
+func (p probeResult) stream(codecType string) (probeStream, bool) {
+	for _, s := range p.Streams {
+		if s.CodecType == codecType {
+			return s, true
+		}
+	}
+
+	return probeStream{}, false
+}
+
+// webPlayable reports whether the streams can be copied into the MP4 as-is,
+// i.e. the file is already H.264/AAC within the preset resolution. The
+// container doesn't matter, MOV or MKV are only remuxed.
+func (p probeResult) webPlayable(maxHeight int) bool {
+	video, ok := p.stream("video")
+	if !ok || video.CodecName != "h264" || video.shortSide() > maxHeight {
+		return false
+	}
+
+	// 10-битный или 4:2:2 H.264 браузеры не играют
+	if video.PixFmt != "" && video.PixFmt != "yuv420p" && video.PixFmt != "yuvj420p" {
+		return false
+	}
+
+	if audio, ok := p.stream("audio"); ok && audio.CodecName != "aac" {
+		return false
+	}
+
+	return true
+}
+
+// ffprobe runs ffprobe against the file and decodes its JSON output.
+func ffprobe(ctx context.Context, ffprobePath, path string) (probeResult, error) {
+	var result probeResult
+
+	out, err := runCommand(ctx, ffprobePath,
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		path,
+	)
+	if err != nil {
+		return result, err
+	}
+
+	if err := json.Unmarshal(out, &result); err != nil {
+		return result, fmt.Errorf("ffprobe: invalid output: %w", err)
+	}
+
+	return result, nil
+}
+
+// transcodeArgs builds the ffmpeg arguments for a web-playable MP4. Files that
+// are already H.264/AAC within the preset are only remuxed. MaxHeight limits
+// the shorter side, so portrait videos are scaled by width.
+func transcodeArgs(input, output string, probe probeResult, preset VideoPreset) []string {
+	args := []string{"-y", "-v", "error", "-i", input, "-map", "0:v:0", "-map", "0:a:0?"}
+
+	if probe.webPlayable(preset.MaxHeight) {
+		args = append(args, "-c", "copy")
+	} else {
+		args = append(args,
+			"-c:v", "libx264",
+			"-preset", preset.X264Preset,
+			"-crf", strconv.Itoa(preset.CRF),
+			"-pix_fmt", "yuv420p",
+			"-vf", fmt.Sprintf("scale='if(gt(iw,ih),-2,min(%[1]d,iw))':'if(gt(iw,ih),min(%[1]d,ih),-2)'", preset.MaxHeight),
+			"-c:a", "aac",
+			"-b:a", preset.AudioBitrate,
+		)
+	}
+
+	return append(args, "-movflags", "+faststart", "-f", "mp4", output)
+}
+
+// runCommand executes the binary and returns its stdout. Stderr is included
+// into the error, as ffmpeg reports the reason of failures there.
+func runCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// ImageFormat is a modern image format encoded with the bundled ffmpeg.
+type ImageFormat struct {
+	Name        string
+	Ext         string
+	ContentType string
+	Encoder     string
+	Args        []string
+}
+
+// imageFormatCandidates lists encoders per format in order of preference.
+var imageFormatCandidates = map[string][]ImageFormat{
+	"webp": {
+		{Name: "webp", Ext: ".webp", ContentType: "image/webp", Encoder: "libwebp", Args: []string{"-c:v", "libwebp", "-quality", "80", "-f", "webp"}},
+	},
+	"avif": {
+		{Name: "avif", Ext: ".avif", ContentType: "image/avif", Encoder: "libaom-av1", Args: []string{"-c:v", "libaom-av1", "-still-picture", "1", "-crf", "32", "-b:v", "0", "-pix_fmt", "yuv420p", "-f", "avif"}},
+		{Name: "avif", Ext: ".avif", ContentType: "image/avif", Encoder: "libsvtav1", Args: []string{"-c:v", "libsvtav1", "-crf", "35", "-pix_fmt", "yuv420p", "-f", "avif"}},
+	},
+}
+
+// detectImageFormats returns the wanted formats for which ffmpeg has an encoder.
+func detectImageFormats(ctx context.Context, ffmpegPath string, wanted []string) ([]ImageFormat, error) {
+	out, err := runCommand(ctx, ffmpegPath, "-hide_banner", "-encoders")
+	if err != nil {
+		return nil, err
+	}
+
+	encoders := make(map[string]struct{})
+	for _, line := range strings.Split(string(out), "\n") {
+		// Строки вида " V....D libwebp   libwebp WebP image (codec webp)"
+		fields := strings.Fields(line)
+		if len(fields) >= 2 {
+			encoders[fields[1]] = struct{}{}
+		}
+	}
+
+	var formats []ImageFormat
+	for _, name := range wanted {
+		for _, candidate := range imageFormatCandidates[strings.TrimSpace(name)] {
+			if _, ok := encoders[candidate.Encoder]; ok {
+				formats = append(formats, candidate)
+				break
+			}
+		}
+	}
+
+	return formats, nil
+}
+
+// encodeImageFormat converts the input image file into the given format.
+func encodeImageFormat(ctx context.Context, ffmpegPath, input, output string, format ImageFormat) error {
+	args := append([]string{"-y", "-v", "error", "-i", input}, format.Args...)
+	_, err := runCommand(ctx, ffmpegPath, append(args, output)...)
+	return err
+}
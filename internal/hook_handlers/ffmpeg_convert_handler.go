@@ -1,45 +1,157 @@
 package hook_handlers
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
 
 	appconfig "codiewuploader/internal/config"
+	"codiewuploader/internal/model"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/tus/tusd/v2/pkg/hooks"
+	"golang.org/x/exp/slog"
 )
 
+const ffmpegStage = "ffmpeg-convert"
+
+var ErrNoVideoStream = errors.New("file has no video stream")
+
 type FfmpegConvertHandler struct {
-	config appconfig.AppConfig
+	config   appconfig.AppConfig
+	s3Client *s3.Client
 }
 
 func NewFfmpegConvertHandler(config appconfig.AppConfig) *FfmpegConvertHandler {
 	return &FfmpegConvertHandler{
-		config: config,
+		config:   config,
+		s3Client: InitS3Client(config),
 	}
 }
 
 func (g *FfmpegConvertHandler) Setup() error {
 	log.Println("FfmpegConvertHandler.Setup setup")
+
+	if _, ok := videoPresets[g.config.VideoPreset]; !ok {
+		return fmt.Errorf("unknown video preset %q", g.config.VideoPreset)
+	}
+
+	for _, bin := range []string{g.config.FfmpegPath, g.config.FfprobePath} {
+		if _, err := exec.LookPath(bin); err != nil {
+			slog.Warn("Video transcoding binary not found, videos will fail to convert", "bin", bin)
+		}
+	}
+
 	return nil
 }
 
-// eyJhdWQiOiJhdXRoZW50aWNhdGVkIiwiZXhwIjoxNzI5MTc3MDUxLCJpYXQiOjE3MjkxNzM0NTEsImlzcyI6Imh0dHA6Ly8xMjcuMC4wLjE6NTQzMjEvYXV0aC92MSIsInN1YiI6ImI5YTVmNzJiLWIzZGUtNDIyNy05ZjZlLTdjNGU3NTMxOWZlMSIsImVtYWlsIjoibWZlZG9yb3ZAZ2FyYS5nZSIsInBob25lIjoiIiwiYXBwX21ldGFkYXRhIjp7InByb3ZpZGVyIjoiZ29vZ2xlIiwicHJvdmlkZXJzIjpbImdvb2dsZSJdfSwidXNlcl9tZXRhZGF0YSI6eyJhdmF0YXJfdXJsIjoiaHR0cHM6Ly9saDMuZ29vZ2xldXNlcmNvbnRlbnQuY29tL2EvQUNnOG9jSmpPbmJKaFJxN3hCbDM5VjVNNWNpN2hVb2g0TzRwYnoxUDRKQWVjWW55US04V1JWQT1zOTYtYyIsImN1c3RvbV9jbGFpbXMiOnsiaGQiOiJnYXJhLmdlIn0sImVtYWlsIjoibWZlZG9yb3ZAZ2FyYS5nZSIsImVtYWlsX3ZlcmlmaWVkIjp0cnVlLCJmdWxsX25hbWUiOiJNYWtzaW0gRmVkb3JvdiIsImlzcyI6Imh0dHBzOi8vYWNjb3VudHMuZ29vZ2xlLmNvbSIsIm5hbWUiOiJNYWtzaW0gRmVkb3JvdiIsInBob25lX3ZlcmlmaWVkIjpmYWxzZSwicGljdHVyZSI6Imh0dHBzOi8vbGgzLmdvb2dsZXVzZXJjb250ZW50LmNvbS9hL0FDZzhvY0pqT25iSmhScTd4QmwzOVY1TTVjaTdoVW9oNE80cGJ6MVA0SkFlY1lueVEtOFdSVkE9czk2LWMiLCJwcm92aWRlcl9pZCI6IjExNzc1NDM5NDAwOTUyMTI5NzcyNSIsInN1YiI6IjExNzc1NDM5NDAwOTUyMTI5NzcyNSJ9LCJyb2xlIjoiYXV0aGVudGljYXRlZCIsImFhbCI6ImFhbDEiLCJhbXIiOlt7Im1ldGhvZCI6Im9hdXRoIiwidGltZXN0YW1wIjoxNzI5MTY1NzkwfV0sInNlc3Npb25faWQiOiI3NGRkNWYzNi1kMjRkLTRiMTEtYjg0My02Y2I5NGQwZmUxNTkiLCJpc19hbm9ueW1vdXMiOmZhbHNlfQ
+// InvokeHook transcodes finished video uploads into a web-playable MP4 which is
+// stored as {entityId}/{name}-web.mp4 next to the original.
 func (g *FfmpegConvertHandler) InvokeHook(req hooks.HookRequest) (res hooks.HookResponse, err error) {
+	if req.Event.Upload.MetaData["mediatype"] != "video" {
+		return res, nil
+	}
 
-	//err = ffmpeg.Input("./sample_data/in1.mp4").
-	//	Output("./sample_data/out1.mp4", ffmpeg.KwArgs{"c:v": "libx265"}).
-	//	OverWriteOutput().ErrorToStdOut().Run()
-	//
-	//if err != nil {
-	//	g.errorResponse(&res)
-	//	return res, nil
-	//}
+	entityId, ok := req.Event.Upload.MetaData["id"]
+	if !ok || entityId == "" {
+		model.StageStatus{Status: model.StatusSkipped, Error: "upload has no id in meta"}.Respond(&res, ffmpegStage)
+		return res, nil
+	}
 
-	return hooks.HookResponse{}, nil
+	// Пресет можно выбрать на конкретную загрузку, иначе берем из конфига
+	presetName, ok := req.Event.Upload.MetaData["videoPreset"]
+	if !ok || presetName == "" {
+		presetName = g.config.VideoPreset
+	}
+
+	preset, ok := videoPresets[presetName]
+	if !ok {
+		model.StageStatus{Status: model.StatusFailed, Error: fmt.Sprintf("unknown video preset %q", presetName)}.Respond(&res, ffmpegStage)
+		return res, nil
+	}
+
+	uploadId, _ := splitIds(req.Event.Upload.ID)
+	key := webVideoKey(entityId, req.Event.Upload.MetaData["filename"], uploadId)
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.config.FfmpegTimeout)
+	defer cancel()
+
+	if err := g.convert(ctx, uploadId, key, preset); err != nil {
+		slog.Error("Video conversion failed", "uploadId", uploadId, "err", err.Error())
+		model.StageStatus{Status: model.StatusFailed, Error: err.Error()}.Respond(&res, ffmpegStage)
+		return res, nil
+	}
+
+	slog.Info("Video converted", "uploadId", uploadId, "key", key, "preset", presetName)
+	model.StageStatus{Status: model.StatusDone, Output: key, Keys: []string{key}}.Respond(&res, ffmpegStage)
+
+	return res, nil
 }
 
-func (g *FfmpegConvertHandler) errorResponse(res *hooks.HookResponse) {
-	res.HTTPResponse.StatusCode = 401
-	res.HTTPResponse.Body = ErrInvalidToken
-	res.RejectUpload = true
+func (g *FfmpegConvertHandler) convert(ctx context.Context, uploadId, key string, preset VideoPreset) error {
+	obj, err := g.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(SwampDir),
+		Key:    aws.String(uploadId),
+	})
+	if err != nil {
+		return err
+	}
+	defer obj.Body.Close()
+
+	inputFile, err := ioutil.TempFile("", "tusd-ffmpeg-in-")
+	if err != nil {
+		return err
+	}
+	defer cleanUpTempFile(inputFile)
+
+	if _, err := io.Copy(inputFile, obj.Body); err != nil {
+		return err
+	}
+
+	probe, err := ffprobe(ctx, g.config.FfprobePath, inputFile.Name())
+	if err != nil {
+		return err
+	}
+
+	if _, ok := probe.stream("video"); !ok {
+		return ErrNoVideoStream
+	}
+
+	outputFile, err := ioutil.TempFile("", "tusd-ffmpeg-out-")
+	if err != nil {
+		return err
+	}
+	defer cleanUpTempFile(outputFile)
+
+	if _, err := runCommand(ctx, g.config.FfmpegPath, transcodeArgs(inputFile.Name(), outputFile.Name(), probe, preset)...); err != nil {
+		return err
+	}
+
+	// ffmpeg писал в файл по имени, наш дескриптор все еще в начале
+	_, err = g.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(g.config.ResultBucket),
+		Key:         aws.String(key),
+		Body:        outputFile,
+		ACL:         types.ObjectCannedACLPublicRead,
+		ContentType: aws.String("video/mp4"),
+	})
+
+	return err
+}
+
+func webVideoKey(entityId, filename, fallback string) string {
+	name := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	if filename == "" || name == "" {
+		name = fallback
+	}
+
+	return fmt.Sprintf("%s/%s-web.mp4", entityId, name)
 }
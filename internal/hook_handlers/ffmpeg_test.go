@@ -0,0 +1,73 @@
+package hook_handlers
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+func TestWebPlayable(t *testing.T) {
+	h264 := probeStream{CodecType: "video", CodecName: "h264", Width: 1920, Height: 1080, PixFmt: "yuv420p"}
+	aac := probeStream{CodecType: "audio", CodecName: "aac"}
+
+	portrait := h264
+	portrait.Width, portrait.Height = 1080, 1920
+
+	large := h264
+	large.Width, large.Height = 3840, 2160
+
+	hevc := h264
+	hevc.CodecName = "hevc"
+
+	tenBit := h264
+	tenBit.PixFmt = "yuv420p10le"
+
+	tests := []struct {
+		name    string
+		streams []probeStream
+		want    bool
+	}{
+		{name: "h264 aac", streams: []probeStream{h264, aac}, want: true},
+		{name: "no audio", streams: []probeStream{h264}, want: true},
+		{name: "portrait within limit", streams: []probeStream{portrait, aac}, want: true},
+		{name: "above limit", streams: []probeStream{large, aac}, want: false},
+		{name: "hevc", streams: []probeStream{hevc, aac}, want: false},
+		{name: "10 bit", streams: []probeStream{tenBit, aac}, want: false},
+		{name: "mp3 audio", streams: []probeStream{h264, {CodecType: "audio", CodecName: "mp3"}}, want: false},
+		{name: "no video", streams: []probeStream{aac}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (probeResult{Streams: tt.streams}).webPlayable(1080); got != tt.want {
+				t.Errorf("webPlayable = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTranscodeArgs(t *testing.T) {
+	preset := videoPresets["default"]
+
+	copied := transcodeArgs("in", "out", probeResult{Streams: []probeStream{
+		{CodecType: "video", CodecName: "h264", Width: 1080, Height: 1920},
+	}}, preset)
+	if !slices.Contains(copied, "copy") || slices.Contains(copied, "libx264") {
+		t.Errorf("web-playable file is re-encoded: %v", copied)
+	}
+
+	encoded := transcodeArgs("in", "out", probeResult{Streams: []probeStream{
+		{CodecType: "video", CodecName: "hevc", Width: 1080, Height: 1920},
+	}}, preset)
+	i := slices.Index(encoded, "-vf")
+	if i < 0 {
+		t.Fatalf("no scale filter: %v", encoded)
+	}
+	if filter := encoded[i+1]; !strings.Contains(filter, "if(gt(iw,ih),-2,min(1080,iw))") || !strings.Contains(filter, "if(gt(iw,ih),min(1080,ih),-2)") {
+		t.Errorf("filter = %s, want the shorter side limited", filter)
+	}
+	if encoded[len(encoded)-1] != "out" {
+		t.Errorf("output = %s, want out", encoded[len(encoded)-1])
+	}
+}
@@ -1,76 +1,443 @@
 package hook_handlers
 
 import (
+	"context"
 	"fmt"
+	"github.com/form3tech-oss/jwt-go"
 	"github.com/tus/tusd/v2/pkg/hooks"
+	"golang.org/x/exp/slog"
+	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	appconfig "codiewuploader/internal/config"
+	"codiewuploader/internal/events"
+	"codiewuploader/internal/quota"
+	"codiewuploader/internal/status"
 )
 
 type Handler struct {
-	handlers []hooks.HookHandler
+	config   appconfig.AppConfig
+	auth     *AuthHandler
+	entities EntityAuthorizer
+	// entityAuthTimeout limits entities, it may come from the stage options
+	entityAuthTimeout time.Duration
+	quota             *QuotaHandler
+	async             *asyncPool
+	status            *status.Store
+	events            *events.Broker
+	handlers          []hooks.HookHandler
+
+	// resultBucket is the bucket the move stage writes to, the only one
+	// served over HTTP
+	resultBucket string
 }
 
-func NewHandler(s3Endpoint string) *Handler {
+func NewHandler(s3Endpoint, uploadDir string) *Handler {
+	env := &appconfig.Env{}
+
+	renditions, err := appconfig.ParseRenditions(env.String("IMAGE_RENDITIONS", "thumb:320,card:800,full:1920"))
+	if err != nil {
+		log.Fatalf("invalid IMAGE_RENDITIONS: %v", err)
+	}
+
+	watermarks, err := appconfig.LoadWatermarkConfig(os.Getenv("WATERMARK_PROFILES"))
+	if err != nil {
+		log.Fatalf("invalid WATERMARK_PROFILES: %v", err)
+	}
+
+	formatLimits, err := appconfig.ParseFormatLimits(os.Getenv("IMAGE_FORMAT_MEGAPIXELS"))
+	if err != nil {
+		log.Fatalf("invalid IMAGE_FORMAT_MEGAPIXELS: %v", err)
+	}
+
+	metadataSchema, err := appconfig.LoadMetadataSchema(os.Getenv("METADATA_SCHEMA"))
+	if err != nil {
+		log.Fatalf("invalid METADATA_SCHEMA: %v", err)
+	}
+
+	pipeline, err := appconfig.LoadPipelineConfig(os.Getenv("PIPELINE_CONFIG"))
+	if err != nil {
+		log.Fatalf("invalid PIPELINE_CONFIG: %v", err)
+	}
+
+	metadataMerge, err := appconfig.ParseMergePolicies(os.Getenv("METADATA_MERGE_POLICY"))
+	if err != nil {
+		log.Fatalf("invalid METADATA_MERGE_POLICY: %v", err)
+	}
+	// Владельца и резерв квоты ставят проверки pre-create, следующие стадии их не
+	// перетирают. Политика фиксированная, METADATA_MERGE_POLICY ее не меняет
+	metadataMerge = mergePolicies(metadataMerge, map[string]string{
+		OwnerMetaKey:            appconfig.MergeFirst,
+		QuotaReservationMetaKey: appconfig.MergeFirst,
+	})
+
 	config := appconfig.AppConfig{
-		JwtSecret:    os.Getenv("JWT_SECRET"),
+		JwtSecrets:       jwtSecrets(),
+		JwtJwks:          os.Getenv("JWT_JWKS"),
+		JwtJwksCacheTTL:  env.Duration("JWT_JWKS_CACHE_TTL", 10*time.Minute),
+		JwtAudience:      splitList(os.Getenv("JWT_AUDIENCE")),
+		JwtIssuer:        os.Getenv("JWT_ISSUER"),
+		JwtClockSkew:     env.Duration("JWT_CLOCK_SKEW", 30*time.Second),
+		JwtRequireExpiry: env.Bool("JWT_REQUIRE_EXPIRY", true),
+
+		// Без ENTITY_AUTH_MODE сущности проверяются по claim токена, открытый режим только явно
+		EntityAuthMode:    env.String("ENTITY_AUTH_MODE", "claim"),
+		EntityAuthClaim:   env.String("ENTITY_AUTH_CLAIM", "entities"),
+		EntityAuthURL:     os.Getenv("ENTITY_AUTH_URL"),
+		EntityAuthTimeout: env.Duration("ENTITY_AUTH_TIMEOUT", 5*time.Second),
+		EntityAuthStub:    os.Getenv("ENTITY_AUTH_STUB"),
+
+		MetadataSchema: metadataSchema,
+		MetadataMerge:  metadataMerge,
+
+		QuarantineBucket: env.String("QUARANTINE_BUCKET", "rent_quarantine"),
+		QuarantinePrefix: env.String("QUARANTINE_PREFIX", "quarantine/"),
+
+		ClamdNetwork:          env.String("CLAMD_NETWORK", "tcp"),
+		ClamdAddress:          os.Getenv("CLAMD_ADDRESS"),
+		ClamdTimeout:          env.Duration("CLAMD_TIMEOUT", 5*time.Minute),
+		ClamdDialTimeout:      env.Duration("CLAMD_DIAL_TIMEOUT", 10*time.Second),
+		ClamdFailOpen:         env.Bool("CLAMD_FAIL_OPEN", false),
+		ClamdQuarantinePrefix: env.String("CLAMD_QUARANTINE_PREFIX", "quarantine/infected/"),
+		ClamdSizeLimitAction:  env.String("CLAMD_SIZE_LIMIT_ACTION", appconfig.ClamdSizeLimitReject),
+
+		QuotaFile: filepath.Join(uploadDir, "quota.json"),
+		QuotaUser: quota.Limits{
+			Bytes:      env.Int64("QUOTA_USER_BYTES", 0),
+			Files:      env.Int64("QUOTA_USER_FILES", 0),
+			InProgress: env.Int64("QUOTA_USER_IN_PROGRESS", 0),
+		},
+		QuotaEntity: quota.Limits{
+			Bytes:      env.Int64("QUOTA_ENTITY_BYTES", 0),
+			Files:      env.Int64("QUOTA_ENTITY_FILES", 0),
+			InProgress: env.Int64("QUOTA_ENTITY_IN_PROGRESS", 0),
+		},
+		QuotaReservationTTL: env.Duration("QUOTA_RESERVATION_TTL", 24*time.Hour),
+
 		ResultBucket: os.Getenv("RECORD_BUCKET"),
 
 		S3Endpoint: s3Endpoint,
-	}
-	_ = config
 
-	return &Handler{
-		handlers: []hooks.HookHandler{
-			NewAuthHandler(config),
-			NewHeicConverterHandler(config),
-			//NewFinishHandler(config),
-			NewMoveHandler(config),
-			NewFfmpegConvertHandler(config),
+		FfmpegPath:    env.String("FFMPEG_PATH", "ffmpeg"),
+		FfprobePath:   env.String("FFPROBE_PATH", "ffprobe"),
+		FfmpegTimeout: env.Duration("FFMPEG_TIMEOUT", 30*time.Minute),
+		VideoPreset:   env.String("VIDEO_PRESET", "default"),
+
+		Renditions:  renditions,
+		JpegQuality: env.Int("JPEG_QUALITY", 90),
+
+		ImageLimits: appconfig.ImageLimits{
+			MaxWidth:         env.Int("IMAGE_MAX_WIDTH", 16384),
+			MaxHeight:        env.Int("IMAGE_MAX_HEIGHT", 16384),
+			MaxMegapixels:    env.Float("IMAGE_MAX_MEGAPIXELS", 100),
+			FormatMegapixels: formatLimits,
 		},
+		ImageWorkers: env.Int("IMAGE_WORKERS", 2),
+		ImageFormats: splitList(env.String("IMAGE_FORMATS", "webp,avif")),
+
+		Watermarks: watermarks,
+
+		SwampCleanupDryRun: env.Bool("SWAMP_CLEANUP_DRY_RUN", false),
+
+		AsyncWorkers:      env.Int("ASYNC_WORKERS", 4),
+		AsyncQueueSize:    env.Int("ASYNC_QUEUE_SIZE", 100),
+		AsyncQueueTimeout: env.Duration("ASYNC_QUEUE_TIMEOUT", 30*time.Second),
+		StatusDir:         filepath.Join(uploadDir, "status"),
+		StatusMaxAge:      env.Duration("STATUS_MAX_AGE", 7*24*time.Hour),
+
+		JobsDir:        filepath.Join(uploadDir, "jobs"),
+		JobWorkers:     env.Int("JOB_WORKERS", 2),
+		JobMaxAttempts: env.Int("JOB_MAX_ATTEMPTS", 8),
+		JobBackoff:     env.Duration("JOB_BACKOFF", 5*time.Second),
+		JobMaxBackoff:  env.Duration("JOB_MAX_BACKOFF", 10*time.Minute),
+	}
+	if err := env.Err(); err != nil {
+		log.Fatalf("invalid configuration: %v", err)
 	}
+
+	if err := checkQuarantineBucket(config.QuarantineBucket, config.ResultBucket); err != nil {
+		log.Fatalf("invalid QUARANTINE_BUCKET: %v", err)
+	}
+
+	auth := NewAuthHandler(config)
+	quotas := NewQuotaHandler(config)
+
+	g := &Handler{
+		config: config,
+		auth:   auth,
+		quota:  quotas,
+		async:  newAsyncPool(config.AsyncWorkers, config.AsyncQueueSize, config.AsyncQueueTimeout),
+		events: events.NewBroker(),
+	}
+
+	statuses, err := status.Open(status.Config{
+		Dir:      config.StatusDir,
+		MaxAge:   config.StatusMaxAge,
+		OnChange: g.publishStage,
+	})
+	if err != nil {
+		log.Fatalf("unable to open upload status store: %v", err)
+	}
+	g.status = statuses
+
+	builder := &pipelineBuilder{
+		config: config,
+		auth:   auth,
+		quotas: quotas,
+		status: statuses,
+		images: newImagePool(config.ImageWorkers),
+	}
+	g.handlers, err = builder.build(pipeline)
+	if err != nil {
+		log.Fatalf("invalid PIPELINE_CONFIG: %v", err)
+	}
+	g.resultBucket = builder.resultBucket
+	g.entities = builder.entities
+	g.entityAuthTimeout = builder.entityAuthTimeout
+
+	if _, ok := g.entities.(AllowAllAuthorizer); ok {
+		slog.Warn("Entity authorization is disabled, any user may access any entity")
+	} else if _, ok := g.entities.(ClaimAuthorizer); ok && os.Getenv("ENTITY_AUTH_MODE") == "" {
+		slog.Info("ENTITY_AUTH_MODE is not set, entities are checked against the token claim", "claim", config.EntityAuthClaim)
+	}
+
+	for _, handler := range g.handlers {
+		if s, ok := handler.(*stage); ok {
+			if antivirus, ok := s.handler.(*AntivirusHandler); ok {
+				name := s.name
+				antivirus.resume = func(req hooks.HookRequest) { g.resumeAfter(name, req) }
+			}
+		}
+	}
+
+	return g
+}
+
+// Auth returns the token checker, it's also used outside of hooks to authorize
+// requests to existing uploads.
+func (g *Handler) Auth() *AuthHandler {
+	return g.auth
+}
+
+// AuthorizeEntity asks the entity authorizer whether the token's user may
+// access the entity, the HTTP endpoints use it for entity scoped data. It is
+// the same authorizer the entity-auth stage uses, with the stage options.
+func (g *Handler) AuthorizeEntity(ctx context.Context, token string, claims jwt.MapClaims, entityId string) (bool, error) {
+	userId, _ := claims["sub"].(string)
+	if userId == "" {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, g.entityAuthTimeout)
+	defer cancel()
+
+	return g.entities.Authorize(ctx, EntityAccess{
+		UserId:   userId,
+		EntityId: entityId,
+		Token:    token,
+		Claims:   claims,
+	})
+}
+
+// Quota returns the quota checker, its usage is exposed over HTTP
+func (g *Handler) Quota() *QuotaHandler {
+	return g.quota
+}
+
+// ResultBucket returns the bucket with the moved records, it's empty without
+// a configured bucket
+func (g *Handler) ResultBucket() string {
+	return g.resultBucket
+}
+
+// Status returns the processing state of the uploads reported by the
+// post-finish stages
+func (g *Handler) Status() *status.Store {
+	return g.status
+}
+
+// Events returns the broker of the upload and processing events
+func (g *Handler) Events() *events.Broker {
+	return g.events
+}
+
+// ServerMetaKeys are set by the internal stages only. The client's values are
+// dropped in pre-create and the changes of external hooks are ignored, so
+// neither can e.g. pick another owner or a detected type, whatever the hooks
+// order.
+var ServerMetaKeys = []string{
+	OwnerMetaKey,
+	QuotaReservationMetaKey,
+	DetectedTypeMetaKey,
+	"sourceKey",
+}
+
+// InternalHooks is the name of the built-in handler chain in the hooks order
+const InternalHooks = "internal"
+
+// UseOrder arranges the built-in chain and the external tusd hooks (file,
+// http, grpc, plugin) in the given order. The built-in chain and every
+// configured external hook must be listed.
+func (g *Handler) UseOrder(order []string, external map[string]hooks.HookHandler) error {
+	var handlers []hooks.HookHandler
+	seen := make(map[string]bool)
+
+	for _, name := range order {
+		if seen[name] {
+			return fmt.Errorf("hook %q is listed twice in the hooks order", name)
+		}
+		seen[name] = true
+
+		if name == InternalHooks {
+			handlers = append(handlers, g.handlers...)
+			continue
+		}
+
+		hook, ok := external[name]
+		if !ok {
+			// Не настроенный внешний хук просто пропускаем, порядок можно задать заранее
+			continue
+		}
+		handlers = append(handlers, &stage{name: name, hooks: hooks.AvailableHooks, external: true, handler: hook})
+	}
+
+	if !seen[InternalHooks] {
+		return fmt.Errorf("hook %q is missing in the hooks order", InternalHooks)
+	}
+
+	for name := range external {
+		if !seen[name] {
+			return fmt.Errorf("hook %q is configured, but missing in the hooks order", name)
+		}
+	}
+
+	g.handlers = handlers
+
+	return nil
 }
 
 func (g *Handler) Setup() error {
+	for _, handler := range g.handlers {
+		if err := handler.Setup(); err != nil {
+			return err
+		}
+	}
+
+	g.async.start()
+	g.status.Start(context.Background())
+
 	return nil
 }
 
 func (g *Handler) InvokeHook(req hooks.HookRequest) (res hooks.HookResponse, err error) {
-	res.HTTPResponse.Header = make(map[string]string)
+	g.publishUpload(req)
+
+	merge := newResponseMerge(g.config.MetadataMerge, &req.Event.Upload)
 
+	// Эти ключи ставят только стадии, значения от клиента выкидываем до них
+	if req.Type == hooks.HookPreCreate {
+		if stripped := merge.strip(ServerMetaKeys); len(stripped) > 0 {
+			slog.Warn("Server-owned metadata from client dropped", "keys", stripped)
+		}
+	}
+
+	return g.run(req, merge, 0)
+}
+
+// run invokes the handlers from start on and merges their responses
+func (g *Handler) run(req hooks.HookRequest, merge *responseMerge, start int) (hooks.HookResponse, error) {
 	// Sub handlers
-	for _, handler := range g.handlers {
+	for i := start; i < len(g.handlers); i++ {
+		// Фоновые стадии уходят в пул со снимком запроса, ответ клиенту не ждет их
+		if group := g.asyncGroup(i); len(group) > 0 {
+			g.runAsync(group, req)
+			i += len(group) - 1
+			continue
+		}
+
+		handler := g.handlers[i]
+		name := stageName(handler)
+
 		subRes, subErr := handler.InvokeHook(req)
 		if subErr != nil {
 			return subRes, subErr
 		}
 
-		if subRes.RejectUpload {
-			return subRes, subErr
+		result := stageResult(name, subRes)
+
+		// Стадия без ответа хук не обрабатывала, в статусе ее не показываем
+		if s, ok := handler.(*stage); ok && (subRes.HTTPResponse.Body != "" || subRes.HTTPResponse.StatusCode != 0) {
+			g.reportStatus(req, s, result)
 		}
 
-		if subRes.StopUpload {
-			return subRes, subErr
+		if s, ok := handler.(*stage); ok && s.external {
+			subRes.ChangeFileInfo.MetaData = dropServerMetaKeys(name, subRes.ChangeFileInfo.MetaData)
 		}
 
-		for subHeaderKey, subHeaderValue := range subRes.HTTPResponse.Header {
-			res.HTTPResponse.Header[subHeaderKey] = subHeaderValue
+		if err := merge.add(name, subRes, &req.Event.Upload); err != nil {
+			slog.Error("Conflicting stage responses", "uploadId", req.Event.Upload.ID, "err", err.Error())
+			merge.fail(name, 500, err.Error())
+			return merge.result(), nil
 		}
 
-		res.HTTPResponse.Body = fmt.Sprintf("%s, %s", res.HTTPResponse.Body, subRes.HTTPResponse.Body)
+		if subRes.RejectUpload || subRes.StopUpload {
+			g.reportRest(req, g.handlers[i+1:], restStatus(result))
+			break
+		}
+	}
 
-		// Берем больштй HTTP код от сабхэнделра, который определит, что ошибка выше
-		if subRes.HTTPResponse.StatusCode > 399 {
-			res.HTTPResponse.StatusCode = subRes.HTTPResponse.StatusCode
+	return merge.result(), nil
+}
+
+// resumeAfter runs the stages following the named one, for a stage which
+// stopped the hook and finished its work later in the background
+func (g *Handler) resumeAfter(name string, req hooks.HookRequest) {
+	for i, handler := range g.handlers {
+		if stageName(handler) != name {
+			continue
+		}
+
+		merge := newResponseMerge(g.config.MetadataMerge, &req.Event.Upload)
+		if _, err := g.run(req, merge, i+1); err != nil {
+			slog.Error("Resumed stages failed", "after", name, "uploadId", req.Event.Upload.ID, "err", err.Error())
+		}
+		return
+	}
+}
+
+// mergePolicies накладывает фиксированные политики поверх политик из env
+func mergePolicies(policies, fixed map[string]string) map[string]string {
+	for key, policy := range fixed {
+		if current, ok := policies[key]; ok && current != policy {
+			log.Printf("METADATA_MERGE_POLICY %s:%s ignored, the key is always merged as %s", key, current, policy)
 		}
+		policies[key] = policy
+	}
+
+	return policies
+}
 
-		// Изменения меты: если совпал ключ, то перезаписываем (TODO:: может объединить?),
-		// если нет — просто добавляем
-		for subResMetaKey, subResMetaValue := range subRes.ChangeFileInfo.MetaData {
-			res.ChangeFileInfo.MetaData[subResMetaKey] = subResMetaValue
+// splitList разбирает список через запятую из env, пустые элементы пропускаются
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
 		}
 	}
 
-	return res, nil
+	return list
+}
+
+// jwtSecrets собирает HMAC секреты: JWT_SECRET целиком и список JWT_SECRETS на время ротации
+func jwtSecrets() []string {
+	secrets := splitList(os.Getenv("JWT_SECRETS"))
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		secrets = append([]string{secret}, secrets...)
+	}
+
+	return secrets
 }
@@ -0,0 +1,79 @@
+package hook_handlers
+
+import (
+	"testing"
+
+	appconfig "codiewuploader/internal/config"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"github.com/tus/tusd/v2/pkg/hooks"
+)
+
+// metaHook answers every hook with the same metadata change
+type metaHook struct {
+	changes handler.MetaData
+}
+
+func (h metaHook) Setup() error { return nil }
+
+func (h metaHook) InvokeHook(req hooks.HookRequest) (res hooks.HookResponse, err error) {
+	res.ChangeFileInfo.MetaData = h.changes
+	return res, nil
+}
+
+func TestExternalHooksCantSetServerMetaData(t *testing.T) {
+	for _, order := range [][]string{
+		{"http", InternalHooks},
+		{InternalHooks, "http"},
+	} {
+		t.Run(order[0]+" first", func(t *testing.T) {
+			g := &Handler{
+				config: appconfig.AppConfig{MetadataMerge: mergePolicies(map[string]string{OwnerMetaKey: appconfig.MergeLast}, map[string]string{
+					OwnerMetaKey:            appconfig.MergeFirst,
+					QuotaReservationMetaKey: appconfig.MergeFirst,
+				})},
+				handlers: []hooks.HookHandler{&stage{
+					name:    "auth",
+					hooks:   []hooks.HookType{hooks.HookPreCreate},
+					handler: metaHook{changes: handler.MetaData{OwnerMetaKey: "u1"}},
+				}},
+			}
+
+			external := map[string]hooks.HookHandler{"http": metaHook{changes: handler.MetaData{
+				OwnerMetaKey:            "u2",
+				QuotaReservationMetaKey: "r2",
+				DetectedTypeMetaKey:     "image/png",
+				"tags":                  "external",
+			}}}
+			if err := g.UseOrder(order, external); err != nil {
+				t.Fatal(err)
+			}
+
+			req := hooks.HookRequest{
+				Type: hooks.HookPreCreate,
+				Event: handler.HookEvent{Upload: handler.FileInfo{
+					MetaData: handler.MetaData{"id": "e1", OwnerMetaKey: "client"},
+				}},
+			}
+
+			res, err := g.InvokeHook(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			meta := res.ChangeFileInfo.MetaData
+			if meta[OwnerMetaKey] != "u1" {
+				t.Errorf("%s = %q, want the value of the internal stage", OwnerMetaKey, meta[OwnerMetaKey])
+			}
+			for _, key := range []string{QuotaReservationMetaKey, DetectedTypeMetaKey} {
+				if value, ok := meta[key]; ok {
+					t.Errorf("%s = %q set by the external hook", key, value)
+				}
+			}
+			// Остальные ключи внешний хук менять может
+			if meta["tags"] != "external" {
+				t.Errorf("tags = %q, want the external hook change", meta["tags"])
+			}
+		})
+	}
+}
@@ -1,23 +1,66 @@
 package hook_handlers
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
 	"log"
+	"path/filepath"
+	"strings"
 
 	appConfig "codiewuploader/internal/config"
+	"codiewuploader/internal/model"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/jdeng/goheif"
+	"github.com/tus/tusd/v2/pkg/handler"
 	"github.com/tus/tusd/v2/pkg/hooks"
+	"golang.org/x/exp/slog"
 )
 
+const heicStage = "heic-converter"
+
+// SourceKeyStorageKey is the storage key the converted object is passed under
+// to the following stages. Unlike the metadata the client can't set it.
+const SourceKeyStorageKey = "SourceKey"
+
+// OriginalNameStorageKey and OriginalTypeStorageKey keep the file name and
+// type of the upload before the conversion, so the move still stores the
+// HEIC as the original.
+const (
+	OriginalNameStorageKey = "OriginalName"
+	OriginalTypeStorageKey = "OriginalType"
+)
+
+// heifBrands are the ISOBMFF major brands used by HEIC/HEIF still images.
+var heifBrands = map[string]struct{}{
+	"heic": {},
+	"heix": {},
+	"heim": {},
+	"heis": {},
+	"hevc": {},
+	"hevx": {},
+	"hevm": {},
+	"hevs": {},
+	"mif1": {},
+	"msf1": {},
+}
+
 type HeicConverterHandler struct {
 	config   appConfig.AppConfig
 	s3Client *s3.Client
+	images   *imagePool
 }
 
-func NewHeicConverterHandler(cfg appConfig.AppConfig) *HeicConverterHandler {
+func NewHeicConverterHandler(cfg appConfig.AppConfig, images *imagePool) *HeicConverterHandler {
 	return &HeicConverterHandler{
 		config:   cfg,
 		s3Client: InitS3Client(cfg),
+		images:   images,
 	}
 }
 
@@ -26,10 +69,172 @@ func (g *HeicConverterHandler) Setup() error {
 	return nil
 }
 
+// InvokeHook converts finished HEIC/HEIF uploads into a JPEG stored next to the
+// original in the swamp bucket. The file name and type are returned as
+// metadata changes and the new object key as a storage change, so the
+// MoveHandler builds the renditions from the JPEG. The HEIC itself is kept as
+// the -original- object. A failed conversion doesn't stop the upload, the
+// original is moved instead.
 func (g *HeicConverterHandler) InvokeHook(req hooks.HookRequest) (res hooks.HookResponse, err error) {
-	if req.Type != hooks.HookPostFinish {
+	if req.Event.Upload.MetaData["mediatype"] != "image" {
+		return res, nil
+	}
+
+	filename := req.Event.Upload.MetaData["filename"]
+	fileType := req.Event.Upload.MetaData["filetype"]
+	uploadId, _ := splitIds(req.Event.Upload.ID)
+	ctx := context.Background()
+
+	header, err := g.readHeader(ctx, uploadId)
+	if err != nil {
+		slog.Error("HEIC header read failed", "uploadId", uploadId, "err", err.Error())
+		model.StageStatus{Status: model.StatusFailed, Error: err.Error()}.Respond(&res, heicStage)
+		return res, nil
+	}
+
+	if !isHeif(header) {
+		if isHeifType(fileType, filename) {
+			slog.Warn("Upload declared as HEIC, but content is not", "uploadId", uploadId, "filetype", fileType, "filename", filename)
+		}
+		return res, nil
+	}
+
+	convertedKey, err := g.convert(ctx, uploadId)
+	if err != nil {
+		slog.Error("HEIC conversion failed", "uploadId", uploadId, "err", err.Error())
+		model.StageStatus{Status: model.StatusFailed, Error: err.Error()}.Respond(&res, heicStage)
 		return res, nil
 	}
 
+	slog.Info("HEIC converted to JPEG", "uploadId", uploadId, "key", convertedKey)
+	model.StageStatus{Status: model.StatusDone, Output: convertedKey, Keys: []string{convertedKey}}.Respond(&res, heicStage)
+
+	res.ChangeFileInfo.MetaData = handler.MetaData{
+		"filename": jpegFilename(filename),
+		"filetype": "image/jpeg",
+	}
+	res.ChangeFileInfo.Storage = map[string]string{
+		SourceKeyStorageKey:    convertedKey,
+		OriginalNameStorageKey: filename,
+		OriginalTypeStorageKey: originalType(fileType),
+	}
+
 	return res, nil
 }
+
+// readHeader fetches the first bytes of the upload, enough to check the ftyp box.
+func (g *HeicConverterHandler) readHeader(ctx context.Context, key string) ([]byte, error) {
+	obj, err := g.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(SwampDir),
+		Key:    aws.String(key),
+		Range:  aws.String("bytes=0-11"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+
+	return io.ReadAll(obj.Body)
+}
+
+// convert decodes the HEIC upload, applies its EXIF orientation and stores the
+// result as {uploadId}.jpg in the swamp bucket.
+func (g *HeicConverterHandler) convert(ctx context.Context, uploadId string) (string, error) {
+	obj, err := g.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(SwampDir),
+		Key:    aws.String(uploadId),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer obj.Body.Close()
+
+	heicFile, err := ioutil.TempFile("", "tusd-heic-tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer cleanUpTempFile(heicFile)
+
+	if _, err := io.Copy(heicFile, obj.Body); err != nil {
+		return "", err
+	}
+
+	if err := checkImageLimits(heicFile, g.config.ImageLimits); err != nil {
+		return "", err
+	}
+
+	release, err := g.images.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	img, err := goheif.Decode(heicFile)
+	if err != nil {
+		return "", fmt.Errorf("decode heic: %w", err)
+	}
+
+	orientation := 1
+	if rawExif, err := goheif.ExtractExif(heicFile); err == nil {
+		orientation = exifOrientation(bytes.NewReader(rawExif))
+	}
+	img = applyOrientation(img, orientation)
+
+	// Go's encoder doesn't write EXIF, so the orientation can't be applied twice
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: g.config.JpegQuality}); err != nil {
+		return "", err
+	}
+
+	key := uploadId + ".jpg"
+	_, err = g.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(SwampDir),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String("image/jpeg"),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+// isHeif checks the ISOBMFF ftyp box for one of the HEIF brands.
+func isHeif(header []byte) bool {
+	if len(header) < 12 || string(header[4:8]) != "ftyp" {
+		return false
+	}
+
+	_, ok := heifBrands[string(header[8:12])]
+	return ok
+}
+
+// isHeifType reports whether the client-provided type or extension claims HEIC/HEIF.
+func isHeifType(fileType, filename string) bool {
+	switch strings.ToLower(fileType) {
+	case "image/heic", "image/heif", "image/heic-sequence", "image/heif-sequence":
+		return true
+	}
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".heic", ".heif":
+		return true
+	}
+
+	return false
+}
+
+// originalType keeps the declared type of the HEIC unless the client sent
+// something generic.
+func originalType(fileType string) string {
+	if isHeifType(fileType, "") {
+		return fileType
+	}
+
+	return "image/heic"
+}
+
+func jpegFilename(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + ".jpg"
+}
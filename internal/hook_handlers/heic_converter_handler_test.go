@@ -0,0 +1,167 @@
+package hook_handlers
+
+import (
+	"bytes"
+	"context"
+	"image/jpeg"
+	"os"
+	"testing"
+
+	appConfig "codiewuploader/internal/config"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"github.com/tus/tusd/v2/pkg/hooks"
+)
+
+func heicRequest(id, filename, fileType string) hooks.HookRequest {
+	return hooks.HookRequest{
+		Type: hooks.HookPostFinish,
+		Event: handler.HookEvent{Upload: handler.FileInfo{
+			ID: id,
+			MetaData: handler.MetaData{
+				"mediatype": "image",
+				"filename":  filename,
+				"filetype":  fileType,
+			},
+		}},
+	}
+}
+
+func newTestHeicConverter(t *testing.T, quality int) (*HeicConverterHandler, *fakeS3) {
+	t.Helper()
+
+	s3, cfg := newFakeS3(t)
+	cfg.JpegQuality = quality
+
+	heic, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3.put(SwampDir, "upl1", heic, "application/octet-stream")
+
+	return NewHeicConverterHandler(cfg, newImagePool(1)), s3
+}
+
+func TestHeicConvert(t *testing.T) {
+	g, s3 := newTestHeicConverter(t, 90)
+
+	res, err := g.InvokeHook(heicRequest("upl1+multipart", "IMG_0001.HEIC", "image/heic"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.RejectUpload || res.StopUpload {
+		t.Fatalf("response = %+v, want the upload to go on", res)
+	}
+	wantStorage := map[string]string{
+		SourceKeyStorageKey:    "upl1.jpg",
+		OriginalNameStorageKey: "IMG_0001.HEIC",
+		OriginalTypeStorageKey: "image/heic",
+	}
+	for key, want := range wantStorage {
+		if got := res.ChangeFileInfo.Storage[key]; got != want {
+			t.Errorf("storage %s = %q, want %q", key, got, want)
+		}
+	}
+	if meta := res.ChangeFileInfo.MetaData; meta["filename"] != "IMG_0001.jpg" || meta["filetype"] != "image/jpeg" {
+		t.Errorf("metadata = %v, want the JPEG name and type", meta)
+	}
+
+	obj, ok := s3.get(SwampDir, "upl1.jpg")
+	if !ok {
+		t.Fatal("converted JPEG wasn't stored")
+	}
+	img, err := jpeg.Decode(bytes.NewReader(obj.body))
+	if err != nil {
+		t.Fatalf("converted JPEG: %v", err)
+	}
+	if size := img.Bounds().Size(); size.X != 1596 || size.Y != 1064 {
+		t.Errorf("size = %v, want 1596x1064", size)
+	}
+
+	// Исходник в болоте остается, его переносит MoveHandler как оригинал
+	if _, ok := s3.get(SwampDir, "upl1"); !ok {
+		t.Error("the HEIC upload was removed")
+	}
+}
+
+func TestHeicConvertQuality(t *testing.T) {
+	sizes := map[int]int{}
+	for _, quality := range []int{20, 95} {
+		g, s3 := newTestHeicConverter(t, quality)
+		if _, err := g.InvokeHook(heicRequest("upl1+m", "a.heic", "image/heic")); err != nil {
+			t.Fatal(err)
+		}
+
+		obj, _ := s3.get(SwampDir, "upl1.jpg")
+		sizes[quality] = len(obj.body)
+	}
+
+	if sizes[20] == 0 || sizes[20] >= sizes[95] {
+		t.Errorf("sizes = %v, want JpegQuality to be used", sizes)
+	}
+}
+
+func TestHeicConvertSkipsOtherImages(t *testing.T) {
+	g, s3 := newTestHeicConverter(t, 90)
+	s3.put(SwampDir, "upl2", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), "image/png")
+
+	// Тип заявлен как HEIC, но по содержимому это PNG
+	res, err := g.InvokeHook(heicRequest("upl2+m", "a.heic", "image/heic"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ChangeFileInfo.Storage != nil || res.ChangeFileInfo.MetaData != nil {
+		t.Errorf("response = %+v, want no changes", res.ChangeFileInfo)
+	}
+	if _, ok := s3.get(SwampDir, "upl2.jpg"); ok {
+		t.Error("non-HEIC upload was converted")
+	}
+}
+
+func TestMoveKeepsHeicOriginal(t *testing.T) {
+	g, s3 := newTestHeicConverter(t, 90)
+	res, err := g.InvokeHook(heicRequest("upl1+m", "IMG_0001.HEIC", "image/heic"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	heic, _ := s3.get(SwampDir, "upl1")
+
+	cfg := g.config
+	cfg.Watermarks = appConfig.DefaultWatermarkConfig()
+	cfg.Watermarks.Default = "none"
+	move := NewMoveHandler(cfg, newImagePool(1), nil)
+
+	storage := res.ChangeFileInfo.Storage
+	record, err := move.move(context.Background(), moveRequest{
+		UploadId:         "upl1",
+		SourceKey:        storage[SourceKeyStorageKey],
+		EntityId:         "e1",
+		Filename:         res.ChangeFileInfo.MetaData["filename"],
+		ContentType:      "image/jpeg",
+		MediaType:        "image",
+		OriginalFilename: storage[OriginalNameStorageKey],
+		OriginalType:     storage[OriginalTypeStorageKey],
+	})
+	if err != nil {
+		t.Fatalf("move: %v", err)
+	}
+
+	if record.Original != "e1/e1-original-IMG_0001.HEIC" || record.Src != "e1/IMG_0001.jpg" {
+		t.Errorf("record = %+v, want the HEIC original and the JPEG source", record)
+	}
+
+	original, ok := s3.get(cfg.ResultBucket, record.Original)
+	if !ok || !bytes.Equal(original.body, heic.body) || original.contentType != "image/heic" {
+		t.Errorf("original = %d bytes of %q, want the HEIC upload", len(original.body), original.contentType)
+	}
+	if src, ok := s3.get(cfg.ResultBucket, record.Src); !ok || src.contentType != "image/jpeg" {
+		t.Errorf("src = %q, want a JPEG", src.contentType)
+	}
+
+	// Перенос удался, болото убрано вместе с промежуточным JPEG
+	if keys := s3.keys(SwampDir); len(keys) != 0 {
+		t.Errorf("swamp = %v, want it cleaned up", keys)
+	}
+}
@@ -0,0 +1,75 @@
+package hook_handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+
+	appConfig "codiewuploader/internal/config"
+)
+
+var ErrImageTooLarge = errors.New("image exceeds the size limits")
+
+// checkImageLimits reads only the image header, so a tiny file claiming
+// 50000x50000 pixels is refused before anything is allocated for the pixels.
+// The reader is rewound before and after the check.
+func checkImageLimits(r io.ReadSeeker, limits appConfig.ImageLimits) error {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	config, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUndecodableImage, err)
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if limits.MaxWidth > 0 && config.Width > limits.MaxWidth {
+		return fmt.Errorf("%w: width %d is over %d", ErrImageTooLarge, config.Width, limits.MaxWidth)
+	}
+
+	if limits.MaxHeight > 0 && config.Height > limits.MaxHeight {
+		return fmt.Errorf("%w: height %d is over %d", ErrImageTooLarge, config.Height, limits.MaxHeight)
+	}
+
+	maxMegapixels := limits.MaxMegapixels
+	if formatLimit, ok := limits.FormatMegapixels[format]; ok {
+		maxMegapixels = formatLimit
+	}
+
+	megapixels := float64(config.Width) * float64(config.Height) / 1e6
+	if maxMegapixels > 0 && megapixels > maxMegapixels {
+		return fmt.Errorf("%w: %s of %.1f megapixels is over %.1f", ErrImageTooLarge, format, megapixels, maxMegapixels)
+	}
+
+	return nil
+}
+
+// imagePool bounds how many images are decoded and processed at once, a
+// decoded image takes width*height*4 bytes and more during resizing.
+type imagePool struct {
+	slots chan struct{}
+}
+
+func newImagePool(workers int) *imagePool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &imagePool{slots: make(chan struct{}, workers)}
+}
+
+// acquire waits for a free slot, the returned func gives it back.
+func (p *imagePool) acquire(ctx context.Context) (func(), error) {
+	select {
+	case p.slots <- struct{}{}:
+		return func() { <-p.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,108 @@
+package hook_handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"testing"
+
+	appConfig "codiewuploader/internal/config"
+)
+
+// pngHeader builds the signature and IHDR chunk of a PNG, enough for
+// DecodeConfig, without any pixels behind it
+func pngHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], width)
+	binary.BigEndian.PutUint32(ihdr[4:], height)
+	ihdr[8] = 8 // глубина цвета
+	ihdr[9] = 6 // RGBA
+
+	chunk := append([]byte("IHDR"), ihdr...)
+
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&buf, binary.BigEndian, uint32(len(ihdr)))
+	buf.Write(chunk)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+
+	return buf.Bytes()
+}
+
+func jpegImage(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestCheckImageLimits(t *testing.T) {
+	// camel.heic — 1596x1064, около 1.7 мегапикселя
+	heic, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		file    []byte
+		limits  appConfig.ImageLimits
+		wantErr error
+	}{
+		{name: "no limits", file: pngHeader(50000, 50000)},
+		{name: "png bomb over megapixels", file: pngHeader(50000, 50000), limits: appConfig.ImageLimits{MaxMegapixels: 100}, wantErr: ErrImageTooLarge},
+		{name: "png within limits", file: pngHeader(4000, 3000), limits: appConfig.ImageLimits{MaxWidth: 4000, MaxHeight: 3000, MaxMegapixels: 12}},
+		{name: "png over width", file: pngHeader(4001, 10), limits: appConfig.ImageLimits{MaxWidth: 4000}, wantErr: ErrImageTooLarge},
+		{name: "png over height", file: pngHeader(10, 3001), limits: appConfig.ImageLimits{MaxHeight: 3000}, wantErr: ErrImageTooLarge},
+		{name: "jpeg over width", file: jpegImage(t, 64, 16), limits: appConfig.ImageLimits{MaxWidth: 32}, wantErr: ErrImageTooLarge},
+		{name: "jpeg within limits", file: jpegImage(t, 64, 16), limits: appConfig.ImageLimits{MaxWidth: 64, MaxHeight: 16, MaxMegapixels: 0.01}},
+		{
+			name:   "format limit overrides",
+			file:   pngHeader(4000, 3000),
+			limits: appConfig.ImageLimits{MaxMegapixels: 100, FormatMegapixels: map[string]float64{"png": 10}}, wantErr: ErrImageTooLarge,
+		},
+		{
+			name:   "format limit of another format",
+			file:   pngHeader(4000, 3000),
+			limits: appConfig.ImageLimits{MaxMegapixels: 100, FormatMegapixels: map[string]float64{"gif": 10}},
+		},
+		{name: "heic within limits", file: heic, limits: appConfig.ImageLimits{MaxWidth: 1596, MaxHeight: 1064, MaxMegapixels: 2}},
+		{name: "heic over width", file: heic, limits: appConfig.ImageLimits{MaxWidth: 1500}, wantErr: ErrImageTooLarge},
+		{name: "heic over height", file: heic, limits: appConfig.ImageLimits{MaxHeight: 1000}, wantErr: ErrImageTooLarge},
+		{name: "heic over megapixels", file: heic, limits: appConfig.ImageLimits{MaxMegapixels: 1.5}, wantErr: ErrImageTooLarge},
+		{
+			name:   "heic format limit",
+			file:   heic,
+			limits: appConfig.ImageLimits{MaxMegapixels: 10, FormatMegapixels: map[string]float64{"heic": 1}}, wantErr: ErrImageTooLarge,
+		},
+		{name: "not an image", file: []byte("hello world"), wantErr: ErrUndecodableImage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bytes.NewReader(tt.file)
+			// Проверка должна сама перемотать файл в начало
+			r.Seek(5, io.SeekStart)
+
+			err := checkImageLimits(r, tt.limits)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("checkImageLimits = %v, want %v", err, tt.wantErr)
+			}
+
+			if err == nil {
+				if offset, _ := r.Seek(0, io.SeekCurrent); offset != 0 {
+					t.Errorf("reader is at %d after the check, want it rewound", offset)
+				}
+			}
+		})
+	}
+}
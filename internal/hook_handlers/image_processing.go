@@ -0,0 +1,55 @@
+package hook_handlers
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// encodeImage кодирует в PNG для .png и в JPEG для всего остального
+func encodeImage(img image.Image, ext string, quality int) (*bytes.Reader, string, error) {
+	buf := new(bytes.Buffer)
+
+	if ext == ".png" {
+		if err := png.Encode(buf, img); err != nil {
+			return nil, "", err
+		}
+		return bytes.NewReader(buf.Bytes()), "image/png", nil
+	}
+
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, "", err
+	}
+	return bytes.NewReader(buf.Bytes()), "image/jpeg", nil
+}
+
+// resizeToWidth уменьшает картинку до ширины width с сохранением пропорций, не увеличивая маленькие
+func resizeToWidth(img image.Image, width int) image.Image {
+	if img.Bounds().Dx() <= width {
+		return img
+	}
+
+	return imaging.Resize(img, width, 0, imaging.Lanczos)
+}
+
+// alternateKey — ключ той же картинки в другом формате: {id}/{name}.webp
+func alternateKey(key string, format ImageFormat) string {
+	return strings.TrimSuffix(key, path.Ext(key)) + format.Ext
+}
+
+// renditionKey — ключ уменьшенной копии: {id}/{name}-{rendition}.{jpg|png}
+func renditionKey(entityId, filename, rendition, ext string) string {
+	base := strings.TrimSuffix(filename, filepath.Ext(filename))
+	if ext != ".png" {
+		ext = ".jpg"
+	}
+
+	return fmt.Sprintf("%s/%s-%s%s", entityId, base, rendition, ext)
+}
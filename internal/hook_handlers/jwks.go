@@ -0,0 +1,249 @@
+package hook_handlers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// jwksMinRefreshInterval limits refreshes caused by an unknown kid, so forged
+// tokens can't make us hammer the identity provider.
+const jwksMinRefreshInterval = 30 * time.Second
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// verificationKey is a public key from the JWKS ready for jwt-go
+type verificationKey struct {
+	kid string
+	alg string
+	key interface{}
+}
+
+// keySet keeps the public keys from a JWKS file or URL. Keys are reloaded when
+// the cache expires or a token comes with a kid we don't know yet.
+type keySet struct {
+	source string
+	ttl    time.Duration
+	client *http.Client
+
+	mu          sync.RWMutex
+	keys        []verificationKey
+	loadedAt    time.Time
+	refreshedAt time.Time
+}
+
+func newKeySet(source string, ttl time.Duration) *keySet {
+	return &keySet{
+		source: source,
+		ttl:    ttl,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (k *keySet) isRemote() bool {
+	return strings.HasPrefix(k.source, "http://") || strings.HasPrefix(k.source, "https://")
+}
+
+// lookup returns the keys matching the kid, an empty kid matches every key.
+// An unknown kid triggers a refresh.
+func (k *keySet) lookup(ctx context.Context, kid string) []verificationKey {
+	k.mu.RLock()
+	expired := k.ttl > 0 && time.Since(k.loadedAt) > k.ttl
+	keys := matchKeys(k.keys, kid)
+	k.mu.RUnlock()
+
+	if !expired && len(keys) > 0 {
+		return keys
+	}
+
+	if err := k.refresh(ctx, true); err != nil {
+		slog.Error("JwksRefreshError", "source", k.source, "err", err.Error())
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return matchKeys(k.keys, kid)
+}
+
+// refresh reloads the keys. A failed refresh keeps the previous keys, so an
+// outage of the identity provider doesn't reject valid tokens.
+func (k *keySet) refresh(ctx context.Context, throttle bool) error {
+	k.mu.Lock()
+	if throttle && time.Since(k.refreshedAt) < jwksMinRefreshInterval {
+		k.mu.Unlock()
+		return nil
+	}
+	k.refreshedAt = time.Now()
+	k.mu.Unlock()
+
+	data, err := k.read(ctx)
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseJwks(data)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.loadedAt = time.Now()
+	k.mu.Unlock()
+
+	slog.Info("JwksLoaded", "source", k.source, "keys", len(keys))
+
+	return nil
+}
+
+func (k *keySet) read(ctx context.Context) ([]byte, error) {
+	if !k.isRemote() {
+		return os.ReadFile(k.source)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks: unexpected status %d", resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+func matchKeys(keys []verificationKey, kid string) []verificationKey {
+	var matched []verificationKey
+	for _, key := range keys {
+		if kid == "" || key.kid == kid {
+			matched = append(matched, key)
+		}
+	}
+
+	return matched
+}
+
+// parseJwks decodes RSA and EC signing keys, other keys are skipped.
+func parseJwks(data []byte) ([]verificationKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+
+	var keys []verificationKey
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			slog.Warn("JwksKeySkipped", "kid", jwk.Kid, "kty", jwk.Kty, "err", err.Error())
+			continue
+		}
+
+		keys = append(keys, verificationKey{kid: jwk.Kid, alg: jwk.Alg, key: key})
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("jwks: no usable signing keys")
+	}
+
+	return keys, nil
+}
+
+func (jwk jsonWebKey) publicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() {
+			return nil, errors.New("rsa exponent is too large")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty key parameter")
+	}
+
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,224 @@
+package hook_handlers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	appconfig "codiewuploader/internal/config"
+
+	"github.com/form3tech-oss/jwt-go"
+)
+
+// testJwks serves the public part of its keys and counts the fetches
+type testJwks struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	keys    []jsonWebKey
+	fetches int
+}
+
+func newTestJwks(t *testing.T) *testJwks {
+	t.Helper()
+
+	j := &testJwks{}
+	j.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+
+		j.fetches++
+		json.NewEncoder(w).Encode(map[string]any{"keys": j.keys})
+	}))
+	t.Cleanup(j.server.Close)
+
+	return j
+}
+
+func (j *testJwks) add(jwk jsonWebKey) {
+	j.mu.Lock()
+	j.keys = append(j.keys, jwk)
+	j.mu.Unlock()
+}
+
+func (j *testJwks) fetchCount() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.fetches
+}
+
+func encodeBigInt(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.Bytes())
+}
+
+func rsaJwk(t *testing.T, kid string) (*rsa.PrivateKey, jsonWebKey) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, jsonWebKey{
+		Kty: "RSA", Kid: kid, Alg: "RS256", Use: "sig",
+		N: encodeBigInt(key.N), E: encodeBigInt(big.NewInt(int64(key.E))),
+	}
+}
+
+func ecJwk(t *testing.T, kid string) (*ecdsa.PrivateKey, jsonWebKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, jsonWebKey{
+		Kty: "EC", Kid: kid, Crv: "P-256",
+		X: encodeBigInt(key.X), Y: encodeBigInt(key.Y),
+	}
+}
+
+func signWithKid(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+func newJwksAuthHandler(t *testing.T, jwks *testJwks) *AuthHandler {
+	t.Helper()
+
+	g := NewAuthHandler(appconfig.AppConfig{JwtJwks: jwks.server.URL, JwtJwksCacheTTL: time.Hour})
+	if err := g.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	return g
+}
+
+func TestJwksTokens(t *testing.T) {
+	jwks := newTestJwks(t)
+	rsaKey, rsaPublic := rsaJwk(t, "rsa1")
+	ecKey, ecPublic := ecJwk(t, "ec1")
+	jwks.add(rsaPublic)
+	jwks.add(ecPublic)
+
+	g := newJwksAuthHandler(t, jwks)
+
+	valid := jwt.MapClaims{"sub": "u1", "exp": float64(time.Now().Add(time.Hour).Unix())}
+	expired := jwt.MapClaims{"sub": "u1", "exp": float64(time.Now().Add(-time.Hour).Unix())}
+
+	// HMAC с публичным ключом RSA в качестве секрета — классическая подмена алгоритма
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	otherKey, _ := rsaJwk(t, "rsa1")
+
+	tests := []struct {
+		name  string
+		token string
+		want  RejectReason
+	}{
+		{name: "rsa", token: signWithKid(t, jwt.SigningMethodRS256, "rsa1", rsaKey, valid)},
+		{name: "ecdsa", token: signWithKid(t, jwt.SigningMethodES256, "ec1", ecKey, valid)},
+		{name: "rsa without kid", token: signWithKid(t, jwt.SigningMethodRS256, "", rsaKey, valid)},
+		{name: "expired", token: signWithKid(t, jwt.SigningMethodRS256, "rsa1", rsaKey, expired), want: ReasonExpired},
+		{name: "hmac with the public key", token: signWithKid(t, jwt.SigningMethodHS256, "rsa1", publicPem, valid), want: ReasonUnexpectedAlgorithm},
+		{name: "alg other than the key's", token: signWithKid(t, jwt.SigningMethodRS384, "rsa1", rsaKey, valid), want: ReasonUnknownKey},
+		{name: "ecdsa token for rsa key", token: signWithKid(t, jwt.SigningMethodES256, "rsa1", ecKey, valid), want: ReasonUnknownKey},
+		{name: "foreign signature", token: signWithKid(t, jwt.SigningMethodRS256, "rsa1", otherKey, valid), want: ReasonInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, reason := g.Authenticate(context.Background(), tt.token)
+			if reason != tt.want {
+				t.Errorf("reason = %q, want %q", reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestJwksRefetchUnknownKid(t *testing.T) {
+	jwks := newTestJwks(t)
+	_, oldPublic := rsaJwk(t, "old")
+	jwks.add(oldPublic)
+
+	g := newJwksAuthHandler(t, jwks)
+	if got := jwks.fetchCount(); got != 1 {
+		t.Fatalf("fetches = %d after Setup, want 1", got)
+	}
+
+	// Провайдер выпустил новый ключ после нашего старта
+	newKey, newPublic := rsaJwk(t, "new")
+	jwks.add(newPublic)
+	token := signWithKid(t, jwt.SigningMethodRS256, "new", newKey, jwt.MapClaims{"sub": "u1"})
+
+	// Сразу после загрузки повторный запрос сдерживается
+	if _, reason := g.Authenticate(context.Background(), token); reason != ReasonUnknownKey {
+		t.Fatalf("reason = %q within the refresh interval, want %q", reason, ReasonUnknownKey)
+	}
+	if got := jwks.fetchCount(); got != 1 {
+		t.Fatalf("fetches = %d, want the refresh throttled", got)
+	}
+
+	g.keys.mu.Lock()
+	g.keys.refreshedAt = time.Now().Add(-jwksMinRefreshInterval)
+	g.keys.mu.Unlock()
+
+	if _, reason := g.Authenticate(context.Background(), token); reason != "" {
+		t.Fatalf("reason = %q, want the new key fetched", reason)
+	}
+	if got := jwks.fetchCount(); got != 2 {
+		t.Errorf("fetches = %d, want a single refetch", got)
+	}
+
+	// Известный kid больше не ходит к провайдеру
+	if _, reason := g.Authenticate(context.Background(), token); reason != "" || jwks.fetchCount() != 2 {
+		t.Errorf("reason = %q, fetches = %d, want the cached key", reason, jwks.fetchCount())
+	}
+}
+
+func TestJwksRefetchUsesRequestContext(t *testing.T) {
+	jwks := newTestJwks(t)
+	key, public := rsaJwk(t, "k1")
+	jwks.add(public)
+
+	// Ключи не загружены, токен требует похода к провайдеру
+	g := NewAuthHandler(appconfig.AppConfig{JwtJwks: jwks.server.URL})
+	token := signWithKid(t, jwt.SigningMethodRS256, "k1", key, jwt.MapClaims{"sub": "u1"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, reason := g.Authenticate(ctx, token); reason != ReasonUnknownKey {
+		t.Errorf("reason = %q, want %q with a cancelled request", reason, ReasonUnknownKey)
+	}
+	if got := jwks.fetchCount(); got != 0 {
+		t.Errorf("fetches = %d, want none after the request is gone", got)
+	}
+}
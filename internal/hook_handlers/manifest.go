@@ -0,0 +1,231 @@
+package hook_handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"codiewuploader/internal/model"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"golang.org/x/exp/slog"
+)
+
+// manifestLocks serialises read-modify-write of manifests per entity, as
+// several uploads of the same entity can finish at the same time.
+var manifestLocks sync.Map
+
+func lockEntity(entityId string) func() {
+	lock, _ := manifestLocks.LoadOrStore(entityId, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+
+	return lock.(*sync.Mutex).Unlock
+}
+
+func manifestKey(entityId string) string {
+	return fmt.Sprintf("%s/manifest.json", entityId)
+}
+
+// recordProgressKey is a private object collecting the files of a multi record
+// until all of them have finished.
+func recordProgressKey(entityId, recordId string) string {
+	return fmt.Sprintf("%s/.records/%s.json", entityId, recordId)
+}
+
+// manifestWriteAttempts limits the read-merge-write retries when another
+// instance changes the object in between.
+const manifestWriteAttempts = 5
+
+// errManifestChanged means the object's ETag no longer matches the read one.
+var errManifestChanged = errors.New("manifest changed concurrently")
+
+// updateManifest reads {entityId}/manifest.json from the result bucket, applies
+// the change and writes it back.
+func (g *MoveHandler) updateManifest(ctx context.Context, entityId string, change func(manifest *model.Manifest)) error {
+	defer lockEntity(entityId)()
+
+	_, err := g.updateObject(ctx, manifestKey(entityId), true, func(manifest *model.Manifest) {
+		manifest.EntityId = entityId
+		change(manifest)
+	})
+
+	return err
+}
+
+// updateRecord adds the file to the progress of its multi record, keyed by its
+// ordinal. Once all expected files are there, the batch is merged into the
+// entity manifest in a single write, so readers never see a half-uploaded
+// gallery, and the progress object is removed.
+func (g *MoveHandler) updateRecord(ctx context.Context, req moveRequest, record model.MediaRecord) error {
+	defer lockEntity(req.EntityId)()
+
+	progressKey := recordProgressKey(req.EntityId, req.RecordId)
+	progress, err := g.updateObject(ctx, progressKey, false, func(progress *model.Manifest) {
+		progress.EntityId = req.EntityId
+		progress.RecordId = req.RecordId
+		progress.Expected = req.Total
+		progress.UpsertOrdinal(record)
+		progress.Complete = len(progress.Media) >= progress.Expected
+	})
+	if err != nil {
+		return err
+	}
+
+	if !progress.Complete {
+		return nil
+	}
+
+	_, err = g.updateObject(ctx, manifestKey(req.EntityId), true, func(manifest *model.Manifest) {
+		manifest.EntityId = req.EntityId
+		manifest.RecordId = progress.RecordId
+		manifest.Expected = progress.Expected
+		manifest.Complete = true
+		for _, media := range progress.Media {
+			manifest.Upsert(media)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Пачка уже в манифесте, забытый прогресс только занимает место
+	if _, err := g.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(g.config.ResultBucket),
+		Key:    aws.String(progressKey),
+	}); err != nil {
+		slog.Warn("Record progress not deleted", "key", progressKey, "err", err.Error())
+	}
+
+	return nil
+}
+
+// updateObject applies the change to the manifest-like object and writes it
+// only if nobody else has written it since it was read. The entity lock only
+// covers this instance, the ETag check covers the other ones.
+//
+// The result bucket must honour If-Match and If-None-Match on PutObject (AWS
+// S3 since 2024, MinIO since RELEASE.2024-11-07). A store ignoring them
+// silently drops concurrent updates from other instances, so
+// checkConditionalWrites refuses such a bucket at startup.
+func (g *MoveHandler) updateObject(ctx context.Context, key string, public bool, change func(manifest *model.Manifest)) (*model.Manifest, error) {
+	for attempt := 1; ; attempt++ {
+		manifest, etag, err := g.readManifest(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		change(manifest)
+
+		err = g.writeManifest(ctx, key, manifest, public, etag)
+		if !errors.Is(err, errManifestChanged) || attempt >= manifestWriteAttempts {
+			return manifest, err
+		}
+	}
+}
+
+// conditionalWriteProbeKey is a private object used to check that the result
+// bucket supports conditional writes.
+const conditionalWriteProbeKey = ".tusd/conditional-write-check"
+
+// errConditionalWritesIgnored means the bucket accepted a write that had to fail.
+var errConditionalWritesIgnored = errors.New("result bucket ignores If-None-Match, concurrent manifest updates would be lost")
+
+// checkConditionalWrites writes the probe object and then writes it again
+// with If-None-Match: *, which must be refused.
+func (g *MoveHandler) checkConditionalWrites(ctx context.Context) error {
+	probe := &model.Manifest{EntityId: conditionalWriteProbeKey}
+
+	if err := g.writeManifest(ctx, conditionalWriteProbeKey, probe, false, ""); err != nil && !errors.Is(err, errManifestChanged) {
+		return err
+	}
+
+	err := g.writeManifest(ctx, conditionalWriteProbeKey, probe, false, "")
+	if _, delErr := g.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(g.config.ResultBucket),
+		Key:    aws.String(conditionalWriteProbeKey),
+	}); delErr != nil {
+		slog.Warn("Conditional write probe not deleted", "key", conditionalWriteProbeKey, "err", delErr.Error())
+	}
+
+	switch {
+	case err == nil:
+		return errConditionalWritesIgnored
+	case errors.Is(err, errManifestChanged):
+		return nil
+	default:
+		return err
+	}
+}
+
+// readManifest returns an empty manifest and an empty ETag when the object
+// doesn't exist yet.
+func (g *MoveHandler) readManifest(ctx context.Context, key string) (*model.Manifest, string, error) {
+	manifest := &model.Manifest{}
+
+	obj, err := g.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(g.config.ResultBucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return manifest, "", nil
+		}
+		return nil, "", err
+	}
+	defer obj.Body.Close()
+
+	if err := json.NewDecoder(obj.Body).Decode(manifest); err != nil {
+		return nil, "", fmt.Errorf("manifest %s is broken: %w", key, err)
+	}
+
+	return manifest, aws.ToString(obj.ETag), nil
+}
+
+// writeManifest writes the object if its ETag is still etag, an empty etag
+// means the object must not exist yet.
+func (g *MoveHandler) writeManifest(ctx context.Context, key string, manifest *model.Manifest, public bool, etag string) error {
+	manifest.UpdatedAt = time.Now().UTC()
+
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	params := &s3.PutObjectInput{
+		Bucket:       aws.String(g.config.ResultBucket),
+		Key:          aws.String(key),
+		Body:         bytes.NewReader(body),
+		ContentType:  aws.String("application/json"),
+		CacheControl: aws.String("no-cache"),
+	}
+	if public {
+		params.ACL = types.ObjectCannedACLPublicRead
+	}
+
+	// В этой версии SDK у PutObjectInput нет IfMatch, заголовки ставим сами
+	condition := smithyhttp.SetHeaderValue("If-None-Match", "*")
+	if etag != "" {
+		condition = smithyhttp.SetHeaderValue("If-Match", etag)
+	}
+
+	_, err = g.s3Client.PutObject(ctx, params, s3.WithAPIOptions(condition))
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return fmt.Errorf("%w: %s", errManifestChanged, key)
+		}
+	}
+
+	return err
+}
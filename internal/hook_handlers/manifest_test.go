@@ -0,0 +1,187 @@
+package hook_handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"codiewuploader/internal/model"
+)
+
+func newTestManifestHandler(t *testing.T) (*MoveHandler, *fakeS3) {
+	t.Helper()
+
+	s3, cfg := newFakeS3(t)
+	return NewMoveHandler(cfg, newImagePool(1), nil), s3
+}
+
+func readTestManifest(t *testing.T, s3 *fakeS3, key string) model.Manifest {
+	t.Helper()
+
+	obj, ok := s3.get("rent_result", key)
+	if !ok {
+		t.Fatalf("%s wasn't written", key)
+	}
+
+	var manifest model.Manifest
+	if err := json.Unmarshal(obj.body, &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	return manifest
+}
+
+func TestWriteManifestConditions(t *testing.T) {
+	tests := []struct {
+		name    string
+		exists  bool
+		etag    func(current fakeObject) string
+		wantErr error
+	}{
+		{name: "new object", etag: func(fakeObject) string { return "" }},
+		{name: "created concurrently", exists: true, etag: func(fakeObject) string { return "" }, wantErr: errManifestChanged},
+		{name: "current etag", exists: true, etag: func(current fakeObject) string { return current.etag }},
+		{name: "stale etag", exists: true, etag: func(fakeObject) string { return `"stale"` }, wantErr: errManifestChanged},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, s3 := newTestManifestHandler(t)
+			if tt.exists {
+				s3.put("rent_result", "e1/manifest.json", []byte(`{"entityId":"e1"}`), "application/json")
+			}
+			current, _ := s3.get("rent_result", "e1/manifest.json")
+
+			err := g.writeManifest(context.Background(), "e1/manifest.json", &model.Manifest{EntityId: "e1"}, true, tt.etag(current))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+
+			after, _ := s3.get("rent_result", "e1/manifest.json")
+			if changed := after.etag != current.etag; changed != (tt.wantErr == nil) {
+				t.Errorf("object changed = %v, want %v", changed, tt.wantErr == nil)
+			}
+		})
+	}
+}
+
+func TestUpdateManifestRetriesConcurrentWrite(t *testing.T) {
+	g, s3 := newTestManifestHandler(t)
+
+	// Другой инстанс успевает записать манифест между чтением и записью
+	concurrent := 0
+	s3.beforePut = func(key string) {
+		if concurrent++; concurrent == 1 {
+			body, _ := json.Marshal(model.Manifest{EntityId: "e1", Media: []model.MediaRecord{{Src: "e1/other.jpg"}}})
+			s3.put("rent_result", key, body, "application/json")
+		}
+	}
+
+	err := g.updateManifest(context.Background(), "e1", func(manifest *model.Manifest) {
+		manifest.Upsert(model.MediaRecord{Src: "e1/a.jpg"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := readTestManifest(t, s3, "e1/manifest.json")
+	if len(manifest.Media) != 2 {
+		t.Errorf("media = %+v, want both the concurrent and the own record", manifest.Media)
+	}
+	if concurrent != 2 {
+		t.Errorf("writes = %d, want a single retry", concurrent)
+	}
+}
+
+func TestUpdateManifestGivesUp(t *testing.T) {
+	g, s3 := newTestManifestHandler(t)
+
+	writes := 0
+	s3.beforePut = func(key string) {
+		writes++
+		body, _ := json.Marshal(model.Manifest{EntityId: "e1", Expected: writes})
+		s3.put("rent_result", key, body, "application/json")
+	}
+
+	err := g.updateManifest(context.Background(), "e1", func(manifest *model.Manifest) {
+		manifest.Upsert(model.MediaRecord{Src: "e1/a.jpg"})
+	})
+	if !errors.Is(err, errManifestChanged) {
+		t.Fatalf("err = %v, want errManifestChanged", err)
+	}
+	if writes != manifestWriteAttempts {
+		t.Errorf("writes = %d, want %d", writes, manifestWriteAttempts)
+	}
+}
+
+func TestUpdateRecordCompletes(t *testing.T) {
+	g, s3 := newTestManifestHandler(t)
+	ctx := context.Background()
+
+	body, _ := json.Marshal(model.Manifest{EntityId: "e1", Media: []model.MediaRecord{{Src: "e1/cover.jpg"}}})
+	s3.put("rent_result", "e1/manifest.json", body, "application/json")
+
+	req := moveRequest{EntityId: "e1", RecordType: "multi", RecordId: "r1", Total: 3}
+	progressKey := recordProgressKey("e1", "r1")
+
+	// Файлы заканчиваются не по порядку
+	for i, ordinal := range []int{2, 0, 1} {
+		record := model.MediaRecord{Src: "e1/" + string(rune('a'+ordinal)) + ".jpg", Ordinal: ordinal}
+		if err := g.updateRecord(ctx, req, record); err != nil {
+			t.Fatal(err)
+		}
+
+		if i == 2 {
+			break
+		}
+		if manifest := readTestManifest(t, s3, "e1/manifest.json"); len(manifest.Media) != 1 {
+			t.Fatalf("manifest = %+v, want the record hidden until complete", manifest.Media)
+		}
+		if progress := readTestManifest(t, s3, progressKey); progress.Complete || len(progress.Media) != i+1 {
+			t.Fatalf("progress = %+v, want %d incomplete files", progress, i+1)
+		}
+	}
+
+	manifest := readTestManifest(t, s3, "e1/manifest.json")
+	if !manifest.Complete || manifest.RecordId != "r1" || manifest.Expected != 3 {
+		t.Errorf("manifest = %+v, want the complete record", manifest)
+	}
+
+	var srcs []string
+	for _, media := range manifest.Media {
+		srcs = append(srcs, media.Src)
+	}
+	want := []string{"e1/cover.jpg", "e1/a.jpg", "e1/b.jpg", "e1/c.jpg"}
+	if len(srcs) != len(want) {
+		t.Fatalf("media = %v, want %v", srcs, want)
+	}
+	for i := range want {
+		if srcs[i] != want[i] {
+			t.Fatalf("media = %v, want %v", srcs, want)
+		}
+	}
+
+	if _, ok := s3.get("rent_result", progressKey); ok {
+		t.Error("record progress wasn't deleted")
+	}
+}
+
+func TestCheckConditionalWrites(t *testing.T) {
+	for _, ignore := range []bool{false, true} {
+		g, s3 := newTestManifestHandler(t)
+		s3.ignoreConditions = ignore
+
+		err := g.checkConditionalWrites(context.Background())
+		if ignore && !errors.Is(err, errConditionalWritesIgnored) {
+			t.Errorf("ignoring store: err = %v, want errConditionalWritesIgnored", err)
+		}
+		if !ignore && err != nil {
+			t.Errorf("conditional store: err = %v", err)
+		}
+
+		if keys := s3.keys("rent_result"); len(keys) != 0 {
+			t.Errorf("keys = %v, want the probe deleted", keys)
+		}
+	}
+}
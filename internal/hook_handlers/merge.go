@@ -0,0 +1,232 @@
+package hook_handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"strings"
+
+	appconfig "codiewuploader/internal/config"
+	"codiewuploader/internal/model"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"github.com/tus/tusd/v2/pkg/hooks"
+	"golang.org/x/exp/slog"
+)
+
+// responseMerge collects the responses of the stages into the single response
+// of the composite handler:
+//   - headers are applied in stage order, a later stage overwrites a header;
+//   - the status code and the error come from the first failing stage;
+//   - bodies are gathered into a model.HookReply;
+//   - metadata keys changed by several stages follow their merge policy;
+//   - ID and storage changes are passed to the following stages.
+type responseMerge struct {
+	policies map[string]string
+
+	res     hooks.HookResponse
+	replies []model.StageReply
+	errMsg  string
+
+	meta        handler.MetaData
+	metaChanged bool
+	changedBy   map[string]string
+
+	idChangedBy string
+}
+
+func newResponseMerge(policies map[string]string, upload *handler.FileInfo) *responseMerge {
+	m := &responseMerge{
+		policies:  policies,
+		changedBy: make(map[string]string),
+	}
+	m.res.HTTPResponse.Header = make(handler.HTTPHeader)
+
+	// Работаем с копиями: изменения от стадии видят все следующие за ней
+	m.meta = maps.Clone(upload.MetaData)
+	if m.meta == nil {
+		m.meta = make(handler.MetaData)
+	}
+	upload.MetaData = m.meta
+	upload.Storage = maps.Clone(upload.Storage)
+
+	return m
+}
+
+// add merges the response of the stage, the changes are applied to upload so
+// the next stages see them. An error means the stages conflict.
+func (m *responseMerge) add(stage string, sub hooks.HookResponse, upload *handler.FileInfo) error {
+	for key, value := range sub.HTTPResponse.Header {
+		m.res.HTTPResponse.Header[key] = value
+	}
+
+	if sub.HTTPResponse.Body != "" || sub.HTTPResponse.StatusCode != 0 {
+		m.reply(stage, sub.HTTPResponse.StatusCode, sub.HTTPResponse.Body)
+	}
+
+	m.res.RejectUpload = m.res.RejectUpload || sub.RejectUpload
+	m.res.StopUpload = m.res.StopUpload || sub.StopUpload
+
+	if err := m.mergeMetaData(stage, sub.ChangeFileInfo.MetaData); err != nil {
+		return err
+	}
+
+	if id := sub.ChangeFileInfo.ID; id != "" {
+		if m.idChangedBy != "" && m.res.ChangeFileInfo.ID != id {
+			return fmt.Errorf("stages %s and %s set different upload ids", m.idChangedBy, stage)
+		}
+		m.idChangedBy = stage
+		m.res.ChangeFileInfo.ID = id
+		upload.ID = id
+	}
+
+	if len(sub.ChangeFileInfo.Storage) > 0 {
+		if m.res.ChangeFileInfo.Storage == nil {
+			m.res.ChangeFileInfo.Storage = make(map[string]string)
+		}
+		if upload.Storage == nil {
+			upload.Storage = make(map[string]string)
+		}
+		for key, value := range sub.ChangeFileInfo.Storage {
+			m.res.ChangeFileInfo.Storage[key] = value
+			upload.Storage[key] = value
+		}
+	}
+
+	return nil
+}
+
+// fail records an error of the composite handler itself and rejects the upload
+func (m *responseMerge) fail(stage string, statusCode int, message string) {
+	m.reply(stage, statusCode, message)
+	m.res.RejectUpload = true
+	m.res.StopUpload = true
+}
+
+func (m *responseMerge) reply(stage string, statusCode int, body string) {
+	reply := model.StageReply{Stage: stage, StatusCode: statusCode}
+	if json.Valid([]byte(body)) {
+		reply.Body = json.RawMessage(body)
+	} else {
+		reply.Message = body
+	}
+	m.replies = append(m.replies, reply)
+
+	// Код и причину определяет первая упавшая стадия
+	if statusCode > 399 && m.res.HTTPResponse.StatusCode == 0 {
+		m.res.HTTPResponse.StatusCode = statusCode
+		m.errMsg = body
+		if reply.Message == "" {
+			m.errMsg = stageError(reply.Body)
+		}
+	}
+}
+
+func (m *responseMerge) mergeMetaData(stage string, changes handler.MetaData) error {
+	for key, value := range changes {
+		previous, changed := m.changedBy[key]
+		if !changed {
+			m.set(stage, key, value)
+			continue
+		}
+
+		switch m.policies[key] {
+		case appconfig.MergeFirst:
+			if m.meta[key] != value {
+				slog.Debug("Metadata change ignored", "key", key, "stage", stage, "keptFrom", previous)
+			}
+		case appconfig.MergeAppend:
+			if !containsValue(m.meta[key], value) {
+				m.set(stage, key, m.meta[key]+","+value)
+			}
+		case appconfig.MergeReject:
+			if m.meta[key] != value {
+				return fmt.Errorf("stages %s and %s set different values for metadata %q", previous, stage, key)
+			}
+		default:
+			m.set(stage, key, value)
+		}
+	}
+
+	return nil
+}
+
+// dropServerMetaKeys returns the changes of an external hook without
+// ServerMetaKeys, these keys are up to the internal stages only.
+func dropServerMetaKeys(stage string, changes handler.MetaData) handler.MetaData {
+	var dropped []string
+	for _, key := range ServerMetaKeys {
+		if _, ok := changes[key]; ok {
+			dropped = append(dropped, key)
+		}
+	}
+	if len(dropped) == 0 {
+		return changes
+	}
+
+	// Ответ хука не трогаем, он может быть общим
+	changes = maps.Clone(changes)
+	for _, key := range dropped {
+		delete(changes, key)
+	}
+	slog.Warn("Server-owned metadata from external hook ignored", "stage", stage, "keys", dropped)
+
+	return changes
+}
+
+// strip removes the keys from the metadata before any stage runs, the
+// removal is sent back to tusd like a stage change.
+func (m *responseMerge) strip(keys []string) (stripped []string) {
+	for _, key := range keys {
+		if _, ok := m.meta[key]; ok {
+			delete(m.meta, key)
+			m.metaChanged = true
+			stripped = append(stripped, key)
+		}
+	}
+
+	return stripped
+}
+
+func (m *responseMerge) set(stage, key, value string) {
+	m.meta[key] = value
+	m.changedBy[key] = stage
+	m.metaChanged = true
+}
+
+func (m *responseMerge) result() hooks.HookResponse {
+	res := m.res
+
+	// tusd заменяет мету целиком, поэтому отдаем ее полностью и только если она менялась
+	if m.metaChanged {
+		res.ChangeFileInfo.MetaData = m.meta
+	}
+
+	if len(m.replies) > 0 {
+		body, _ := json.Marshal(model.HookReply{Error: m.errMsg, Stages: m.replies})
+		res.HTTPResponse.Body = string(body)
+		res.HTTPResponse.Header["Content-Type"] = "application/json"
+	}
+
+	return res
+}
+
+// stageError takes the error from a JSON stage body like model.StageStatus
+func stageError(body json.RawMessage) string {
+	var status struct {
+		Error string `json:"error"`
+	}
+	json.Unmarshal(body, &status)
+
+	return status.Error
+}
+
+func containsValue(list, value string) bool {
+	for _, item := range strings.Split(list, ",") {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,209 @@
+package hook_handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	appconfig "codiewuploader/internal/config"
+	"codiewuploader/internal/model"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"github.com/tus/tusd/v2/pkg/hooks"
+)
+
+func metaChange(meta handler.MetaData) hooks.HookResponse {
+	var res hooks.HookResponse
+	res.ChangeFileInfo.MetaData = meta
+	return res
+}
+
+func TestMergeMetaDataPolicies(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		initial string
+		first   string
+		second  string
+		want    string
+		wantErr bool
+	}{
+		{name: "last", policy: appconfig.MergeLast, first: "a", second: "b", want: "b"},
+		{name: "default is last", policy: "", first: "a", second: "b", want: "b"},
+		{name: "first", policy: appconfig.MergeFirst, first: "a", second: "b", want: "a"},
+		{name: "append", policy: appconfig.MergeAppend, first: "a", second: "b", want: "a,b"},
+		{name: "append same value", policy: appconfig.MergeAppend, first: "a", second: "a", want: "a"},
+		{name: "reject different", policy: appconfig.MergeReject, first: "a", second: "b", wantErr: true},
+		{name: "reject same", policy: appconfig.MergeReject, first: "a", second: "a", want: "a"},
+		// Значение клиента — не изменение стадии, политика к нему не применяется
+		{name: "client value replaced", policy: appconfig.MergeFirst, initial: "client", first: "a", second: "b", want: "a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upload := &handler.FileInfo{MetaData: handler.MetaData{}}
+			if tt.initial != "" {
+				upload.MetaData["tags"] = tt.initial
+			}
+			m := newResponseMerge(map[string]string{"tags": tt.policy}, upload)
+
+			if err := m.add("one", metaChange(handler.MetaData{"tags": tt.first}), upload); err != nil {
+				t.Fatalf("first stage: %v", err)
+			}
+			err := m.add("two", metaChange(handler.MetaData{"tags": tt.second}), upload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if got := m.result().ChangeFileInfo.MetaData["tags"]; got != tt.want {
+				t.Errorf("tags = %q, want %q", got, tt.want)
+			}
+			// Следующие стадии видят уже объединенное значение
+			if got := upload.MetaData["tags"]; got != tt.want {
+				t.Errorf("upload tags = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeKeepsUntouchedMetaData(t *testing.T) {
+	upload := &handler.FileInfo{MetaData: handler.MetaData{"filename": "a.jpg"}}
+	original := upload.MetaData
+	m := newResponseMerge(nil, upload)
+
+	if res := m.result(); res.ChangeFileInfo.MetaData != nil {
+		t.Errorf("unchanged metadata sent back: %v", res.ChangeFileInfo.MetaData)
+	}
+
+	if err := m.add("one", metaChange(handler.MetaData{"width": "10"}), upload); err != nil {
+		t.Fatal(err)
+	}
+
+	meta := m.result().ChangeFileInfo.MetaData
+	if meta["filename"] != "a.jpg" || meta["width"] != "10" {
+		t.Errorf("metadata = %v, want the full metadata", meta)
+	}
+	if _, ok := original["width"]; ok {
+		t.Error("the metadata of the request was modified")
+	}
+}
+
+func TestMergeIdAndStorage(t *testing.T) {
+	tests := []struct {
+		name    string
+		ids     []string
+		wantId  string
+		wantErr bool
+	}{
+		{name: "single change", ids: []string{"new", ""}, wantId: "new"},
+		{name: "same id twice", ids: []string{"new", "new"}, wantId: "new"},
+		{name: "conflict", ids: []string{"new", "other"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upload := &handler.FileInfo{ID: "old"}
+			m := newResponseMerge(nil, upload)
+
+			var err error
+			for i, id := range tt.ids {
+				var res hooks.HookResponse
+				res.ChangeFileInfo.ID = id
+				if err = m.add([]string{"one", "two"}[i], res, upload); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if got := m.result().ChangeFileInfo.ID; got != tt.wantId {
+				t.Errorf("id = %q, want %q", got, tt.wantId)
+			}
+			if upload.ID != tt.wantId {
+				t.Errorf("upload id = %q, want %q", upload.ID, tt.wantId)
+			}
+		})
+	}
+
+	t.Run("storage", func(t *testing.T) {
+		storage := map[string]string{"Key": "upload"}
+		upload := &handler.FileInfo{Storage: storage}
+		m := newResponseMerge(nil, upload)
+
+		var first, second hooks.HookResponse
+		first.ChangeFileInfo.Storage = map[string]string{"Converted": "upload.jpg"}
+		second.ChangeFileInfo.Storage = map[string]string{"Converted": "upload.png", "Extra": "1"}
+
+		if err := m.add("one", first, upload); err != nil {
+			t.Fatal(err)
+		}
+		if upload.Storage["Converted"] != "upload.jpg" {
+			t.Errorf("next stage storage = %v, want the change", upload.Storage)
+		}
+		if err := m.add("two", second, upload); err != nil {
+			t.Fatal(err)
+		}
+
+		got := m.result().ChangeFileInfo.Storage
+		if got["Converted"] != "upload.png" || got["Extra"] != "1" {
+			t.Errorf("storage = %v, want the later stage to win", got)
+		}
+		if _, ok := storage["Converted"]; ok {
+			t.Error("the storage of the request was modified")
+		}
+	})
+}
+
+func TestMergeReplies(t *testing.T) {
+	upload := &handler.FileInfo{}
+	m := newResponseMerge(nil, upload)
+
+	ok := hooks.HookResponse{HTTPResponse: handler.HTTPResponse{
+		StatusCode: http.StatusOK,
+		Header:     handler.HTTPHeader{"X-Stage": "one"},
+	}}
+	failed := hooks.HookResponse{HTTPResponse: handler.HTTPResponse{
+		StatusCode: http.StatusUnprocessableEntity,
+		Body:       `{"status":"rejected","error":"too large"}`,
+		Header:     handler.HTTPHeader{"X-Stage": "two"},
+	}, RejectUpload: true}
+	later := hooks.HookResponse{HTTPResponse: handler.HTTPResponse{
+		StatusCode: http.StatusInternalServerError,
+		Body:       "boom",
+	}}
+
+	for i, res := range []hooks.HookResponse{ok, failed, later} {
+		if err := m.add([]string{"one", "two", "three"}[i], res, upload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res := m.result()
+	if res.HTTPResponse.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("status = %d, want the first failing stage", res.HTTPResponse.StatusCode)
+	}
+	if !res.RejectUpload || res.StopUpload {
+		t.Errorf("reject = %v, stop = %v, want only reject", res.RejectUpload, res.StopUpload)
+	}
+	if res.HTTPResponse.Header["X-Stage"] != "two" {
+		t.Errorf("header = %q, want the later stage", res.HTTPResponse.Header["X-Stage"])
+	}
+
+	var reply model.HookReply
+	if err := json.Unmarshal([]byte(res.HTTPResponse.Body), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Error != "too large" || len(reply.Stages) != 3 {
+		t.Errorf("reply = %+v, want the first error and all stages", reply)
+	}
+	if reply.Stages[2].Message != "boom" {
+		t.Errorf("plain body = %+v, want a message", reply.Stages[2])
+	}
+}
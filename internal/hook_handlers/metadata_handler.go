@@ -0,0 +1,190 @@
+package hook_handlers
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+
+	appconfig "codiewuploader/internal/config"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"github.com/tus/tusd/v2/pkg/hooks"
+	"golang.org/x/exp/slices"
+)
+
+// MetadataHandler rejects uploads with metadata MoveHandler can't handle in
+// pre-create, before any bytes are sent.
+type MetadataHandler struct {
+	schema appconfig.MetadataSchema
+
+	idPattern       *regexp.Regexp
+	filenamePattern *regexp.Regexp
+}
+
+func NewMetadataHandler(config appconfig.AppConfig) *MetadataHandler {
+	return &MetadataHandler{
+		schema: config.MetadataSchema,
+	}
+}
+
+func (g *MetadataHandler) Setup() error {
+	log.Println("MetadataHandler.Setup setup")
+
+	var err error
+	if g.schema.IdPattern != "" {
+		if g.idPattern, err = regexp.Compile(g.schema.IdPattern); err != nil {
+			return fmt.Errorf("invalid id pattern in metadata schema: %w", err)
+		}
+	}
+
+	if g.schema.Filename.Pattern != "" {
+		if g.filenamePattern, err = regexp.Compile(g.schema.Filename.Pattern); err != nil {
+			return fmt.Errorf("invalid filename pattern in metadata schema: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (g *MetadataHandler) InvokeHook(req hooks.HookRequest) (res hooks.HookResponse, err error) {
+	meta := req.Event.Upload.MetaData
+
+	if err := g.Validate(meta); err != nil {
+		res.HTTPResponse.StatusCode = 400
+		res.HTTPResponse.Body = fmt.Sprintf("Invalid upload metadata: %s", err)
+		res.RejectUpload = true
+		return res, nil
+	}
+
+	// Без recordType MoveHandler не перенесет файл, старым клиентам ставим значение по умолчанию
+	if meta["recordType"] == "" && g.schema.DefaultRecordType != "" {
+		res.ChangeFileInfo.MetaData = handler.MetaData{"recordType": g.schema.DefaultRecordType}
+	}
+
+	return res, nil
+}
+
+// Validate returns the first violation of the schema.
+func (g *MetadataHandler) Validate(meta handler.MetaData) error {
+	for _, key := range g.schema.Required {
+		if meta[key] == "" {
+			return fmt.Errorf("missing required key %q", key)
+		}
+	}
+
+	if id, ok := meta["id"]; ok && g.idPattern != nil && !g.idPattern.MatchString(id) {
+		return fmt.Errorf("id %q doesn't match %s", id, g.schema.IdPattern)
+	}
+
+	recordType := meta["recordType"]
+	if recordType != "" && len(g.schema.RecordTypes) > 0 && !slices.Contains(g.schema.RecordTypes, recordType) {
+		return fmt.Errorf("recordType %q is not one of %s", recordType, strings.Join(g.schema.RecordTypes, ", "))
+	}
+
+	if recordType == "multi" {
+		if err := parseMultiRecord(meta, &moveRequest{}); err != nil {
+			return err
+		}
+	}
+
+	if filename, ok := meta["filename"]; ok {
+		if err := g.validateFilename(filename); err != nil {
+			return err
+		}
+	}
+
+	if mediaType, ok := meta["mediatype"]; ok {
+		if err := g.validateMediaType(mediaType, meta["filetype"], meta["filename"]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (g *MetadataHandler) validateFilename(filename string) error {
+	rule := g.schema.Filename
+
+	if filename == "" || filename == "." || filename == ".." {
+		return fmt.Errorf("filename %q is not allowed", filename)
+	}
+
+	if rule.MaxLength > 0 && len(filename) > rule.MaxLength {
+		return fmt.Errorf("filename is longer than %d bytes", rule.MaxLength)
+	}
+
+	// Имя становится частью ключа в S3, поэтому никаких путей
+	if strings.ContainsAny(filename, "/\\") {
+		return fmt.Errorf("filename %q contains a path separator", filename)
+	}
+
+	if strings.ContainsFunc(filename, unicode.IsControl) {
+		return fmt.Errorf("filename %q contains control characters", filename)
+	}
+
+	if g.filenamePattern != nil && !g.filenamePattern.MatchString(filename) {
+		return fmt.Errorf("filename %q doesn't match %s", filename, rule.Pattern)
+	}
+
+	return nil
+}
+
+func (g *MetadataHandler) validateMediaType(mediaType, fileType, filename string) error {
+	if len(g.schema.MediaTypes) == 0 {
+		return nil
+	}
+
+	rule, ok := g.schema.MediaTypes[mediaType]
+	if !ok {
+		allowed := make([]string, 0, len(g.schema.MediaTypes))
+		for name := range g.schema.MediaTypes {
+			allowed = append(allowed, name)
+		}
+		slices.Sort(allowed)
+
+		return fmt.Errorf("mediatype %q is not one of %s", mediaType, strings.Join(allowed, ", "))
+	}
+
+	if len(rule.FileTypes) > 0 {
+		if fileType == "" {
+			return fmt.Errorf("filetype is required for mediatype %s", mediaType)
+		}
+		if !matchFileType(rule.FileTypes, fileType) {
+			return fmt.Errorf("filetype %q is not allowed for mediatype %s", fileType, mediaType)
+		}
+	}
+
+	if len(rule.Extensions) > 0 && filename != "" {
+		ext := strings.ToLower(filepath.Ext(filename))
+		if !slices.ContainsFunc(rule.Extensions, func(allowed string) bool { return strings.EqualFold(allowed, ext) }) {
+			return fmt.Errorf("extension %q is not allowed for mediatype %s", ext, mediaType)
+		}
+	}
+
+	return nil
+}
+
+// matchFileType compares the MIME type without parameters, "type/*" matches the
+// whole family.
+func matchFileType(allowed []string, fileType string) bool {
+	fileType, _, _ = strings.Cut(fileType, ";")
+	fileType = strings.ToLower(strings.TrimSpace(fileType))
+
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		if family, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(fileType, family+"/") {
+				return true
+			}
+			continue
+		}
+		if pattern == fileType {
+			return true
+		}
+	}
+
+	return false
+}
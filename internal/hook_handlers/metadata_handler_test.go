@@ -0,0 +1,152 @@
+package hook_handlers
+
+import (
+	"strings"
+	"testing"
+
+	appconfig "codiewuploader/internal/config"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"github.com/tus/tusd/v2/pkg/hooks"
+)
+
+func newTestMetadataHandler(t *testing.T, schema appconfig.MetadataSchema) *MetadataHandler {
+	t.Helper()
+
+	g := NewMetadataHandler(appconfig.AppConfig{MetadataSchema: schema})
+	if err := g.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	return g
+}
+
+func validMeta(changes map[string]string) handler.MetaData {
+	meta := handler.MetaData{
+		"id":         "listing_42",
+		"filename":   "photo.jpg",
+		"mediatype":  "image",
+		"filetype":   "image/jpeg",
+		"recordType": "single",
+	}
+	for key, value := range changes {
+		if value == "" {
+			delete(meta, key)
+			continue
+		}
+		meta[key] = value
+	}
+
+	return meta
+}
+
+func TestMetadataValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes map[string]string
+		wantErr bool
+	}{
+		{name: "valid"},
+		{name: "no recordType", changes: map[string]string{"recordType": ""}},
+		{name: "missing id", changes: map[string]string{"id": ""}, wantErr: true},
+		{name: "missing filename", changes: map[string]string{"filename": ""}, wantErr: true},
+		{name: "missing mediatype", changes: map[string]string{"mediatype": ""}, wantErr: true},
+		{name: "id pattern", changes: map[string]string{"id": "../other"}, wantErr: true},
+		{name: "unknown recordType", changes: map[string]string{"recordType": "album"}, wantErr: true},
+		{name: "multi", changes: map[string]string{"recordType": "multi", "recordId": "r1", "ordinal": "0", "total": "2"}},
+		{name: "multi without recordId", changes: map[string]string{"recordType": "multi", "ordinal": "0", "total": "2"}, wantErr: true},
+		{name: "multi ordinal out of range", changes: map[string]string{"recordType": "multi", "recordId": "r1", "ordinal": "2", "total": "2"}, wantErr: true},
+		{name: "filename with path", changes: map[string]string{"filename": "../photo.jpg"}, wantErr: true},
+		{name: "filename with control character", changes: map[string]string{"filename": "photo\n.jpg"}, wantErr: true},
+		{name: "filename too long", changes: map[string]string{"filename": strings.Repeat("a", 252) + ".jpg"}, wantErr: true},
+		{name: "unknown mediatype", changes: map[string]string{"mediatype": "audio"}, wantErr: true},
+		{name: "filetype missing", changes: map[string]string{"filetype": ""}, wantErr: true},
+		{name: "filetype not allowed", changes: map[string]string{"filetype": "image/gif"}, wantErr: true},
+		{name: "filetype with parameters", changes: map[string]string{"filetype": "Image/JPEG; charset=binary"}},
+		{name: "extension not allowed", changes: map[string]string{"filename": "photo.gif"}, wantErr: true},
+		{name: "extension case", changes: map[string]string{"filename": "PHOTO.JPG"}},
+		{name: "video family", changes: map[string]string{"mediatype": "video", "filetype": "video/quicktime", "filename": "clip.mov"}},
+	}
+
+	g := newTestMetadataHandler(t, appconfig.DefaultMetadataSchema())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := g.Validate(validMeta(tt.changes))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMetadataDefaultRecordType(t *testing.T) {
+	tests := []struct {
+		name       string
+		recordType string
+		schema     func(schema *appconfig.MetadataSchema)
+		want       string
+	}{
+		{name: "missing", want: "single"},
+		{name: "sent", recordType: "multi", want: ""},
+		{name: "no default", schema: func(schema *appconfig.MetadataSchema) { schema.DefaultRecordType = "" }, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema := appconfig.DefaultMetadataSchema()
+			if tt.schema != nil {
+				tt.schema(&schema)
+			}
+			g := newTestMetadataHandler(t, schema)
+
+			meta := validMeta(map[string]string{"recordType": ""})
+			if tt.recordType != "" {
+				meta = validMeta(map[string]string{"recordType": tt.recordType, "recordId": "r1", "ordinal": "0", "total": "1"})
+			}
+
+			res, err := g.InvokeHook(hooks.HookRequest{Type: hooks.HookPreCreate, Event: handler.HookEvent{Upload: handler.FileInfo{MetaData: meta}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.RejectUpload {
+				t.Fatalf("rejected: %s", res.HTTPResponse.Body)
+			}
+			if got := res.ChangeFileInfo.MetaData["recordType"]; got != tt.want {
+				t.Errorf("recordType change = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetadataRejects(t *testing.T) {
+	g := newTestMetadataHandler(t, appconfig.DefaultMetadataSchema())
+
+	res, err := g.InvokeHook(hooks.HookRequest{Type: hooks.HookPreCreate, Event: handler.HookEvent{Upload: handler.FileInfo{
+		MetaData: validMeta(map[string]string{"recordType": "", "filename": "a/b.jpg"}),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !res.RejectUpload || res.HTTPResponse.StatusCode != 400 {
+		t.Errorf("response = %+v, want a 400 rejection", res.HTTPResponse)
+	}
+	if res.ChangeFileInfo.MetaData != nil {
+		t.Errorf("metadata = %v, want no changes for a rejected upload", res.ChangeFileInfo.MetaData)
+	}
+}
+
+func TestMetadataSchemaPatterns(t *testing.T) {
+	schema := appconfig.DefaultMetadataSchema()
+	schema.Filename.Pattern = `^[a-z]+\.jpg$`
+
+	g := newTestMetadataHandler(t, schema)
+	if err := g.Validate(validMeta(map[string]string{"filename": "Photo.jpg"})); err == nil {
+		t.Error("filename outside the pattern accepted")
+	}
+
+	schema.IdPattern = "("
+	if err := NewMetadataHandler(appconfig.AppConfig{MetadataSchema: schema}).Setup(); err == nil {
+		t.Error("invalid id pattern accepted")
+	}
+}
@@ -0,0 +1,49 @@
+package hook_handlers
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var MetricsSwampReclaimedBytes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "tusd_swamp_reclaimed_bytes_total",
+		Help: "Total number of bytes deleted from the swamp bucket after a successful move. The dry-run mode counts bytes which would have been deleted.",
+	},
+	[]string{"mode"},
+)
+
+var MetricsAuthRejectionsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "tusd_auth_rejections_total",
+		Help: "Total number of uploads rejected by the upload token check per reason.",
+	},
+	[]string{"reason"},
+)
+
+var MetricsQuarantinedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "tusd_uploads_quarantined_total",
+		Help: "Total number of uploads moved into quarantine per processing stage.",
+	},
+	[]string{"stage"},
+)
+
+var MetricsAntivirusSizeLimitTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "tusd_antivirus_size_limit_total",
+		Help: "Total number of uploads above the clamd stream limit per action (reject, skip).",
+	},
+	[]string{"action"},
+)
+
+var MetricsAsyncQueueLength = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "tusd_async_queue_length",
+		Help: "Number of async stage jobs waiting for a worker.",
+	},
+)
+
+var MetricsAsyncQueueOverflowTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "tusd_async_queue_overflow_total",
+		Help: "Total number of async stage jobs dropped because the queue stayed full.",
+	},
+)
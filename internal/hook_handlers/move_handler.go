@@ -2,43 +2,136 @@ package hook_handlers
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/disintegration/imaging"
 	"image"
-	"image/jpeg"
 	"image/png"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	appConfig "codiewuploader/internal/config"
+	"codiewuploader/internal/jobqueue"
+	"codiewuploader/internal/model"
+	"codiewuploader/internal/status"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/tus/tusd/v2/pkg/handler"
 	"github.com/tus/tusd/v2/pkg/hooks"
 	"golang.org/x/exp/slog"
-	"golang.org/x/image/draw"
 )
 
 const SwampDir = "rent_swamp"
 
+var (
+	ErrSourceNotFound   = errors.New("source object not found in swamp")
+	ErrUndecodableImage = errors.New("image can't be decoded")
+)
+
+// MoveError описывает, на каком шаге переноса и с каким объектом случилась ошибка
+type MoveError struct {
+	Step string
+	Key  string
+	Err  error
+}
+
+func (e *MoveError) Error() string {
+	return fmt.Sprintf("move %s %s: %v", e.Step, e.Key, e.Err)
+}
+
+func (e *MoveError) Unwrap() error {
+	return e.Err
+}
+
+// newMoveError превращает 404 от S3 в ErrSourceNotFound
+func newMoveError(step, key string, err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound":
+			err = fmt.Errorf("%w: %v", ErrSourceNotFound, err)
+		}
+	}
+
+	return &MoveError{Step: step, Key: key, Err: err}
+}
+
 type MoveHandler struct {
-	config   appConfig.AppConfig
-	s3Client *s3.Client
+	config     appConfig.AppConfig
+	s3Client   *s3.Client
+	watermarks *Watermarks
+
+	// imageFormats — дополнительные форматы (webp, avif), для которых в ffmpeg есть энкодер
+	imageFormats []ImageFormat
+
+	// queue — перенос выполняется в фоне с ретраями, а не внутри хука
+	queue *jobqueue.Queue
+
+	// images — общий с конвертером HEIC лимит одновременно декодируемых картинок
+	images *imagePool
+
+	// status — перенос заканчивается в фоне, поэтому его статус пишем сами
+	status *status.Store
 }
 
-func NewMoveHandler(cfg appConfig.AppConfig) *MoveHandler {
+const (
+	moveJobKind = "move"
+	moveStage   = "move"
+
+	// copyObjectMaxSize — предел CopyObject, объекты больше копируем по частям
+	copyObjectMaxSize = 5 << 30
+	// copyPartSize — размер части UploadPartCopy, 10000 частей покрывают 5 TiB
+	copyPartSize = 512 << 20
+)
+
+func NewMoveHandler(cfg appConfig.AppConfig, images *imagePool, statuses *status.Store) *MoveHandler {
 	return &MoveHandler{
-		config:   cfg,
-		s3Client: InitS3Client(cfg),
+		config:     cfg,
+		s3Client:   InitS3Client(cfg),
+		watermarks: NewWatermarks(cfg.Watermarks),
+		images:     images,
+		status:     statuses,
 	}
 }
 
+// reportsStatus: статус переноса обновляет задача из очереди, а не ответ хука
+func (g *MoveHandler) reportsStatus() {}
+
+// moveRequest — все, что нужно для переноса одной загрузки в бакет с результатами
+type moveRequest struct {
+	UploadId    string
+	UserId      string
+	SourceKey   string
+	EntityId    string
+	Filename    string
+	ContentType string
+	MediaType   string
+	Watermark   string
+
+	// Имя и тип загрузки до конвертации, если SourceKey — ее результат
+	OriginalFilename string
+	OriginalType     string
+
+	// Только для recordType == "multi"
+	RecordType string
+	RecordId   string
+	Ordinal    int
+	Total      int
+}
+
 func InitS3Client(cfg appConfig.AppConfig) *s3.Client {
 	s3Config, err := config.LoadDefaultConfig(context.TODO())
 	if err != nil {
@@ -54,36 +147,102 @@ func InitS3Client(cfg appConfig.AppConfig) *s3.Client {
 
 func (g *MoveHandler) Setup() error {
 	log.Println("MoveHandler.Setup setup")
+
+	if err := g.watermarks.Validate(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Без условной записи манифесты между инстансами молча теряют изменения
+	if err := g.checkConditionalWrites(ctx); errors.Is(err, errConditionalWritesIgnored) {
+		return err
+	} else if err != nil {
+		slog.Warn("Unable to check conditional writes of the result bucket", "bucket", g.config.ResultBucket, "err", err.Error())
+	}
+
+	formats, err := detectImageFormats(context.Background(), g.config.FfmpegPath, g.config.ImageFormats)
+	if err != nil {
+		slog.Warn("Unable to list ffmpeg encoders, only JPEG/PNG will be produced", "err", err.Error())
+	}
+
+	for _, format := range formats {
+		slog.Info("Image format enabled", "format", format.Name, "encoder", format.Encoder)
+	}
+	g.imageFormats = formats
+
+	g.queue, err = jobqueue.New(jobqueue.Config{
+		Dir:         g.config.JobsDir,
+		Workers:     g.config.JobWorkers,
+		MaxAttempts: g.config.JobMaxAttempts,
+		BaseBackoff: g.config.JobBackoff,
+		MaxBackoff:  g.config.JobMaxBackoff,
+	}, g.runJob)
+	if err != nil {
+		return fmt.Errorf("unable to create move queue: %w", err)
+	}
+	g.queue.Start(context.Background())
+
 	return nil
 }
 
-func (g *MoveHandler) InvokeHook(req hooks.HookRequest) (res hooks.HookResponse, err error) {
-	if req.Type != hooks.HookPostFinish {
-		return res, nil
+// runJob выполняет перенос из очереди
+func (g *MoveHandler) runJob(ctx context.Context, job jobqueue.Job) error {
+	var req moveRequest
+	if err := json.Unmarshal(job.Payload, &req); err != nil {
+		return jobqueue.Permanent(err)
+	}
+
+	owner := status.Owner{UserId: req.UserId, EntityId: req.EntityId}
+	setStageStatus(g.status, req.UploadId, owner, model.StageStatus{Stage: moveStage, Status: model.StatusRunning})
+
+	record, err := g.move(ctx, req)
+	if err == nil {
+		setStageStatus(g.status, req.UploadId, owner, model.StageStatus{Stage: moveStage, Status: model.StatusDone, Output: record.Src, Keys: record.Keys()})
+		return nil
+	}
+
+	if errors.Is(err, ErrSourceNotFound) || errors.Is(err, ErrUndecodableImage) || errors.Is(err, ErrImageTooLarge) {
+		// Повторы тут не помогут — сразу в dead-letter
+		err = jobqueue.Permanent(err)
+	}
+
+	// До последней попытки задача еще ждет повтора
+	result := model.StatusPending
+	if jobqueue.IsPermanent(err) || job.Attempts+1 >= g.config.JobMaxAttempts {
+		result = model.StatusFailed
 	}
+	setStageStatus(g.status, req.UploadId, owner, model.StageStatus{Stage: moveStage, Status: result, Error: err.Error()})
 
+	return err
+}
+
+func (g *MoveHandler) InvokeHook(req hooks.HookRequest) (res hooks.HookResponse, err error) {
 	recordType, ok := req.Event.Upload.MetaData["recordType"]
-	if !ok || recordType != "single" {
-		slog.Info("Record not single", "id", req.Event.Upload.ID, "recordType", recordType, "metadata", req.Event.Upload.MetaData)
+	if !ok || (recordType != "single" && recordType != "multi") {
+		slog.Info("Record neither single nor multi", "id", req.Event.Upload.ID, "recordType", recordType, "metadata", req.Event.Upload.MetaData)
 
 		return res, nil
 	}
 
-	entityId, ok := req.Event.Upload.MetaData["id"]
-	if !ok {
-		slog.Info("Record hasn't entityId in meta", "entityId", entityId)
+	// Мета уже проверена в pre-create MetadataHandler'ом, сюда доходят только загрузки,
+	// созданные до включения схемы
+	entityId := req.Event.Upload.MetaData["id"]
+	if entityId == "" {
+		slog.Info("Record hasn't id in meta", "uploadId", req.Event.Upload.ID)
 		return res, nil
 	}
 
-	filename, ok := req.Event.Upload.MetaData["filename"]
-	if !ok {
-		slog.Info("Record hasn't entityId in meta", "filename", filename)
+	filename := req.Event.Upload.MetaData["filename"]
+	if filename == "" {
+		slog.Info("Record hasn't filename in meta", "uploadId", req.Event.Upload.ID, "entityId", entityId)
 		return res, nil
 	}
 
-	mediaType, ok := req.Event.Upload.MetaData["mediatype"]
-	if !ok {
-		slog.Info("Record hasn't entityId in meta", "mediatype", filename)
+	mediaType := req.Event.Upload.MetaData["mediatype"]
+	if mediaType == "" {
+		slog.Info("Record hasn't mediatype in meta", "uploadId", req.Event.Upload.ID, "entityId", entityId)
 		return res, nil
 	}
 
@@ -95,29 +254,79 @@ func (g *MoveHandler) InvokeHook(req hooks.HookRequest) (res hooks.HookResponse,
 	id := req.Event.Upload.ID
 	uploadId, _ := splitIds(id)
 
+	// Если файл был сконвертирован (например, HEIC -> JPEG), берем результат конвертации
+	sourceKey := req.Event.Upload.Storage[SourceKeyStorageKey]
+	if sourceKey == "" {
+		sourceKey = uploadId
+	}
+	if err := checkSourceKey(uploadId, sourceKey); err != nil {
+		slog.Error("Invalid move source", "uploadId", uploadId, "err", err.Error())
+		setStageStatus(g.status, uploadId, uploadOwner(req.Event.Upload.MetaData), model.StageStatus{Stage: moveStage, Status: model.StatusFailed, Error: err.Error()})
+		return res, nil
+	}
+
 	slog.Info(
 		"debug move info",
 		"filename", filename,
 		"contentType", contentType,
 		"entityId", entityId,
 		"uploadId", uploadId,
+		"sourceKey", sourceKey,
 		"mediaType", mediaType,
 	)
 
-	err = g.move(context.Background(), uploadId, entityId, filename, contentType, mediaType)
+	moveReq := moveRequest{
+		UploadId:    uploadId,
+		UserId:      req.Event.Upload.MetaData[OwnerMetaKey],
+		SourceKey:   sourceKey,
+		EntityId:    entityId,
+		Filename:    filename,
+		ContentType: contentType,
+		MediaType:   mediaType,
+		Watermark:   req.Event.Upload.MetaData["watermark"],
+		RecordType:  recordType,
+
+		OriginalFilename: req.Event.Upload.Storage[OriginalNameStorageKey],
+		OriginalType:     req.Event.Upload.Storage[OriginalTypeStorageKey],
+	}
 
+	if recordType == "multi" {
+		if err := parseMultiRecord(req.Event.Upload.MetaData, &moveReq); err != nil {
+			slog.Info("Invalid multi record meta", "id", req.Event.Upload.ID, "err", err.Error())
+			setStageStatus(g.status, uploadId, uploadOwner(req.Event.Upload.MetaData), model.StageStatus{Stage: moveStage, Status: model.StatusFailed, Error: err.Error()})
+			return res, nil
+		}
+	}
+
+	// Ключ задачи из uploadId: повторный post-finish той же загрузки не создаст дубль
+	added, err := g.queue.Enqueue(moveJobKind+"-"+uploadId, moveJobKind, moveReq)
 	if err != nil {
-		slog.Error("Move failed", "err", err.Error())
+		slog.Error("Move enqueue failed", "uploadId", uploadId, "err", err.Error())
+		setStageStatus(g.status, uploadId, uploadOwner(req.Event.Upload.MetaData), model.StageStatus{Stage: moveStage, Status: model.StatusFailed, Error: err.Error()})
+		return res, nil
+	}
+	if !added {
+		// Задача уже в очереди или в dead-letter, ее статус актуальнее
+		slog.Info("Move already queued", "uploadId", uploadId)
 		return res, nil
 	}
 
+	setStageStatus(g.status, uploadId, uploadOwner(req.Event.Upload.MetaData), model.StageStatus{Stage: moveStage, Status: model.StatusPending})
+
 	return res, nil
 }
 
 /*
 Перемещаем все наши записи в /{id}/... файлы записями
 */
-func (g *MoveHandler) move(ctx context.Context, uploadId, entityId, filename, contentType, mediaType string) error {
+func (g *MoveHandler) move(ctx context.Context, req moveRequest) (model.MediaRecord, error) {
+	// Задачи из очереди могли быть поставлены до проверки в хуке
+	if err := checkSourceKey(req.UploadId, req.SourceKey); err != nil {
+		return model.MediaRecord{}, jobqueue.Permanent(err)
+	}
+
+	entityId, filename, contentType, mediaType := req.EntityId, req.Filename, req.ContentType, req.MediaType
+
 	ext := strings.ToLower(filepath.Ext(filename))
 	if mediaType == "image" {
 		switch ext {
@@ -127,133 +336,434 @@ func (g *MoveHandler) move(ctx context.Context, uploadId, entityId, filename, co
 		}
 	}
 
-	res, _ := g.s3Client.GetObject(ctx, &s3.GetObjectInput{
+	// Оригинал — сама загрузка, даже если обрабатываем результат конвертации (HEIC -> JPEG)
+	originalKey, originalFilename, originalType := req.SourceKey, filename, contentType
+	if req.OriginalFilename != "" {
+		originalKey, originalFilename, originalType = req.UploadId, req.OriginalFilename, req.OriginalType
+	}
+
+	originalName := fmt.Sprintf("%s/%s", entityId, originalFilename)
+	// для картинок прячем названием за имя с id в название и промежуточным префиксом -original-
+	if mediaType == "image" {
+		originalName = fmt.Sprintf("%s/%s-original-%s", entityId, entityId, originalFilename)
+	}
+
+	var originalFile *os.File
+	if mediaType == "image" {
+		// Локальная копия нужна только для декодирования картинки. Размеры проверяем
+		// по заголовку до копирования оригинала, чтобы бомба не попала в публичный бакет
+		var err error
+		originalFile, err = g.download(ctx, req.SourceKey)
+		if err != nil {
+			return model.MediaRecord{}, err
+		}
+		defer cleanUpTempFile(originalFile)
+
+		if err := checkImageLimits(originalFile, g.config.ImageLimits); err != nil {
+			return model.MediaRecord{}, &MoveError{Step: "limits", Key: req.SourceKey, Err: err}
+		}
+	}
+
+	// Оригинал копируем на стороне S3, через под он не проходит
+	if err := g.copyOriginal(ctx, originalKey, originalName, originalType); err != nil {
+		return model.MediaRecord{}, err
+	}
+
+	record := model.MediaRecord{Src: originalName, Type: mediaType}
+
+	if mediaType == "image" {
+		release, err := g.images.acquire(ctx)
+		if err != nil {
+			return model.MediaRecord{}, err
+		}
+		defer release()
+
+		record, err = g.processImage(ctx, originalFile, req, ext)
+		if err != nil {
+			return model.MediaRecord{}, err
+		}
+		record.Original = originalName
+	}
+
+	if req.RecordType == "multi" {
+		record.Ordinal = req.Ordinal
+		if err := g.updateRecord(ctx, req, record); err != nil {
+			return model.MediaRecord{}, err
+		}
+	} else if err := g.updateManifest(ctx, entityId, func(manifest *model.Manifest) {
+		manifest.Upsert(record)
+	}); err != nil {
+		return model.MediaRecord{}, err
+	}
+
+	// Все записи в бакет с результатами прошли — исходники в болоте больше не нужны
+	g.cleanupSwamp(ctx, req.UploadId)
+
+	return record, nil
+}
+
+// copyOriginal копирует исходник из болота в бакет с результатами без скачивания.
+// CopyObject ограничен 5 GiB на объект, больше этого копируем через multipart
+func (g *MoveHandler) copyOriginal(ctx context.Context, sourceKey, key, contentType string) error {
+	head, err := g.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(SwampDir),
-		Key:    aws.String(uploadId),
+		Key:    aws.String(sourceKey),
 	})
-
-	originalFile, err := ioutil.TempFile("", "tusd-s3-concat-tmp-")
 	if err != nil {
-		return err
+		return newMoveError("copy", sourceKey, err)
 	}
-	defer cleanUpTempFile(originalFile)
 
-	if _, err := io.Copy(originalFile, res.Body); err != nil {
-		return err
+	copySource := aws.String(SwampDir + "/" + url.PathEscape(sourceKey))
+	var ct *string
+	if contentType != "" {
+		ct = aws.String(contentType)
 	}
 
-	_, err = originalFile.Seek(0, 0)
-	if err != nil {
-		return err
+	if size := aws.ToInt64(head.ContentLength); size > copyObjectMaxSize {
+		return g.copyMultipart(ctx, sourceKey, key, ct, size)
 	}
 
-	originalName := fmt.Sprintf("%s/%s", entityId, filename)
-	// для картинок прячем названием за имя с id в название и промежуточным префиксом -original-
-	if mediaType == "image" {
-		originalName = fmt.Sprintf("%s/%s-original-%s", entityId, entityId, filename)
+	if _, err := g.s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(g.config.ResultBucket),
+		Key:               aws.String(key),
+		CopySource:        copySource,
+		ACL:               types.ObjectCannedACLPublicRead,
+		MetadataDirective: types.MetadataDirectiveReplace,
+		ContentType:       ct,
+	}); err != nil {
+		return newMoveError("copy", sourceKey, err)
 	}
 
-	params := &s3.PutObjectInput{
+	return nil
+}
+
+// copyMultipart копирует большой объект частями через UploadPartCopy. Если
+// что-то пошло не так, незавершенную загрузку отменяем, иначе части так и
+// останутся лежать в бакете
+func (g *MoveHandler) copyMultipart(ctx context.Context, sourceKey, key string, contentType *string, size int64) (err error) {
+	copySource := aws.String(SwampDir + "/" + url.PathEscape(sourceKey))
+
+	upload, err := g.s3Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
 		Bucket:      aws.String(g.config.ResultBucket),
-		Key:         aws.String(originalName),
-		Body:        originalFile,
+		Key:         aws.String(key),
 		ACL:         types.ObjectCannedACLPublicRead,
-		ContentType: aws.String(contentType),
+		ContentType: contentType,
+	})
+	if err != nil {
+		return newMoveError("copy", sourceKey, err)
+	}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		if _, abortErr := g.s3Client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(g.config.ResultBucket),
+			Key:      aws.String(key),
+			UploadId: upload.UploadId,
+		}); abortErr != nil {
+			slog.Warn("Multipart copy abort failed", "key", key, "err", abortErr.Error())
+		}
+	}()
+
+	var parts []types.CompletedPart
+	for offset, number := int64(0), int32(1); offset < size; offset, number = offset+copyPartSize, number+1 {
+		last := min(offset+copyPartSize, size) - 1
+
+		part, err := g.s3Client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(g.config.ResultBucket),
+			Key:             aws.String(key),
+			UploadId:        upload.UploadId,
+			PartNumber:      aws.Int32(number),
+			CopySource:      copySource,
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, last)),
+		})
+		if err != nil {
+			return newMoveError("copy", sourceKey, err)
+		}
+
+		parts = append(parts, types.CompletedPart{
+			ETag:       part.CopyPartResult.ETag,
+			PartNumber: aws.Int32(number),
+		})
+	}
+
+	if _, err := g.s3Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(g.config.ResultBucket),
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}); err != nil {
+		return newMoveError("copy", sourceKey, err)
+	}
+
+	return nil
+}
+
+// download скачивает исходник во временный файл, удалить его должен вызывающий
+func (g *MoveHandler) download(ctx context.Context, key string) (*os.File, error) {
+	res, err := g.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(SwampDir),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, newMoveError("download", key, err)
 	}
+	defer res.Body.Close()
 
-	_, err = g.s3Client.PutObject(ctx, params)
+	file, err := ioutil.TempFile("", "tusd-s3-concat-tmp-")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if _, err := originalFile.Seek(0, 0); err != nil {
-		return err
+	if _, err := io.Copy(file, res.Body); err != nil {
+		cleanUpTempFile(file)
+		return nil, newMoveError("download", key, err)
 	}
 
-	if mediaType == "image" {
-		// === ЛОГИКА ВОДЯНОГО ЗНАКА ===
-		img, _, err := image.Decode(originalFile)
+	if _, err := file.Seek(0, 0); err != nil {
+		cleanUpTempFile(file)
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// processImage поворачивает картинку по EXIF, накладывает водяной знак и заливает
+// полноразмерную версию в {id}/{filename} и уменьшенные копии из конфига
+func (g *MoveHandler) processImage(ctx context.Context, file *os.File, req moveRequest, ext string) (model.MediaRecord, error) {
+	record := model.MediaRecord{Src: fmt.Sprintf("%s/%s", req.EntityId, req.Filename), Type: "image"}
+
+	// Профиль водяного знака: из меты загрузки, по бакету или дефолтный
+	profile, err := g.watermarks.Profile(req.Watermark, g.config.ResultBucket)
+	if err != nil {
+		return record, err
+	}
+
+	// Сначала читаем EXIF ориентацию, чтобы водяной знак лег уже на повернутое фото
+	orientation := exifOrientation(file)
+	if _, err := file.Seek(0, 0); err != nil {
+		return record, err
+	}
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return record, &MoveError{Step: "decode", Key: req.SourceKey, Err: fmt.Errorf("%w: %v", ErrUndecodableImage, err)}
+	}
+
+	// Энкодеры Go не пишут EXIF, поэтому в результате тега ориентации нет
+	// и браузер не повернет картинку второй раз
+	img = applyOrientation(img, orientation)
+
+	watermarked, err := g.watermarks.Apply(img, profile)
+	if err != nil {
+		return record, err
+	}
+
+	body, contentType, err := encodeImage(watermarked, ext, g.config.JpegQuality)
+	if err != nil {
+		return record, err
+	}
+
+	if err := g.putObject(ctx, record.Src, body, contentType); err != nil {
+		return record, err
+	}
+
+	if record.Alternates, err = g.putAlternates(ctx, watermarked, record.Src); err != nil {
+		return record, err
+	}
+
+	// Копии поменьше: водяной знак накладываем на каждую отдельно, чтобы он оставался четким
+	for _, rendition := range g.config.Renditions {
+		resized := resizeToWidth(img, rendition.Width)
+
+		watermarked, err := g.watermarks.Apply(resized, profile)
 		if err != nil {
-			return err
+			return record, err
 		}
 
-		watermarkFile, err := os.Open("/usr/local/share/watermark60.png")
+		body, contentType, err := encodeImage(watermarked, ext, g.config.JpegQuality)
 		if err != nil {
-			return err
+			return record, err
+		}
+
+		key := renditionKey(req.EntityId, req.Filename, rendition.Name, ext)
+		if err := g.putObject(ctx, key, body, contentType); err != nil {
+			return record, err
 		}
-		defer watermarkFile.Close()
 
-		watermark, _, err := image.Decode(watermarkFile)
+		alternates, err := g.putAlternates(ctx, watermarked, key)
 		if err != nil {
-			return err
+			return record, err
 		}
 
-		wWidth := img.Bounds().Dx()
-		scale := float64(wWidth) / float64(watermark.Bounds().Dx())
-		wHeight := int(float64(watermark.Bounds().Dy()) * scale)
-		resizedWatermark := imaging.Resize(watermark, wWidth, wHeight, imaging.Lanczos)
+		record.Renditions = append(record.Renditions, model.Rendition{
+			Name:       rendition.Name,
+			Src:        key,
+			Width:      resized.Bounds().Dx(),
+			Height:     resized.Bounds().Dy(),
+			Alternates: alternates,
+		})
+	}
 
-		result := imaging.Clone(img)
+	return record, nil
+}
 
-		// Вычисляем координаты центра
-		x := 0 // по ширине мы масштабировали водяной знак на всю ширину
-		y := (img.Bounds().Dy() - wHeight) / 2
+// putAlternates кодирует картинку через ffmpeg во все доступные форматы и заливает
+// их рядом с key, возвращает content-type -> ключ. Форматы необязательные, поэтому
+// ошибка в одном из них только логируется
+func (g *MoveHandler) putAlternates(ctx context.Context, img image.Image, key string) (map[string]string, error) {
+	if len(g.imageFormats) == 0 {
+		return nil, nil
+	}
 
-		draw.Draw(result, image.Rect(x, y, x+wWidth, y+wHeight), resizedWatermark, image.Point{}, draw.Over)
+	// ffmpeg получает картинку без потерь, чтобы не пережимать JPEG второй раз
+	input, err := ioutil.TempFile("", "tusd-alt-in-*.png")
+	if err != nil {
+		return nil, err
+	}
+	defer cleanUpTempFile(input)
 
-		if err := originalFile.Truncate(0); err != nil {
-			return err
-		}
-		if _, err := originalFile.Seek(0, 0); err != nil {
-			return err
-		}
+	if err := png.Encode(input, img); err != nil {
+		return nil, err
+	}
 
-		if ext == ".png" {
-			if err := png.Encode(originalFile, result); err != nil {
-				return err
-			}
-			contentType = "image/png"
-		} else {
-			if err := jpeg.Encode(originalFile, result, &jpeg.Options{Quality: 90}); err != nil {
-				return err
-			}
-			contentType = "image/jpeg"
+	alternates := make(map[string]string, len(g.imageFormats))
+	for _, format := range g.imageFormats {
+		altKey := alternateKey(key, format)
+		if err := g.putAlternate(ctx, input.Name(), altKey, format); err != nil {
+			slog.Warn("Alternate format failed", "key", altKey, "format", format.Name, "err", err.Error())
+			continue
 		}
+		alternates[format.ContentType] = altKey
+	}
 
-		if _, err := originalFile.Seek(0, 0); err != nil {
-			return err
-		}
-		// === КОНЕЦ ЛОГИКИ ВОДЯНОГО ЗНАКА ===
-
-		params := &s3.PutObjectInput{
-			Bucket:      aws.String(g.config.ResultBucket),
-			Key:         aws.String(fmt.Sprintf("%s/%s", entityId, filename)),
-			Body:        originalFile,
-			ACL:         types.ObjectCannedACLPublicRead,
-			ContentType: aws.String(contentType),
-		}
+	return alternates, nil
+}
 
-		_, err = g.s3Client.PutObject(ctx, params)
-		if err != nil {
-			return err
-		}
+func (g *MoveHandler) putAlternate(ctx context.Context, input, key string, format ImageFormat) error {
+	output, err := ioutil.TempFile("", "tusd-alt-out-*"+format.Ext)
+	if err != nil {
+		return err
 	}
+	defer cleanUpTempFile(output)
 
-	// TODO:: (STEP_2) удалить файл и чанки и инфо, все старые файлы так как перемистили все, (вместе с шагом (STEP_1))
+	if err := encodeImageFormat(ctx, g.config.FfmpegPath, input, output.Name(), format); err != nil {
+		return err
+	}
 
-	return nil
+	return g.putObject(ctx, key, output, format.ContentType)
+}
+
+func (g *MoveHandler) putObject(ctx context.Context, key string, body io.Reader, contentType string) error {
+	_, err := g.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(g.config.ResultBucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ACL:         types.ObjectCannedACLPublicRead,
+		ContentType: aws.String(contentType),
+	})
+
+	return err
 }
 
-func (g *MoveHandler) deleteExists(ctx context.Context, userID, replace string) {
-	_, err := g.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
-		Bucket: aws.String(g.config.ResultBucket),
-		Key:    aws.String(fmt.Sprintf("%s/%s", userID, replace)),
+// cleanupSwamp удаляет из болота саму загрузку, ее .info, .part и результаты
+// конвертации ({uploadId}.jpg) — у всех них ключ начинается с uploadId.
+// Ошибки только логируем: перенос уже удался, а мусор можно добить позже
+func (g *MoveHandler) cleanupSwamp(ctx context.Context, uploadId string) {
+	if uploadId == "" {
+		return
+	}
+
+	list, err := g.s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(SwampDir),
+		Prefix: aws.String(uploadId),
 	})
+	if err != nil {
+		slog.Warn("Swamp cleanup list failed", "uploadId", uploadId, "err", err.Error())
+		return
+	}
+
+	if len(list.Contents) == 0 {
+		return
+	}
+
+	var objects []types.ObjectIdentifier
+	var size int64
+	for _, obj := range list.Contents {
+		objects = append(objects, types.ObjectIdentifier{Key: obj.Key})
+		size += aws.ToInt64(obj.Size)
+	}
+
+	if g.config.SwampCleanupDryRun {
+		for _, obj := range objects {
+			slog.Info("Swamp cleanup dry run, object kept", "key", aws.ToString(obj.Key))
+		}
+		MetricsSwampReclaimedBytes.WithLabelValues("dry-run").Add(float64(size))
+		return
+	}
 
+	out, err := g.s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(SwampDir),
+		Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+	})
 	if err != nil {
-		slog.Warn("Exists err", "filename", fmt.Sprintf("%s/%s", userID, replace))
+		slog.Warn("Swamp cleanup failed", "uploadId", uploadId, "err", err.Error())
 		return
 	}
+
+	for _, failed := range out.Errors {
+		slog.Warn("Swamp object not deleted", "key", aws.ToString(failed.Key), "err", aws.ToString(failed.Message))
+	}
+
+	if len(out.Errors) == 0 {
+		MetricsSwampReclaimedBytes.WithLabelValues("deleted").Add(float64(size))
+		slog.Info("Swamp cleaned up", "uploadId", uploadId, "objects", len(objects), "bytes", size)
+	}
+}
+
+// parseMultiRecord читает recordId, ordinal и total мульти-записи. Порядковый номер
+// добавляется в имя файла, чтобы файлы пачки не перетирали друг друга (у айфона
+// все фото называются image.jpg) и ключи сортировались в порядке загрузки
+func parseMultiRecord(meta handler.MetaData, req *moveRequest) error {
+	req.RecordId = meta["recordId"]
+	if req.RecordId == "" || strings.ContainsAny(req.RecordId, "/\\") {
+		return fmt.Errorf("invalid recordId %q", req.RecordId)
+	}
+
+	ordinal, err := strconv.Atoi(meta["ordinal"])
+	if err != nil || ordinal < 0 {
+		return fmt.Errorf("invalid ordinal %q", meta["ordinal"])
+	}
+
+	total, err := strconv.Atoi(meta["total"])
+	if err != nil || total < 1 || ordinal >= total {
+		return fmt.Errorf("invalid total %q for ordinal %d", meta["total"], ordinal)
+	}
+
+	req.Ordinal = ordinal
+	req.Total = total
+	req.Filename = fmt.Sprintf("%03d-%s", ordinal, req.Filename)
+
+	return nil
+}
+
+// checkSourceKey пускает в перенос только объекты самой загрузки: ее исходник
+// и результаты конвертации {uploadId}.*, но не служебные .info и .part
+func checkSourceKey(uploadId, key string) error {
+	if uploadId == "" {
+		return errors.New("upload id is unknown")
+	}
+
+	switch {
+	case key == uploadId:
+		return nil
+	case key == uploadId+".info", key == uploadId+".part":
+	case strings.HasPrefix(key, uploadId+"."):
+		return nil
+	}
+
+	return fmt.Errorf("source %q doesn't belong to upload %s", key, uploadId)
 }
 
 func cleanUpTempFile(file *os.File) {
@@ -272,73 +782,45 @@ func splitIds(id string) (uploadId, multipartId string) {
 	return
 }
 
+// exifOrientation читает тег ориентации из EXIF (JPEG, TIFF или сырой блок "Exif\0\0"),
+// если тега нет или он битый — считаем, что ориентация 1
+func exifOrientation(r io.Reader) int {
+	x, err := exif.Decode(r)
+	if err != nil {
+		return 1
+	}
+
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+
+	orientation, err := tag.Int(0)
+	if err != nil || orientation < 1 || orientation > 8 {
+		return 1
+	}
+
+	return orientation
+}
+
 // applyOrientation корректирует изображение по EXIF ориентации
 func applyOrientation(src image.Image, orientation int) image.Image {
-	bounds := src.Bounds()
-	dst := image.NewRGBA(bounds)
-
 	switch orientation {
 	case 2: // зеркально по горизонтали
-		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-			for x := bounds.Min.X; x < bounds.Max.X; x++ {
-				dst.Set(bounds.Max.X-x-1, y, src.At(x, y))
-			}
-		}
+		return imaging.FlipH(src)
 	case 3: // перевернуть 180
-		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-			for x := bounds.Min.X; x < bounds.Max.X; x++ {
-				dst.Set(bounds.Max.X-x-1, bounds.Max.Y-y-1, src.At(x, y))
-			}
-		}
+		return imaging.Rotate180(src)
 	case 4: // зеркально по вертикали
-		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-			for x := bounds.Min.X; x < bounds.Max.X; x++ {
-				dst.Set(x, bounds.Max.Y-y-1, src.At(x, y))
-			}
-		}
-	case 5: // зеркально + поворот 90
-		dst = rotate90(src, true)
-	case 6: // поворот 90
-		dst = rotate90(src, false)
-	case 7: // зеркально + поворот 270
-		dst = rotate270(src, true)
-	case 8: // поворот 270
-		dst = rotate270(src, false)
+		return imaging.FlipV(src)
+	case 5: // зеркально + поворот 90 против часовой
+		return imaging.Transpose(src)
+	case 6: // поворот 90 по часовой
+		return imaging.Rotate270(src)
+	case 7: // зеркально + поворот 90 по часовой
+		return imaging.Transverse(src)
+	case 8: // поворот 90 против часовой
+		return imaging.Rotate90(src)
 	default: // ориентация 1 — без изменений
-		draw.Draw(dst, bounds, src, bounds.Min, draw.Src)
-	}
-
-	return dst
-}
-
-func rotate90(src image.Image, flip bool) *image.RGBA {
-	b := src.Bounds()
-	dst := image.NewRGBA(image.Rect(0, 0, b.Dy(), b.Dx()))
-	for y := b.Min.Y; y < b.Max.Y; y++ {
-		for x := b.Min.X; x < b.Max.X; x++ {
-			px := src.At(x, y)
-			if flip {
-				dst.Set(y, b.Max.X-x-1, px)
-			} else {
-				dst.Set(y, x, px)
-			}
-		}
-	}
-	return dst
-}
-
-func rotate270(src image.Image, flip bool) *image.RGBA {
-	b := src.Bounds()
-	dst := image.NewRGBA(image.Rect(0, 0, b.Dy(), b.Dx()))
-	for y := b.Min.Y; y < b.Max.Y; y++ {
-		for x := b.Min.X; x < b.Max.X; x++ {
-			px := src.At(x, y)
-			if flip {
-				dst.Set(b.Dy()-y-1, b.Max.X-x-1, px)
-			} else {
-				dst.Set(b.Dy()-y-1, x, px)
-			}
-		}
+		return src
 	}
-	return dst
 }
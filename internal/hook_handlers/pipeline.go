@@ -0,0 +1,313 @@
+package hook_handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	appconfig "codiewuploader/internal/config"
+	"codiewuploader/internal/status"
+
+	"github.com/tus/tusd/v2/pkg/hooks"
+	"golang.org/x/exp/slices"
+)
+
+// stageHooks are the hook types each stage can handle, a stage without
+// explicit hooks in the pipeline config subscribes to all of them.
+var stageHooks = map[string][]hooks.HookType{
+	"auth":           {hooks.HookPreCreate},
+	"metadata":       {hooks.HookPreCreate},
+	"entity-auth":    {hooks.HookPreCreate},
+	"quota":          {hooks.HookPreCreate, hooks.HookPostReceive, hooks.HookPostFinish, hooks.HookPostTerminate},
+	"content-sniff":  {hooks.HookPostFinish},
+	"antivirus":      {hooks.HookPostFinish},
+	"heic-converter": {hooks.HookPostFinish},
+	"ffmpeg-convert": {hooks.HookPostFinish},
+	"move":           {hooks.HookPostFinish},
+}
+
+// stage routes only the subscribed hook types to its handler, so the
+// handlers don't need to check the type themselves. Async stages are run by
+// the Handler through its worker pool.
+type stage struct {
+	name  string
+	hooks []hooks.HookType
+	async bool
+	// external — внешний хук tusd из порядка хуков, серверные ключи меты он не меняет
+	external bool
+	handler  hooks.HookHandler
+}
+
+// stageName is the name the stage reports its response under
+func stageName(handler hooks.HookHandler) string {
+	if s, ok := handler.(*stage); ok {
+		return s.name
+	}
+
+	return fmt.Sprintf("%T", handler)
+}
+
+func (s *stage) Setup() error {
+	return s.handler.Setup()
+}
+
+func (s *stage) InvokeHook(req hooks.HookRequest) (res hooks.HookResponse, err error) {
+	if !slices.Contains(s.hooks, req.Type) {
+		return res, nil
+	}
+
+	return s.handler.InvokeHook(req)
+}
+
+// pipelineBuilder creates the stage handlers, auth and quotas are shared
+// with the HTTP endpoints so they exist even outside of the pipeline.
+type pipelineBuilder struct {
+	config appconfig.AppConfig
+	auth   *AuthHandler
+	quotas *QuotaHandler
+	status *status.Store
+	images *imagePool
+
+	// resultBucket is where the move stage writes to after its options
+	resultBucket string
+	// entities and entityAuthTimeout are the entity authorization after the
+	// options of the entity-auth stage
+	entities          EntityAuthorizer
+	entityAuthTimeout time.Duration
+}
+
+func (b *pipelineBuilder) build(pipeline appconfig.PipelineConfig) ([]hooks.HookHandler, error) {
+	var handlers []hooks.HookHandler
+	seen := make(map[string]bool)
+	b.resultBucket = b.config.ResultBucket
+	b.entities = nil
+	b.entityAuthTimeout = b.config.EntityAuthTimeout
+
+	for _, stageConfig := range pipeline.Stages {
+		supported, ok := stageHooks[stageConfig.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown stage %q", stageConfig.Name)
+		}
+		if seen[stageConfig.Name] {
+			return nil, fmt.Errorf("stage %q is listed twice", stageConfig.Name)
+		}
+		seen[stageConfig.Name] = true
+
+		subscribed, err := stageSubscriptions(stageConfig, supported)
+		if err != nil {
+			return nil, err
+		}
+
+		handler, err := b.handler(stageConfig)
+		if err != nil {
+			return nil, fmt.Errorf("stage %q: %w", stageConfig.Name, err)
+		}
+
+		handlers = append(handlers, &stage{
+			name:    stageConfig.Name,
+			hooks:   subscribed,
+			async:   stageConfig.Async,
+			handler: handler,
+		})
+	}
+
+	// Без проверки токена сервис открыт всем, такую конфигурацию не запускаем
+	if !seen["auth"] {
+		return nil, fmt.Errorf("stage %q is required", "auth")
+	}
+
+	// HTTP эндпоинтам проверка сущностей нужна и без стадии entity-auth
+	if b.entities == nil {
+		entities, err := NewEntityAuthorizer(b.config)
+		if err != nil {
+			return nil, fmt.Errorf("entity authorization: %w", err)
+		}
+		b.entities = entities
+	}
+
+	return handlers, nil
+}
+
+// stageSubscriptions checks the hook types from the config against the ones
+// the stage supports.
+func stageSubscriptions(stageConfig appconfig.StageConfig, supported []hooks.HookType) ([]hooks.HookType, error) {
+	subscribed := supported
+	if len(stageConfig.Hooks) > 0 {
+		subscribed = nil
+		for _, name := range stageConfig.Hooks {
+			hookType := hooks.HookType(name)
+			if !slices.Contains(supported, hookType) {
+				return nil, fmt.Errorf("stage %q doesn't handle %q hooks", stageConfig.Name, name)
+			}
+			subscribed = append(subscribed, hookType)
+		}
+	}
+
+	if stageConfig.Async {
+		for _, hookType := range subscribed {
+			// Ответ pre-хуков решает судьбу загрузки, в фоне его некому отдать
+			if hookType == hooks.HookPreCreate || hookType == hooks.HookPreFinish {
+				return nil, fmt.Errorf("stage %q can't be async for %q hooks", stageConfig.Name, hookType)
+			}
+		}
+	}
+
+	return subscribed, nil
+}
+
+func (b *pipelineBuilder) handler(stageConfig appconfig.StageConfig) (hooks.HookHandler, error) {
+	config := b.config
+
+	switch stageConfig.Name {
+	case "auth":
+		return b.auth, decodeOptions(stageConfig.Options, &struct{}{})
+
+	case "metadata":
+		return NewMetadataHandler(config), decodeOptions(stageConfig.Options, &struct{}{})
+
+	case "entity-auth":
+		var options struct {
+			Mode    *string             `json:"mode"`
+			Claim   *string             `json:"claim"`
+			URL     *string             `json:"url"`
+			Timeout *appconfig.Duration `json:"timeout"`
+			Stub    *string             `json:"stub"`
+		}
+		if err := decodeOptions(stageConfig.Options, &options); err != nil {
+			return nil, err
+		}
+		setOption(&config.EntityAuthMode, options.Mode)
+		setOption(&config.EntityAuthClaim, options.Claim)
+		setOption(&config.EntityAuthURL, options.URL)
+		setDurationOption(&config.EntityAuthTimeout, options.Timeout)
+		setOption(&config.EntityAuthStub, options.Stub)
+
+		entities, err := NewEntityAuthorizer(config)
+		if err != nil {
+			return nil, err
+		}
+		b.entities = entities
+		b.entityAuthTimeout = config.EntityAuthTimeout
+
+		return NewEntityAuthHandler(config, b.auth, entities), nil
+
+	case "quota":
+		return b.quotas, decodeOptions(stageConfig.Options, &struct{}{})
+
+	case "content-sniff":
+		var options struct {
+			QuarantinePrefix *string `json:"quarantinePrefix"`
+		}
+		if err := decodeOptions(stageConfig.Options, &options); err != nil {
+			return nil, err
+		}
+		setOption(&config.QuarantinePrefix, options.QuarantinePrefix)
+
+		return NewContentSniffHandler(config), nil
+
+	case "antivirus":
+		var options struct {
+			Network          *string             `json:"network"`
+			Address          *string             `json:"address"`
+			Timeout          *appconfig.Duration `json:"timeout"`
+			DialTimeout      *appconfig.Duration `json:"dialTimeout"`
+			FailOpen         *bool               `json:"failOpen"`
+			QuarantinePrefix *string             `json:"quarantinePrefix"`
+			SizeLimitAction  *string             `json:"sizeLimitAction"`
+		}
+		if err := decodeOptions(stageConfig.Options, &options); err != nil {
+			return nil, err
+		}
+		setOption(&config.ClamdNetwork, options.Network)
+		setOption(&config.ClamdAddress, options.Address)
+		setDurationOption(&config.ClamdTimeout, options.Timeout)
+		setDurationOption(&config.ClamdDialTimeout, options.DialTimeout)
+		setOption(&config.ClamdFailOpen, options.FailOpen)
+		setOption(&config.ClamdQuarantinePrefix, options.QuarantinePrefix)
+		setOption(&config.ClamdSizeLimitAction, options.SizeLimitAction)
+
+		switch config.ClamdSizeLimitAction {
+		case appconfig.ClamdSizeLimitReject, appconfig.ClamdSizeLimitSkip:
+		default:
+			return nil, fmt.Errorf("unknown size limit action %q", config.ClamdSizeLimitAction)
+		}
+
+		return NewAntivirusHandler(config, b.status), nil
+
+	case "heic-converter":
+		return NewHeicConverterHandler(config, b.images), decodeOptions(stageConfig.Options, &struct{}{})
+
+	case "ffmpeg-convert":
+		var options struct {
+			Preset  *string             `json:"preset"`
+			Timeout *appconfig.Duration `json:"timeout"`
+		}
+		if err := decodeOptions(stageConfig.Options, &options); err != nil {
+			return nil, err
+		}
+		setOption(&config.VideoPreset, options.Preset)
+		setDurationOption(&config.FfmpegTimeout, options.Timeout)
+
+		return NewFfmpegConvertHandler(config), nil
+
+	case "move":
+		var options struct {
+			Bucket      *string  `json:"bucket"`
+			Renditions  *string  `json:"renditions"`
+			Formats     []string `json:"formats"`
+			JpegQuality *int     `json:"jpegQuality"`
+		}
+		if err := decodeOptions(stageConfig.Options, &options); err != nil {
+			return nil, err
+		}
+		setOption(&config.ResultBucket, options.Bucket)
+		if err := checkQuarantineBucket(config.QuarantineBucket, config.ResultBucket); err != nil {
+			return nil, err
+		}
+		b.resultBucket = config.ResultBucket
+		setOption(&config.JpegQuality, options.JpegQuality)
+		if options.Formats != nil {
+			config.ImageFormats = options.Formats
+		}
+		if options.Renditions != nil {
+			renditions, err := appconfig.ParseRenditions(*options.Renditions)
+			if err != nil {
+				return nil, err
+			}
+			config.Renditions = renditions
+		}
+
+		return NewMoveHandler(config, b.images, b.status), nil
+	}
+
+	return nil, fmt.Errorf("unknown stage %q", stageConfig.Name)
+}
+
+// decodeOptions refuses unknown keys, a typo in the config shouldn't silently
+// fall back to the env value.
+func decodeOptions(data json.RawMessage, options interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(options); err != nil {
+		return fmt.Errorf("invalid options: %w", err)
+	}
+
+	return nil
+}
+
+func setOption[T any](field *T, value *T) {
+	if value != nil {
+		*field = *value
+	}
+}
+
+func setDurationOption(field *time.Duration, value *appconfig.Duration) {
+	if value != nil {
+		*field = time.Duration(*value)
+	}
+}
@@ -0,0 +1,228 @@
+package hook_handlers
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	appconfig "codiewuploader/internal/config"
+
+	"github.com/tus/tusd/v2/pkg/hooks"
+)
+
+func TestPipelineSharesEntityAuthorizer(t *testing.T) {
+	config := appconfig.AppConfig{
+		EntityAuthMode:    "claim",
+		EntityAuthClaim:   "entities",
+		EntityAuthTimeout: 5 * time.Second,
+	}
+
+	tests := []struct {
+		name        string
+		stages      []appconfig.StageConfig
+		want        EntityAuthorizer
+		wantTimeout time.Duration
+	}{
+		{
+			name:        "env",
+			stages:      []appconfig.StageConfig{{Name: "auth"}, {Name: "entity-auth"}},
+			want:        ClaimAuthorizer{Claim: "entities"},
+			wantTimeout: 5 * time.Second,
+		},
+		{
+			name: "stage options",
+			stages: []appconfig.StageConfig{{Name: "auth"}, {
+				Name:    "entity-auth",
+				Options: json.RawMessage(`{"mode":"claim","claim":"listings","timeout":"1s"}`),
+			}},
+			want:        ClaimAuthorizer{Claim: "listings"},
+			wantTimeout: time.Second,
+		},
+		{
+			name:        "without the stage",
+			stages:      []appconfig.StageConfig{{Name: "auth"}},
+			want:        ClaimAuthorizer{Claim: "entities"},
+			wantTimeout: 5 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := &pipelineBuilder{config: config, auth: NewAuthHandler(config)}
+			handlers, err := builder.build(appconfig.PipelineConfig{Stages: tt.stages})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if builder.entities != tt.want || builder.entityAuthTimeout != tt.wantTimeout {
+				t.Errorf("entities = %#v, %s, want %#v, %s", builder.entities, builder.entityAuthTimeout, tt.want, tt.wantTimeout)
+			}
+
+			// Стадия и /quota спрашивают один и тот же authorizer
+			for _, handler := range handlers {
+				if entityAuth, ok := handler.(*stage).handler.(*EntityAuthHandler); ok && entityAuth.authorizer != builder.entities {
+					t.Errorf("stage authorizer = %#v, want the shared one", entityAuth.authorizer)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeOptions(t *testing.T) {
+	type options struct {
+		Address *string             `json:"address"`
+		Timeout *appconfig.Duration `json:"timeout"`
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		want    options
+		wantErr bool
+	}{
+		{name: "no options"},
+		{name: "null", data: `null`},
+		{name: "empty", data: `{}`},
+		{name: "values", data: `{"address": "clamd:3310", "timeout": "30s"}`, want: options{Address: ptr("clamd:3310"), Timeout: ptr(appconfig.Duration(30 * time.Second))}},
+		{name: "unknown key", data: `{"adress": "clamd:3310"}`, wantErr: true},
+		{name: "wrong type", data: `{"address": 3310}`, wantErr: true},
+		{name: "invalid duration", data: `{"timeout": "soon"}`, wantErr: true},
+		{name: "duration without unit", data: `{"timeout": 30}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got options
+			err := decodeOptions(json.RawMessage(tt.data), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("options = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// Стадия без опций тоже не принимает лишних ключей
+	if err := decodeOptions(json.RawMessage(`{"x": 1}`), &struct{}{}); err == nil {
+		t.Error("option of a stage without options accepted")
+	}
+}
+
+func ptr[T any](value T) *T {
+	return &value
+}
+
+func TestPipelineBuild(t *testing.T) {
+	_, config := newFakeS3(t)
+	config.EntityAuthMode = "claim"
+	config.EntityAuthClaim = "entities"
+	config.ClamdSizeLimitAction = appconfig.ClamdSizeLimitReject
+	config.ClamdDialTimeout = 10 * time.Second
+
+	tests := []struct {
+		name    string
+		stages  string
+		wantErr bool
+	}{
+		{name: "unknown stage", stages: `[{"name": "auth"}, {"name": "resize"}]`, wantErr: true},
+		{name: "stage twice", stages: `[{"name": "auth"}, {"name": "metadata"}, {"name": "metadata"}]`, wantErr: true},
+		{name: "without auth", stages: `[{"name": "metadata"}]`, wantErr: true},
+		{name: "unsupported hook", stages: `[{"name": "auth", "hooks": ["post-finish"]}]`, wantErr: true},
+		{name: "async pre-create", stages: `[{"name": "auth"}, {"name": "quota", "hooks": ["pre-create"], "async": true}]`, wantErr: true},
+		{name: "unknown option", stages: `[{"name": "auth", "options": {"secret": "x"}}]`, wantErr: true},
+		{name: "invalid option", stages: `[{"name": "auth"}, {"name": "antivirus", "options": {"sizeLimitAction": "ignore"}}]`, wantErr: true},
+		{name: "invalid entity auth mode", stages: `[{"name": "auth"}, {"name": "entity-auth", "options": {"mode": "maybe"}}]`, wantErr: true},
+		{name: "valid", stages: `[{"name": "auth"}, {"name": "antivirus", "async": true}]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stages []appconfig.StageConfig
+			if err := json.Unmarshal([]byte(tt.stages), &stages); err != nil {
+				t.Fatal(err)
+			}
+
+			builder := &pipelineBuilder{config: config, auth: NewAuthHandler(config)}
+			_, err := builder.build(appconfig.PipelineConfig{Stages: stages})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPipelineBuildFromYaml(t *testing.T) {
+	_, config := newFakeS3(t)
+	config.EntityAuthMode = "claim"
+	config.EntityAuthClaim = "entities"
+	config.ClamdTimeout = time.Minute
+	config.ClamdDialTimeout = 10 * time.Second
+	config.ClamdSizeLimitAction = appconfig.ClamdSizeLimitReject
+
+	path := filepath.Join(t.TempDir(), "pipeline.yaml")
+	file := `
+stages:
+  - name: auth
+  - name: metadata
+  - name: quota
+    hooks: [pre-create, post-terminate]
+  - name: antivirus
+    async: true
+    options:
+      network: unix
+      dialTimeout: 2s
+      sizeLimitAction: skip
+`
+	if err := os.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pipeline, err := appconfig.LoadPipelineConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	builder := &pipelineBuilder{config: config, auth: NewAuthHandler(config), quotas: NewQuotaHandler(config)}
+	handlers, err := builder.build(pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, handler := range handlers {
+		names = append(names, stageName(handler))
+	}
+	if !reflect.DeepEqual(names, []string{"auth", "metadata", "quota", "antivirus"}) {
+		t.Fatalf("stages = %v, want the order of the file", names)
+	}
+
+	quota := handlers[2].(*stage)
+	if !reflect.DeepEqual(quota.hooks, []hooks.HookType{hooks.HookPreCreate, hooks.HookPostTerminate}) || quota.handler != builder.quotas {
+		t.Errorf("quota stage = %+v, want the shared handler on the listed hooks", quota)
+	}
+
+	antivirus := handlers[3].(*stage)
+	if !antivirus.async || !reflect.DeepEqual(antivirus.hooks, []hooks.HookType{hooks.HookPostFinish}) {
+		t.Errorf("antivirus stage = %+v, want async on post-finish", antivirus)
+	}
+
+	// Опции стадии перекрывают env только для нее
+	av := antivirus.handler.(*AntivirusHandler).config
+	if av.ClamdNetwork != "unix" || av.ClamdDialTimeout != 2*time.Second || av.ClamdSizeLimitAction != appconfig.ClamdSizeLimitSkip {
+		t.Errorf("antivirus config = %s, %s, %s, want the stage options", av.ClamdNetwork, av.ClamdDialTimeout, av.ClamdSizeLimitAction)
+	}
+	if av.ClamdTimeout != time.Minute {
+		t.Errorf("antivirus timeout = %s, want the env value", av.ClamdTimeout)
+	}
+	if config.ClamdDialTimeout != 10*time.Second || builder.config.ClamdNetwork != "" {
+		t.Error("stage options leaked into the shared config")
+	}
+}
@@ -0,0 +1,74 @@
+package hook_handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	appConfig "codiewuploader/internal/config"
+	"codiewuploader/internal/model"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// checkQuarantineBucket refuses a quarantine bucket shared with the swamp or
+// the results: objects there are served or moved on and an infected file
+// would get out.
+func checkQuarantineBucket(quarantineBucket, resultBucket string) error {
+	switch quarantineBucket {
+	case "":
+		return fmt.Errorf("quarantine bucket is not set")
+	case SwampDir:
+		return fmt.Errorf("quarantine bucket %q must differ from the swamp bucket", quarantineBucket)
+	case resultBucket:
+		return fmt.Errorf("quarantine bucket %q must differ from the result bucket", quarantineBucket)
+	}
+
+	return nil
+}
+
+// quarantine moves the upload out of the swamp under the prefix of the
+// quarantine bucket and stores the report next to it as {key}.json. The tus
+// .info and .part objects stay in the swamp, so the upload itself still
+// resolves.
+func quarantine(ctx context.Context, s3Client *s3.Client, config appConfig.AppConfig, prefix, sourceKey string, report model.QuarantineReport) (string, error) {
+	key := prefix + report.UploadId
+
+	_, err := s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(config.QuarantineBucket),
+		Key:        aws.String(key),
+		CopySource: aws.String(SwampDir + "/" + url.PathEscape(sourceKey)),
+	})
+	if err != nil {
+		return key, err
+	}
+
+	report.CreatedAt = time.Now().UTC()
+	data, err := json.Marshal(report)
+	if err != nil {
+		return key, err
+	}
+
+	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(config.QuarantineBucket),
+		Key:         aws.String(key + ".json"),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return key, err
+	}
+
+	_, err = s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(SwampDir),
+		Key:    aws.String(sourceKey),
+	})
+
+	MetricsQuarantinedTotal.WithLabelValues(report.Stage).Inc()
+
+	return key, err
+}
@@ -0,0 +1,111 @@
+package hook_handlers
+
+import (
+	"errors"
+	"log"
+
+	appconfig "codiewuploader/internal/config"
+	"codiewuploader/internal/quota"
+
+	"github.com/tus/tusd/v2/pkg/hooks"
+	"golang.org/x/exp/slog"
+)
+
+// QuotaReservationMetaKey links the upload to its quota reservation
+const QuotaReservationMetaKey = "quotaReservation"
+
+// QuotaHandler enforces the per-user and per-entity limits in pre-create and
+// keeps the usage up to date when uploads finish or get terminated. The
+// post-receive progress keeps the reservation of a running upload alive.
+type QuotaHandler struct {
+	config appconfig.AppConfig
+	store  *quota.Store
+}
+
+func NewQuotaHandler(config appconfig.AppConfig) *QuotaHandler {
+	return &QuotaHandler{
+		config: config,
+	}
+}
+
+func (g *QuotaHandler) Setup() error {
+	log.Println("QuotaHandler.Setup setup")
+
+	store, err := quota.Open(quota.Config{
+		Path:           g.config.QuotaFile,
+		User:           g.config.QuotaUser,
+		Entity:         g.config.QuotaEntity,
+		ReservationTTL: g.config.QuotaReservationTTL,
+	})
+	if err != nil {
+		return err
+	}
+
+	g.store = store
+
+	return nil
+}
+
+// Store gives access to the usage for the quota endpoint
+func (g *QuotaHandler) Store() *quota.Store {
+	return g.store
+}
+
+func (g *QuotaHandler) InvokeHook(req hooks.HookRequest) (res hooks.HookResponse, err error) {
+	meta := req.Event.Upload.MetaData
+
+	switch req.Type {
+	case hooks.HookPreCreate:
+		g.reserve(req, &res)
+
+	case hooks.HookPostReceive:
+		if err := g.store.Touch(meta[QuotaReservationMetaKey]); err != nil {
+			slog.Error("QuotaTouchError", "uploadId", req.Event.Upload.ID, "err", err.Error())
+		}
+
+	case hooks.HookPostFinish:
+		if err := g.store.Complete(meta[QuotaReservationMetaKey]); err != nil {
+			slog.Error("QuotaCompleteError", "uploadId", req.Event.Upload.ID, "err", err.Error())
+		}
+
+	case hooks.HookPostTerminate:
+		if err := g.store.Release(meta[QuotaReservationMetaKey]); err != nil {
+			slog.Error("QuotaReleaseError", "uploadId", req.Event.Upload.ID, "err", err.Error())
+		}
+	}
+
+	return res, nil
+}
+
+func (g *QuotaHandler) reserve(req hooks.HookRequest, res *hooks.HookResponse) {
+	upload := req.Event.Upload
+
+	// Без известного размера лимит по байтам не проверить
+	if upload.SizeIsDeferred && (g.config.QuotaUser.Bytes > 0 || g.config.QuotaEntity.Bytes > 0) {
+		res.HTTPResponse.StatusCode = 400
+		res.HTTPResponse.Body = "Upload-Length is required"
+		res.RejectUpload = true
+		return
+	}
+
+	reservation, err := g.store.Reserve(upload.MetaData[OwnerMetaKey], upload.MetaData["id"], upload.Size)
+	if err != nil {
+		var exceeded *quota.ExceededError
+		if errors.As(err, &exceeded) {
+			res.HTTPResponse.StatusCode = 413
+			res.HTTPResponse.Body = exceeded.Error()
+			res.RejectUpload = true
+			return
+		}
+
+		slog.Error("QuotaReserveError", "err", err.Error())
+		res.HTTPResponse.StatusCode = 503
+		res.HTTPResponse.Body = "Unable to check upload quota"
+		res.RejectUpload = true
+		return
+	}
+
+	res.ChangeFileInfo.MetaData = map[string]string{
+		QuotaReservationMetaKey: reservation,
+	}
+}
@@ -0,0 +1,244 @@
+package hook_handlers
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	appConfig "codiewuploader/internal/config"
+)
+
+// fakeS3 is an in-memory S3 answering the path-style requests the handlers
+// make. Conditional writes follow S3: If-Match needs the current ETag and
+// If-None-Match: * needs a missing object, otherwise 412 PreconditionFailed.
+type fakeS3 struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	objects map[string]fakeObject
+
+	// ignoreConditions behaves like a store without conditional writes
+	ignoreConditions bool
+	// beforePut runs before a conditional write is checked, e.g. to simulate
+	// another instance writing in between
+	beforePut func(key string)
+}
+
+type fakeObject struct {
+	body        []byte
+	contentType string
+	etag        string
+}
+
+type fakeS3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+// newFakeS3 starts the server and returns the app config pointing the S3
+// clients to it.
+func newFakeS3(t *testing.T) (*fakeS3, appConfig.AppConfig) {
+	t.Helper()
+
+	s := &fakeS3{objects: make(map[string]fakeObject)}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.server.Close)
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	return s, appConfig.AppConfig{S3Endpoint: s.server.URL, ResultBucket: "rent_result"}
+}
+
+func (s *fakeS3) put(bucket, key string, body []byte, contentType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.objects[bucket+"/"+key] = newFakeObject(body, contentType)
+}
+
+func (s *fakeS3) get(bucket, key string) (fakeObject, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[bucket+"/"+key]
+	return obj, ok
+}
+
+func (s *fakeS3) keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for path := range s.objects {
+		if key, ok := strings.CutPrefix(path, bucket+"/"); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func newFakeObject(body []byte, contentType string) fakeObject {
+	sum := md5.Sum(body)
+	return fakeObject{body: body, contentType: contentType, etag: `"` + hex.EncodeToString(sum[:]) + `"`}
+}
+
+func (s *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && key == "" && query.Get("list-type") == "2":
+		s.list(w, bucket, query.Get("prefix"))
+	case r.Method == http.MethodPost && key == "" && query.Has("delete"):
+		s.deleteObjects(w, bucket, body)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		s.getObject(w, r, bucket, key)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.copyObject(w, r, bucket, key)
+	case r.Method == http.MethodPut:
+		s.putObject(w, r, bucket, key, body)
+	case r.Method == http.MethodDelete:
+		s.mu.Lock()
+		delete(s.objects, bucket+"/"+key)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeFakeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *fakeS3) getObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	obj, ok := s.get(bucket, key)
+	if !ok {
+		writeFakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+
+	body, status := obj.body, http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		var first, last int
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &first, &last); err == nil && first < len(body) {
+			body, status = body[first:min(last+1, len(body))], http.StatusPartialContent
+		}
+	}
+
+	w.Header().Set("ETag", obj.etag)
+	w.Header().Set("Content-Type", obj.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(body)
+	}
+}
+
+func (s *fakeS3) putObject(w http.ResponseWriter, r *http.Request, bucket, key string, body []byte) {
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if s.beforePut != nil && (ifMatch != "" || ifNoneMatch != "") {
+		s.beforePut(key)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, exists := s.objects[bucket+"/"+key]
+	if !s.ignoreConditions {
+		if (ifMatch != "" && (!exists || current.etag != ifMatch)) || (ifNoneMatch == "*" && exists) {
+			writeFakeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+	}
+
+	obj := newFakeObject(body, r.Header.Get("Content-Type"))
+	s.objects[bucket+"/"+key] = obj
+
+	w.Header().Set("ETag", obj.etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *fakeS3) copyObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	source, err := url.PathUnescape(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"))
+	if err != nil {
+		writeFakeS3Error(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[source]
+	if !ok {
+		writeFakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		obj.contentType = contentType
+	}
+	s.objects[bucket+"/"+key] = obj
+
+	fmt.Fprintf(w, `<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>`, obj.etag)
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, bucket, prefix string) {
+	var contents strings.Builder
+	for _, key := range s.keys(bucket) {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		obj, _ := s.get(bucket, key)
+		fmt.Fprintf(&contents, "<Contents><Key>%s</Key><Size>%d</Size></Contents>", key, len(obj.body))
+	}
+
+	fmt.Fprintf(w, `<ListBucketResult><Name>%s</Name><Prefix>%s</Prefix><IsTruncated>false</IsTruncated>%s</ListBucketResult>`, bucket, prefix, contents.String())
+}
+
+func (s *fakeS3) deleteObjects(w http.ResponseWriter, bucket string, body []byte) {
+	var request struct {
+		Objects []struct {
+			Key string `xml:"Key"`
+		} `xml:"Object"`
+	}
+	if err := xml.Unmarshal(body, &request); err != nil {
+		writeFakeS3Error(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	s.mu.Lock()
+	for _, obj := range request.Objects {
+		delete(s.objects, bucket+"/"+obj.Key)
+	}
+	s.mu.Unlock()
+
+	io.WriteString(w, `<DeleteResult></DeleteResult>`)
+}
+
+func writeFakeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+
+	var buf bytes.Buffer
+	xml.NewEncoder(&buf).Encode(fakeS3Error{Code: code, Message: code})
+	w.Write(buf.Bytes())
+}
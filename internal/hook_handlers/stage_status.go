@@ -0,0 +1,84 @@
+package hook_handlers
+
+import (
+	"encoding/json"
+
+	"codiewuploader/internal/model"
+	"codiewuploader/internal/status"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"github.com/tus/tusd/v2/pkg/hooks"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+)
+
+// selfReporting is implemented by the stages which update the status store
+// themselves, e.g. when the work is finished later by a background job.
+type selfReporting interface {
+	reportsStatus()
+}
+
+// reportStatus records the stage result of a post-finish hook, that's where
+// the processing happens which the clients can't see otherwise.
+func (g *Handler) reportStatus(req hooks.HookRequest, s *stage, stageStatus model.StageStatus) {
+	if req.Type != hooks.HookPostFinish {
+		return
+	}
+	if _, ok := s.handler.(selfReporting); ok {
+		return
+	}
+
+	uploadId, _ := splitIds(req.Event.Upload.ID)
+	setStageStatus(g.status, uploadId, uploadOwner(req.Event.Upload.MetaData), stageStatus)
+}
+
+// reportRest marks the stages after a stopped one which would have handled
+// the hook
+func (g *Handler) reportRest(req hooks.HookRequest, rest []hooks.HookHandler, status string) {
+	for _, handler := range rest {
+		if s, ok := handler.(*stage); ok && slices.Contains(s.hooks, req.Type) {
+			g.reportStatus(req, s, model.StageStatus{Stage: s.name, Status: status})
+		}
+	}
+}
+
+// restStatus is the status of the stages after a stopped one: they are
+// skipped, unless the stopping stage is still pending and resumes them later
+func restStatus(stopped model.StageStatus) string {
+	if stopped.Status == model.StatusPending {
+		return model.StatusPending
+	}
+
+	return model.StatusSkipped
+}
+
+func setStageStatus(store *status.Store, uploadId string, owner status.Owner, stageStatus model.StageStatus) {
+	if err := store.Set(uploadId, owner, stageStatus); err != nil {
+		slog.Error("StatusSaveError", "uploadId", uploadId, "stage", stageStatus.Stage, "err", err.Error())
+	}
+}
+
+func uploadOwner(meta handler.MetaData) status.Owner {
+	return status.Owner{
+		UserId:   meta[OwnerMetaKey],
+		EntityId: meta["id"],
+	}
+}
+
+// stageResult turns the stage response into its status, the stages which
+// report a model.StageStatus body are taken as is.
+func stageResult(name string, res hooks.HookResponse) model.StageStatus {
+	var result model.StageStatus
+	if json.Unmarshal([]byte(res.HTTPResponse.Body), &result) == nil && result.Status != "" {
+		result.Stage = name
+		return result
+	}
+
+	result = model.StageStatus{Stage: name, Status: model.StatusDone}
+	if res.HTTPResponse.StatusCode > 399 {
+		result.Status = model.StatusFailed
+		result.Error = res.HTTPResponse.Body
+	}
+
+	return result
+}
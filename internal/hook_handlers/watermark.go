@@ -0,0 +1,172 @@
+package hook_handlers
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+
+	"codiewuploader/assets"
+	appConfig "codiewuploader/internal/config"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+	"golang.org/x/image/draw"
+)
+
+// Watermarks selects watermark profiles and applies them, decoded watermark
+// images are cached by source.
+type Watermarks struct {
+	config appConfig.WatermarkConfig
+	images sync.Map
+}
+
+func NewWatermarks(cfg appConfig.WatermarkConfig) *Watermarks {
+	return &Watermarks{
+		config: cfg,
+	}
+}
+
+// Validate loads images of all profiles, so a broken config fails on start.
+func (w *Watermarks) Validate() error {
+	for name, profile := range w.config.Profiles {
+		if profile.Image == "" {
+			continue
+		}
+
+		if _, err := w.image(profile.Image); err != nil {
+			return fmt.Errorf("watermark profile %q: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Profile picks the profile requested by the upload if it's selectable, then
+// the one configured for the bucket and falls back to the default.
+func (w *Watermarks) Profile(name, bucket string) (appConfig.WatermarkProfile, error) {
+	if name != "" && !slices.Contains(w.config.Selectable, name) {
+		slog.Warn("Watermark profile can't be selected by the upload, ignored", "profile", name)
+		name = ""
+	}
+	if name == "" {
+		name = w.config.Buckets[bucket]
+	}
+	if name == "" {
+		name = w.config.Default
+	}
+
+	profile, ok := w.config.Profiles[name]
+	if !ok {
+		return profile, fmt.Errorf("unknown watermark profile %q", name)
+	}
+
+	return profile, nil
+}
+
+// Apply draws the watermark of the profile over a copy of img.
+func (w *Watermarks) Apply(img image.Image, profile appConfig.WatermarkProfile) (*image.NRGBA, error) {
+	result := imaging.Clone(img)
+	if profile.Image == "" {
+		return result, nil
+	}
+
+	watermark, err := w.image(profile.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := result.Bounds()
+	scale := profile.Scale
+	if scale <= 0 {
+		scale = 1
+	}
+
+	// Размер водяного знака считаем от ширины или высоты картинки с сохранением пропорций
+	var wWidth, wHeight int
+	if profile.ScaleBy == "height" {
+		wHeight = int(float64(bounds.Dy()) * scale)
+		wWidth = int(float64(watermark.Bounds().Dx()) * float64(wHeight) / float64(watermark.Bounds().Dy()))
+	} else {
+		wWidth = int(float64(bounds.Dx()) * scale)
+		wHeight = int(float64(watermark.Bounds().Dy()) * float64(wWidth) / float64(watermark.Bounds().Dx()))
+	}
+	if wWidth < 1 || wHeight < 1 {
+		return result, nil
+	}
+
+	resized := imaging.Resize(watermark, wWidth, wHeight, imaging.Lanczos)
+
+	opacity := profile.Opacity
+	if opacity <= 0 || opacity > 1 {
+		opacity = 1
+	}
+	mask := image.NewUniform(color.Alpha{A: uint8(math.Round(opacity * 255))})
+
+	margin := int(float64(min(bounds.Dx(), bounds.Dy())) * profile.Margin)
+
+	if profile.Tile {
+		for y := margin; y < bounds.Dy(); y += wHeight + margin {
+			for x := margin; x < bounds.Dx(); x += wWidth + margin {
+				draw.DrawMask(result, image.Rect(x, y, x+wWidth, y+wHeight), resized, image.Point{}, mask, image.Point{}, draw.Over)
+			}
+		}
+		return result, nil
+	}
+
+	at := anchorPoint(profile.Anchor, bounds.Size(), image.Pt(wWidth, wHeight), margin)
+	draw.DrawMask(result, image.Rectangle{Min: at, Max: at.Add(image.Pt(wWidth, wHeight))}, resized, image.Point{}, mask, image.Point{}, draw.Over)
+
+	return result, nil
+}
+
+func (w *Watermarks) image(source string) (image.Image, error) {
+	if img, ok := w.images.Load(source); ok {
+		return img.(image.Image), nil
+	}
+
+	var file io.ReadCloser
+	var err error
+	if name, ok := strings.CutPrefix(source, "embed:"); ok {
+		file, err = assets.FS.Open(name)
+	} else {
+		file, err = os.Open(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("decode watermark %s: %w", source, err)
+	}
+
+	w.images.Store(source, img)
+	return img, nil
+}
+
+// anchorPoint returns the top-left corner of the watermark for the anchor
+func anchorPoint(anchor string, size, mark image.Point, margin int) image.Point {
+	x := (size.X - mark.X) / 2
+	y := (size.Y - mark.Y) / 2
+
+	if strings.Contains(anchor, "left") {
+		x = margin
+	} else if strings.Contains(anchor, "right") {
+		x = size.X - mark.X - margin
+	}
+
+	if strings.HasPrefix(anchor, "top") {
+		y = margin
+	} else if strings.HasPrefix(anchor, "bottom") {
+		y = size.Y - mark.Y - margin
+	}
+
+	return image.Pt(x, y)
+}
@@ -0,0 +1,114 @@
+package hook_handlers
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	appConfig "codiewuploader/internal/config"
+
+	"github.com/disintegration/imaging"
+)
+
+func testWatermarkConfig() appConfig.WatermarkConfig {
+	cfg := appConfig.DefaultWatermarkConfig()
+	cfg.Profiles["corner"] = appConfig.WatermarkProfile{Image: appConfig.DefaultWatermarkImage, Anchor: "bottom-right", Scale: 0.2}
+	cfg.Profiles["tenant"] = appConfig.WatermarkProfile{Image: appConfig.DefaultWatermarkImage, Scale: 0.5}
+	cfg.Selectable = []string{"default", "corner"}
+	cfg.Buckets = map[string]string{"tenant_result": "tenant"}
+
+	return cfg
+}
+
+func TestWatermarkProfile(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested string
+		bucket    string
+		want      string
+		wantErr   bool
+	}{
+		{name: "default", want: "default"},
+		{name: "selectable", requested: "corner", want: "corner"},
+		{name: "bucket", bucket: "tenant_result", want: "tenant"},
+		{name: "requested wins over bucket", requested: "corner", bucket: "tenant_result", want: "corner"},
+		// Клиент не может снять водяной знак или выбрать чужой профиль
+		{name: "none ignored", requested: "none", want: "default"},
+		{name: "not selectable ignored", requested: "tenant", want: "default"},
+		{name: "not selectable falls back to bucket", requested: "none", bucket: "tenant_result", want: "tenant"},
+		{name: "unknown ignored", requested: "missing", want: "default"},
+	}
+
+	w := NewWatermarks(testWatermarkConfig())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile, err := w.Profile(tt.requested, tt.bucket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := testWatermarkConfig().Profiles[tt.want]; profile != want {
+				t.Errorf("profile = %+v, want %s %+v", profile, tt.want, want)
+			}
+		})
+	}
+
+	t.Run("broken default", func(t *testing.T) {
+		cfg := testWatermarkConfig()
+		cfg.Default = "missing"
+		if _, err := NewWatermarks(cfg).Profile("", ""); err == nil {
+			t.Error("unknown default profile accepted")
+		}
+	})
+}
+
+func TestWatermarksValidate(t *testing.T) {
+	if err := NewWatermarks(testWatermarkConfig()).Validate(); err != nil {
+		t.Errorf("embedded watermark: %v", err)
+	}
+
+	for _, source := range []string{"embed:missing.png", "/nonexistent/watermark.png"} {
+		cfg := testWatermarkConfig()
+		cfg.Profiles["broken"] = appConfig.WatermarkProfile{Image: source}
+		if err := NewWatermarks(cfg).Validate(); err == nil {
+			t.Errorf("%s: broken profile passed validation", source)
+		}
+	}
+}
+
+func TestWatermarkApply(t *testing.T) {
+	w := NewWatermarks(testWatermarkConfig())
+	img := imaging.New(400, 300, color.White)
+
+	none, err := w.Apply(img, appConfig.WatermarkProfile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if none.Bounds() != img.Bounds() || none.At(200, 150) != img.At(200, 150) {
+		t.Error("profile without image changed the picture")
+	}
+
+	corner, err := w.Apply(img, testWatermarkConfig().Profiles["corner"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed(img, corner, image.Rect(320, 240, 400, 300)) {
+		t.Error("bottom-right watermark isn't in the corner")
+	}
+	if changed(img, corner, image.Rect(0, 0, 200, 150)) {
+		t.Error("bottom-right watermark covers the top-left")
+	}
+}
+
+func changed(a, b image.Image, rect image.Rectangle) bool {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			r1, g1, b1, _ := a.At(x, y).RGBA()
+			r2, g2, b2, _ := b.At(x, y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
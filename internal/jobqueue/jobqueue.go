@@ -0,0 +1,369 @@
+package jobqueue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"codiewuploader/internal/utils"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/exp/slog"
+)
+
+var reUnsafeKey = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+var MetricsJobsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "tusd_jobs_total",
+		Help: "Total number of processed background jobs per kind and result (done, retry, dead).",
+	},
+	[]string{"kind", "result"},
+)
+
+// Job is a unit of work which is kept on disk until it is done or dead.
+type Job struct {
+	Key       string          `json:"key"`
+	Kind      string          `json:"kind"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"lastError,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	NextRunAt time.Time       `json:"nextRunAt"`
+}
+
+// HandlerFunc processes a job. Returning an error schedules a retry, unless
+// it's wrapped with Permanent.
+type HandlerFunc func(ctx context.Context, job Job) error
+
+type Config struct {
+	// Dir keeps the pending/ and dead/ job files
+	Dir          string
+	Workers      int
+	MaxAttempts  int
+	BaseBackoff  time.Duration
+	MaxBackoff   time.Duration
+	PollInterval time.Duration
+}
+
+// Queue is a durable job queue backed by one JSON file per job. A job which
+// was running when the process died is picked up again on the next start.
+// The files are only read in New, afterwards the queue works from memory and
+// writes every change through to disk.
+type Queue struct {
+	config  Config
+	handler HandlerFunc
+
+	mu      sync.Mutex
+	pending map[string]Job
+	dead    map[string]struct{}
+	running map[string]struct{}
+	wake    chan struct{}
+	jobs    chan Job
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks the error as not worth retrying, the job goes straight to
+// the dead-letter directory.
+func Permanent(err error) error {
+	return permanentError{err: err}
+}
+
+// IsPermanent tells whether the error was marked with Permanent
+func IsPermanent(err error) bool {
+	var permanent permanentError
+	return errors.As(err, &permanent)
+}
+
+func New(config Config, handler HandlerFunc) (*Queue, error) {
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
+	if config.MaxAttempts < 1 {
+		config.MaxAttempts = 1
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = time.Second
+	}
+
+	for _, dir := range []string{config.pendingDir(), config.deadDir()} {
+		if err := os.MkdirAll(dir, os.FileMode(0774)); err != nil {
+			return nil, err
+		}
+	}
+
+	q := &Queue{
+		config:  config,
+		handler: handler,
+		pending: make(map[string]Job),
+		dead:    make(map[string]struct{}),
+		running: make(map[string]struct{}),
+		wake:    make(chan struct{}, 1),
+		jobs:    make(chan Job),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// load reads the jobs left by the previous run.
+func (q *Queue) load() error {
+	entries, err := os.ReadDir(q.config.pendingDir())
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		key, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+
+		job, err := readJob(q.config.pendingPath(key))
+		if err != nil {
+			slog.Error("JobQueueBrokenJob", "key", key, "err", err.Error())
+			continue
+		}
+		q.pending[key] = job
+	}
+
+	entries, err = os.ReadDir(q.config.deadDir())
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if key, ok := strings.CutSuffix(entry.Name(), ".json"); ok {
+			q.dead[key] = struct{}{}
+		}
+	}
+
+	return nil
+}
+
+// Start runs the dispatcher and workers until ctx is cancelled.
+func (q *Queue) Start(ctx context.Context) {
+	for i := 0; i < q.config.Workers; i++ {
+		go q.work(ctx)
+	}
+
+	go q.dispatch(ctx)
+}
+
+// Enqueue stores the job under the key. The key makes enqueueing idempotent:
+// if a job with the same key is already pending or dead, nothing is added and
+// false is returned.
+func (q *Queue) Enqueue(key, kind string, payload any) (bool, error) {
+	key = reUnsafeKey.ReplaceAllString(key, "_")
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return false, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.pending[key]; ok {
+		return false, nil
+	}
+	if _, ok := q.dead[key]; ok {
+		return false, nil
+	}
+
+	now := time.Now().UTC()
+	job := Job{
+		Key:       key,
+		Kind:      kind,
+		Payload:   data,
+		CreatedAt: now,
+		NextRunAt: now,
+	}
+
+	if err := writeJob(q.config.pendingPath(key), job); err != nil {
+		return false, err
+	}
+	q.pending[key] = job
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return true, nil
+}
+
+func (q *Queue) dispatch(ctx context.Context) {
+	ticker := time.NewTicker(q.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, job := range q.dueJobs() {
+			select {
+			case q.jobs <- job:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+// dueJobs returns the pending jobs whose time has come, oldest first, and
+// marks them as running.
+func (q *Queue) dueJobs() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	var due []Job
+	for key, job := range q.pending {
+		if _, ok := q.running[key]; ok {
+			continue
+		}
+		if job.NextRunAt.After(now) {
+			continue
+		}
+
+		q.running[key] = struct{}{}
+		due = append(due, job)
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].CreatedAt.Equal(due[j].CreatedAt) {
+			return due[i].CreatedAt.Before(due[j].CreatedAt)
+		}
+		return due[i].Key < due[j].Key
+	})
+
+	return due
+}
+
+func (q *Queue) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-q.jobs:
+			q.finish(job, q.handler(ctx, job))
+		}
+	}
+}
+
+// finish removes a done job, schedules a retry with exponential backoff or
+// moves the job to the dead-letter directory.
+func (q *Queue) finish(job Job, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer delete(q.running, job.Key)
+
+	pendingPath := q.config.pendingPath(job.Key)
+
+	if err == nil {
+		MetricsJobsTotal.WithLabelValues(job.Kind, "done").Inc()
+		delete(q.pending, job.Key)
+		if err := os.Remove(pendingPath); err != nil {
+			slog.Error("JobQueueRemoveError", "key", job.Key, "err", err.Error())
+		}
+		return
+	}
+
+	job.Attempts++
+	job.LastError = err.Error()
+
+	if IsPermanent(err) || job.Attempts >= q.config.MaxAttempts {
+		MetricsJobsTotal.WithLabelValues(job.Kind, "dead").Inc()
+		slog.Error("JobDead", "key", job.Key, "kind", job.Kind, "attempts", job.Attempts, "err", job.LastError)
+
+		if err := writeJob(q.config.deadPath(job.Key), job); err != nil {
+			slog.Error("JobQueueWriteError", "key", job.Key, "err", err.Error())
+			return
+		}
+		delete(q.pending, job.Key)
+		q.dead[job.Key] = struct{}{}
+		if err := os.Remove(pendingPath); err != nil {
+			slog.Error("JobQueueRemoveError", "key", job.Key, "err", err.Error())
+		}
+		return
+	}
+
+	job.NextRunAt = time.Now().UTC().Add(q.backoff(job.Attempts))
+	MetricsJobsTotal.WithLabelValues(job.Kind, "retry").Inc()
+	slog.Warn("JobRetry", "key", job.Key, "kind", job.Kind, "attempts", job.Attempts, "nextRunAt", job.NextRunAt, "err", job.LastError)
+
+	// Повтор планируем и при ошибке записи, файл догонит при следующей попытке
+	q.pending[job.Key] = job
+	if err := writeJob(pendingPath, job); err != nil {
+		slog.Error("JobQueueWriteError", "key", job.Key, "err", err.Error())
+	}
+}
+
+func (q *Queue) backoff(attempts int) time.Duration {
+	backoff := time.Duration(float64(q.config.BaseBackoff) * math.Pow(2, float64(attempts-1)))
+	if q.config.MaxBackoff > 0 && (backoff > q.config.MaxBackoff || backoff <= 0) {
+		backoff = q.config.MaxBackoff
+	}
+
+	return backoff
+}
+
+func (c Config) pendingDir() string {
+	return filepath.Join(c.Dir, "pending")
+}
+
+func (c Config) deadDir() string {
+	return filepath.Join(c.Dir, "dead")
+}
+
+func (c Config) pendingPath(key string) string {
+	return filepath.Join(c.pendingDir(), key+".json")
+}
+
+func (c Config) deadPath(key string) string {
+	return filepath.Join(c.deadDir(), key+".json")
+}
+
+func readJob(path string) (Job, error) {
+	var job Job
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return job, err
+	}
+
+	if err := json.Unmarshal(data, &job); err != nil {
+		return job, fmt.Errorf("invalid job file %s: %w", path, err)
+	}
+
+	return job, nil
+}
+
+func writeJob(path string, job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	return utils.WriteFileAtomic(path, data)
+}
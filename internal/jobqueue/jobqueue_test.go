@@ -0,0 +1,259 @@
+package jobqueue
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestQueue(t *testing.T, config Config, handler HandlerFunc) *Queue {
+	t.Helper()
+
+	config.Dir = t.TempDir()
+	q, err := New(config, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return q
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     time.Duration
+		max      time.Duration
+		attempts int
+		want     time.Duration
+	}{
+		{name: "first retry", base: time.Second, attempts: 1, want: time.Second},
+		{name: "doubles", base: time.Second, attempts: 3, want: 4 * time.Second},
+		{name: "capped", base: time.Second, max: 5 * time.Second, attempts: 4, want: 5 * time.Second},
+		{name: "below cap", base: time.Second, max: 5 * time.Second, attempts: 2, want: 2 * time.Second},
+		{name: "overflow capped", base: time.Second, max: time.Hour, attempts: 200, want: time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &Queue{config: Config{BaseBackoff: tt.base, MaxBackoff: tt.max}}
+			if got := q.backoff(tt.attempts); got != tt.want {
+				t.Errorf("backoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnqueueIdempotent(t *testing.T) {
+	q := newTestQueue(t, Config{}, nil)
+
+	added, err := q.Enqueue("move-1", "move", map[string]string{"id": "1"})
+	if err != nil || !added {
+		t.Fatalf("first Enqueue = %v, %v, want added", added, err)
+	}
+
+	added, err = q.Enqueue("move-1", "move", map[string]string{"id": "other"})
+	if err != nil || added {
+		t.Fatalf("repeated Enqueue = %v, %v, want not added", added, err)
+	}
+
+	job, err := readJob(q.config.pendingPath("move-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(job.Payload) != `{"id":"1"}` {
+		t.Errorf("payload = %s, want the first one", job.Payload)
+	}
+
+	// Мертвая задача тоже занимает ключ
+	q.finish(job, Permanent(errors.New("broken")))
+	added, err = q.Enqueue("move-1", "move", nil)
+	if err != nil || added {
+		t.Fatalf("Enqueue after dead = %v, %v, want not added", added, err)
+	}
+
+	// Небезопасные символы ключа не выводят файл из каталога
+	added, err = q.Enqueue("../move/2", "move", nil)
+	if err != nil || !added {
+		t.Fatalf("Enqueue unsafe key = %v, %v, want added", added, err)
+	}
+	if !exists(q.config.pendingPath(".._move_2")) {
+		t.Error("unsafe key wasn't sanitized")
+	}
+}
+
+func TestFinish(t *testing.T) {
+	transient := errors.New("timeout")
+
+	tests := []struct {
+		name        string
+		attempts    int
+		err         error
+		wantPending bool
+		wantDead    bool
+		wantRetry   bool
+	}{
+		{name: "done", err: nil},
+		{name: "retry", err: transient, wantPending: true, wantRetry: true},
+		{name: "last attempt", attempts: 2, err: transient, wantDead: true},
+		{name: "permanent", err: Permanent(transient), wantDead: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQueue(t, Config{MaxAttempts: 3, BaseBackoff: time.Minute}, nil)
+
+			if _, err := q.Enqueue("job", "test", nil); err != nil {
+				t.Fatal(err)
+			}
+			job, err := readJob(q.config.pendingPath("job"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			job.Attempts = tt.attempts
+
+			q.finish(job, tt.err)
+
+			if got := exists(q.config.pendingPath("job")); got != tt.wantPending {
+				t.Errorf("pending = %v, want %v", got, tt.wantPending)
+			}
+			if got := exists(q.config.deadPath("job")); got != tt.wantDead {
+				t.Errorf("dead = %v, want %v", got, tt.wantDead)
+			}
+
+			if tt.wantRetry {
+				retried, err := readJob(q.config.pendingPath("job"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if retried.Attempts != tt.attempts+1 || retried.LastError != transient.Error() {
+					t.Errorf("retried job = %+v, want one more attempt", retried)
+				}
+				if until := time.Until(retried.NextRunAt); until < 50*time.Second {
+					t.Errorf("next run in %s, want the backoff", until)
+				}
+				if len(q.dueJobs()) != 0 {
+					t.Error("retried job is due before its backoff")
+				}
+			}
+
+			if tt.wantDead {
+				dead, err := readJob(q.config.deadPath("job"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if dead.LastError != transient.Error() {
+					t.Errorf("dead job error = %q, want %q", dead.LastError, transient)
+				}
+			}
+		})
+	}
+}
+
+func TestQueueRetriesUntilDone(t *testing.T) {
+	var calls atomic.Int32
+	done := make(chan struct{})
+
+	q := newTestQueue(t, Config{
+		MaxAttempts:  5,
+		BaseBackoff:  time.Millisecond,
+		PollInterval: 5 * time.Millisecond,
+	}, func(ctx context.Context, job Job) error {
+		if calls.Add(1) < 3 {
+			return errors.New("not yet")
+		}
+		close(done)
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.Start(ctx)
+
+	if _, err := q.Enqueue("job", "test", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("job wasn't done, %d calls", calls.Load())
+	}
+
+	// finish удаляет файл сразу после возврата из обработчика
+	deadline := time.Now().Add(time.Second)
+	for exists(q.config.pendingPath("job")) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if exists(q.config.pendingPath("job")) || exists(q.config.deadPath("job")) {
+		t.Error("done job is still on disk")
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("calls = %d, want 3", got)
+	}
+}
+
+func TestNewLoadsJobs(t *testing.T) {
+	q := newTestQueue(t, Config{MaxAttempts: 3, BaseBackoff: time.Hour}, nil)
+
+	for _, key := range []string{"due", "retry", "dead"} {
+		if _, err := q.Enqueue(key, "test", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.finish(q.pending["retry"], errors.New("timeout"))
+	q.finish(q.pending["dead"], Permanent(errors.New("broken")))
+	if err := os.WriteFile(q.config.pendingPath("broken"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := New(q.config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reopened.pending) != 2 {
+		t.Fatalf("pending = %v, want due and retry", reopened.pending)
+	}
+	if retry := reopened.pending["retry"]; retry.Attempts != 1 || time.Until(retry.NextRunAt) < 50*time.Minute {
+		t.Errorf("retry = %+v, want its backoff kept", retry)
+	}
+	if added, err := reopened.Enqueue("dead", "test", nil); err != nil || added {
+		t.Errorf("Enqueue of a dead key = %v, %v, want not added", added, err)
+	}
+
+	due := reopened.dueJobs()
+	if len(due) != 1 || due[0].Key != "due" {
+		t.Errorf("due = %+v, want only the job without backoff", due)
+	}
+}
+
+func TestDueJobsFromMemory(t *testing.T) {
+	q := newTestQueue(t, Config{}, nil)
+
+	for _, key := range []string{"first", "second"} {
+		if _, err := q.Enqueue(key, "test", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// После старта каталог не перечитывается
+	if err := os.RemoveAll(q.config.pendingDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	due := q.dueJobs()
+	if len(due) != 2 || due[0].Key != "first" || due[1].Key != "second" {
+		t.Fatalf("due = %+v, want both jobs, oldest first", due)
+	}
+	if len(q.dueJobs()) != 0 {
+		t.Error("running jobs are due again")
+	}
+}
@@ -1,10 +1,170 @@
 package model
 
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/tus/tusd/v2/pkg/hooks"
+)
+
 type Profile struct {
 	Id int `json:"id"`
 }
 
 type MediaRecord struct {
-	Src  string `json:"src"`
-	Type string `json:"type"`
+	Src        string      `json:"src"`
+	Type       string      `json:"type"`
+	Original   string      `json:"original,omitempty"`
+	Ordinal    int         `json:"ordinal,omitempty"`
+	Renditions []Rendition `json:"renditions,omitempty"`
+	// Alternates maps a content type (image/webp, image/avif) to the object key
+	Alternates map[string]string `json:"alternates,omitempty"`
+}
+
+// Rendition is a resized copy of an image
+type Rendition struct {
+	Name       string            `json:"name"`
+	Src        string            `json:"src"`
+	Width      int               `json:"width"`
+	Height     int               `json:"height"`
+	Alternates map[string]string `json:"alternates,omitempty"`
+}
+
+// Manifest lists all processed media of an entity, stored as {entityId}/manifest.json.
+// For multi records RecordId, Expected and Complete describe the last merged batch.
+type Manifest struct {
+	EntityId  string        `json:"entityId"`
+	RecordId  string        `json:"recordId,omitempty"`
+	Expected  int           `json:"expected,omitempty"`
+	Complete  bool          `json:"complete,omitempty"`
+	Media     []MediaRecord `json:"media"`
+	UpdatedAt time.Time     `json:"updatedAt"`
+}
+
+// Keys lists the objects of the record: the source, the original, the
+// renditions and all their alternate formats
+func (r MediaRecord) Keys() []string {
+	keys := []string{r.Src}
+	if r.Original != "" && r.Original != r.Src {
+		keys = append(keys, r.Original)
+	}
+	keys = appendAlternates(keys, r.Alternates)
+	for _, rendition := range r.Renditions {
+		keys = append(keys, rendition.Src)
+		keys = appendAlternates(keys, rendition.Alternates)
+	}
+
+	return keys
+}
+
+// appendAlternates adds the keys in the order of their content types
+func appendAlternates(keys []string, alternates map[string]string) []string {
+	contentTypes := make([]string, 0, len(alternates))
+	for contentType := range alternates {
+		contentTypes = append(contentTypes, contentType)
+	}
+	sort.Strings(contentTypes)
+
+	for _, contentType := range contentTypes {
+		keys = append(keys, alternates[contentType])
+	}
+
+	return keys
+}
+
+// Upsert replaces the record with the same Src or appends a new one
+func (m *Manifest) Upsert(record MediaRecord) {
+	for i := range m.Media {
+		if m.Media[i].Src == record.Src {
+			m.Media[i] = record
+			return
+		}
+	}
+
+	m.Media = append(m.Media, record)
+}
+
+// UpsertOrdinal replaces the record with the same Ordinal or adds a new one,
+// the records stay sorted by Ordinal. Used for the files of a multi record.
+func (m *Manifest) UpsertOrdinal(record MediaRecord) {
+	for i := range m.Media {
+		if m.Media[i].Ordinal == record.Ordinal {
+			m.Media[i] = record
+			return
+		}
+	}
+
+	m.Media = append(m.Media, record)
+	sort.SliceStable(m.Media, func(i, j int) bool {
+		return m.Media[i].Ordinal < m.Media[j].Ordinal
+	})
+}
+
+// StageStatus is the outcome of a single processing stage for an upload
+type StageStatus struct {
+	Stage  string `json:"stage"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Output string `json:"output,omitempty"`
+	// Keys are the objects the stage has written
+	Keys      []string  `json:"keys,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt,omitempty"`
+}
+
+const (
+	StatusPending     = "pending"
+	StatusRunning     = "running"
+	StatusDone        = "done"
+	StatusFailed      = "failed"
+	StatusSkipped     = "skipped"
+	StatusQuarantined = "quarantined"
+	// StatusRejected means the stage refused the upload by its policy, e.g.
+	// a file too large to be scanned
+	StatusRejected = "rejected"
+)
+
+// Respond writes the status of the stage as the JSON body of its hook
+// response. Quarantined and rejected uploads get a 422, failed ones a 500.
+func (s StageStatus) Respond(res *hooks.HookResponse, stage string) {
+	s.Stage = stage
+
+	body, _ := json.Marshal(s)
+	res.HTTPResponse.Body = string(body)
+	res.HTTPResponse.Header = map[string]string{"Content-Type": "application/json"}
+
+	switch s.Status {
+	case StatusQuarantined, StatusRejected:
+		res.HTTPResponse.StatusCode = 422
+	case StatusFailed:
+		res.HTTPResponse.StatusCode = 500
+	}
+}
+
+// QuarantineReport is stored next to a quarantined upload and tells why it
+// was taken out of processing
+type QuarantineReport struct {
+	UploadId     string            `json:"uploadId"`
+	Stage        string            `json:"stage"`
+	Reason       string            `json:"reason"`
+	DeclaredType string            `json:"declaredType,omitempty"`
+	DetectedType string            `json:"detectedType,omitempty"`
+	MetaData     map[string]string `json:"metaData"`
+	CreatedAt    time.Time         `json:"createdAt"`
+}
+
+// HookReply is the JSON body the composite hook handler responds with. Error
+// is the reason of the stage which decided the status code.
+type HookReply struct {
+	Error  string       `json:"error,omitempty"`
+	Stages []StageReply `json:"stages"`
+}
+
+// StageReply is the response of a single stage. Body holds the stage's JSON
+// response, plain text responses go to Message.
+type StageReply struct {
+	Stage      string          `json:"stage"`
+	StatusCode int             `json:"statusCode,omitempty"`
+	Body       json.RawMessage `json:"body,omitempty"`
+	Message    string          `json:"message,omitempty"`
 }
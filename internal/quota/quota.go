@@ -0,0 +1,348 @@
+package quota
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"codiewuploader/internal/utils"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	ScopeUser   = "user"
+	ScopeEntity = "entity"
+)
+
+// MetricsQuotaUsage is the usage summed over all users or entities, a label
+// per id would grow with every user.
+var MetricsQuotaUsage = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "tusd_quota_usage",
+		Help: "Current quota usage summed per scope (user, entity) and kind (bytes, files, in_progress).",
+	},
+	[]string{"scope", "kind"},
+)
+
+// Limits are the upper bounds per user or entity, zero means unlimited.
+type Limits struct {
+	Bytes      int64 `json:"bytes"`
+	Files      int64 `json:"files"`
+	InProgress int64 `json:"inProgress"`
+}
+
+type Usage struct {
+	Bytes      int64 `json:"bytes"`
+	Files      int64 `json:"files"`
+	InProgress int64 `json:"inProgress"`
+}
+
+// Reservation is the usage taken by an upload at creation. It's kept until
+// the upload is finished, terminated or abandoned for too long.
+type Reservation struct {
+	User      string    `json:"user"`
+	Entity    string    `json:"entity"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+	// ActiveAt is the last time the upload received data, zero until then
+	ActiveAt time.Time `json:"activeAt,omitempty"`
+}
+
+// lastActivity is the time the TTL of the reservation counts from
+func (r Reservation) lastActivity() time.Time {
+	if r.ActiveAt.After(r.CreatedAt) {
+		return r.ActiveAt
+	}
+
+	return r.CreatedAt
+}
+
+// ExceededError tells which limit the upload would break.
+type ExceededError struct {
+	Scope string
+	Kind  string
+	Used  int64
+	Limit int64
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("%s quota exceeded: %s %d of %d", e.Scope, e.Kind, e.Used, e.Limit)
+}
+
+type Config struct {
+	// Path of the JSON file keeping the usage between restarts
+	Path           string
+	User           Limits
+	Entity         Limits
+	ReservationTTL time.Duration
+}
+
+type state struct {
+	Users        map[string]*Usage      `json:"users"`
+	Entities     map[string]*Usage      `json:"entities"`
+	Reservations map[string]Reservation `json:"reservations"`
+}
+
+// Store tracks the usage per user and entity.
+type Store struct {
+	config Config
+
+	mu    sync.Mutex
+	state state
+}
+
+func Open(config Config) (*Store, error) {
+	s := &Store{
+		config: config,
+		state: state{
+			Users:        make(map[string]*Usage),
+			Entities:     make(map[string]*Usage),
+			Reservations: make(map[string]Reservation),
+		},
+	}
+
+	data, err := os.ReadFile(config.Path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.state); err != nil {
+			return nil, fmt.Errorf("invalid quota file %s: %w", config.Path, err)
+		}
+	}
+
+	for _, scope := range []string{ScopeUser, ScopeEntity} {
+		total := Usage{}
+		for _, usage := range s.usages(scope) {
+			total.Bytes += usage.Bytes
+			total.Files += usage.Files
+			total.InProgress += usage.InProgress
+		}
+		s.report(scope, total)
+	}
+
+	return s, nil
+}
+
+// Limits returns the configured limits of the scope
+func (s *Store) Limits(scope string) Limits {
+	if scope == ScopeEntity {
+		return s.config.Entity
+	}
+
+	return s.config.User
+}
+
+// Usage returns the current usage of the user or entity
+func (s *Store) Usage(scope, id string) Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if usage := s.usages(scope)[id]; usage != nil {
+		return *usage
+	}
+
+	return Usage{}
+}
+
+// Reserve checks the limits of the user and the entity and takes the usage
+// for a new upload of the given size. The returned id is passed to Complete
+// or Release later.
+func (s *Store) Reserve(user, entity string, size int64) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(time.Now())
+
+	if err := check(ScopeUser, s.state.Users[user], s.config.User, size); err != nil {
+		return "", err
+	}
+	if entity != "" {
+		if err := check(ScopeEntity, s.state.Entities[entity], s.config.Entity, size); err != nil {
+			return "", err
+		}
+	}
+
+	id, err := newReservationId()
+	if err != nil {
+		return "", err
+	}
+
+	reservation := Reservation{User: user, Entity: entity, Size: size, CreatedAt: time.Now().UTC()}
+	s.state.Reservations[id] = reservation
+	s.apply(reservation, Usage{Bytes: size, Files: 1, InProgress: 1})
+
+	if err := s.save(); err != nil {
+		// Без записи на диск резерв потеряется при рестарте, откатываем
+		delete(s.state.Reservations, id)
+		s.apply(reservation, Usage{Bytes: -size, Files: -1, InProgress: -1})
+		return "", err
+	}
+
+	return id, nil
+}
+
+// Touch marks the reservation as active, so a resumable upload which keeps
+// receiving data doesn't expire however long it takes. To spare the disk the
+// file is only written once a tenth of the TTL has passed since the last
+// write. Unknown reservations are ignored.
+func (s *Store) Touch(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reservation, ok := s.state.Reservations[id]
+	if !ok || s.config.ReservationTTL <= 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	if now.Sub(reservation.lastActivity()) < s.config.ReservationTTL/10 {
+		return nil
+	}
+
+	reservation.ActiveAt = now
+	s.state.Reservations[id] = reservation
+
+	return s.save()
+}
+
+// Complete frees the in-progress slot of a finished upload, its bytes and
+// file stay counted. Unknown reservations are ignored.
+func (s *Store) Complete(id string) error {
+	return s.finish(id, func(r Reservation) Usage {
+		return Usage{InProgress: -1}
+	})
+}
+
+// Release gives back everything taken by a terminated upload.
+func (s *Store) Release(id string) error {
+	return s.finish(id, func(r Reservation) Usage {
+		return Usage{Bytes: -r.Size, Files: -1, InProgress: -1}
+	})
+}
+
+func (s *Store) finish(id string, delta func(Reservation) Usage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reservation, ok := s.state.Reservations[id]
+	if !ok {
+		return nil
+	}
+
+	delete(s.state.Reservations, id)
+	s.apply(reservation, delta(reservation))
+
+	return s.save()
+}
+
+// expire releases reservations of uploads which received no data for the TTL
+func (s *Store) expire(now time.Time) {
+	if s.config.ReservationTTL <= 0 {
+		return
+	}
+
+	for id, reservation := range s.state.Reservations {
+		if now.Sub(reservation.lastActivity()) > s.config.ReservationTTL {
+			delete(s.state.Reservations, id)
+			s.apply(reservation, Usage{Bytes: -reservation.Size, Files: -1, InProgress: -1})
+		}
+	}
+}
+
+func (s *Store) apply(r Reservation, delta Usage) {
+	s.add(ScopeUser, r.User, delta)
+	if r.Entity != "" {
+		s.add(ScopeEntity, r.Entity, delta)
+	}
+}
+
+func (s *Store) add(scope, id string, delta Usage) {
+	usages := s.usages(scope)
+
+	usage := usages[id]
+	if usage == nil {
+		usage = &Usage{}
+		usages[id] = usage
+	}
+
+	before := *usage
+	usage.Bytes = max(usage.Bytes+delta.Bytes, 0)
+	usage.Files = max(usage.Files+delta.Files, 0)
+	usage.InProgress = max(usage.InProgress+delta.InProgress, 0)
+
+	if *usage == (Usage{}) {
+		delete(usages, id)
+	}
+
+	s.reportChange(scope, Usage{
+		Bytes:      usage.Bytes - before.Bytes,
+		Files:      usage.Files - before.Files,
+		InProgress: usage.InProgress - before.InProgress,
+	})
+}
+
+func (s *Store) usages(scope string) map[string]*Usage {
+	if scope == ScopeEntity {
+		return s.state.Entities
+	}
+
+	return s.state.Users
+}
+
+// report sets the gauges of the scope to the total usage
+func (s *Store) report(scope string, total Usage) {
+	MetricsQuotaUsage.WithLabelValues(scope, "bytes").Set(float64(total.Bytes))
+	MetricsQuotaUsage.WithLabelValues(scope, "files").Set(float64(total.Files))
+	MetricsQuotaUsage.WithLabelValues(scope, "in_progress").Set(float64(total.InProgress))
+}
+
+// reportChange moves the gauges of the scope by the change of one usage
+func (s *Store) reportChange(scope string, delta Usage) {
+	MetricsQuotaUsage.WithLabelValues(scope, "bytes").Add(float64(delta.Bytes))
+	MetricsQuotaUsage.WithLabelValues(scope, "files").Add(float64(delta.Files))
+	MetricsQuotaUsage.WithLabelValues(scope, "in_progress").Add(float64(delta.InProgress))
+}
+
+func (s *Store) save() error {
+	data, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+
+	return utils.WriteFileAtomic(s.config.Path, data)
+}
+
+func check(scope string, usage *Usage, limits Limits, size int64) error {
+	if usage == nil {
+		usage = &Usage{}
+	}
+
+	if limits.Bytes > 0 && usage.Bytes+size > limits.Bytes {
+		return &ExceededError{Scope: scope, Kind: "bytes", Used: usage.Bytes, Limit: limits.Bytes}
+	}
+	if limits.Files > 0 && usage.Files+1 > limits.Files {
+		return &ExceededError{Scope: scope, Kind: "files", Used: usage.Files, Limit: limits.Files}
+	}
+	if limits.InProgress > 0 && usage.InProgress+1 > limits.InProgress {
+		return &ExceededError{Scope: scope, Kind: "inProgress", Used: usage.InProgress, Limit: limits.InProgress}
+	}
+
+	return nil
+}
+
+func newReservationId() (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return strconv.FormatInt(time.Now().Unix(), 36) + hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,251 @@
+package quota
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func openTestStore(t *testing.T, config Config) *Store {
+	t.Helper()
+
+	config.Path = filepath.Join(t.TempDir(), "quota.json")
+	s, err := Open(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestReserveLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    Config
+		existing  []int64
+		entity    string
+		size      int64
+		wantScope string
+		wantKind  string
+	}{
+		{name: "unlimited", existing: []int64{100, 100}, size: 100},
+		{name: "bytes fit", config: Config{User: Limits{Bytes: 100}}, existing: []int64{60}, size: 40},
+		{name: "bytes exceeded", config: Config{User: Limits{Bytes: 100}}, existing: []int64{60}, size: 41, wantScope: ScopeUser, wantKind: "bytes"},
+		{name: "files exceeded", config: Config{User: Limits{Files: 2}}, existing: []int64{1, 1}, size: 1, wantScope: ScopeUser, wantKind: "files"},
+		{name: "in progress exceeded", config: Config{User: Limits{InProgress: 1}}, existing: []int64{1}, size: 1, wantScope: ScopeUser, wantKind: "inProgress"},
+		{name: "entity exceeded", config: Config{Entity: Limits{Bytes: 10}}, existing: []int64{8}, entity: "e1", size: 3, wantScope: ScopeEntity, wantKind: "bytes"},
+		{name: "other entity", config: Config{Entity: Limits{Bytes: 10}}, existing: []int64{8}, entity: "e2", size: 3},
+		{name: "no entity", config: Config{Entity: Limits{Bytes: 10}}, existing: []int64{8}, size: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := openTestStore(t, tt.config)
+			for _, size := range tt.existing {
+				if _, err := s.Reserve("u1", "e1", size); err != nil {
+					t.Fatalf("existing reservation: %v", err)
+				}
+			}
+			before := s.Usage(ScopeUser, "u1")
+
+			_, err := s.Reserve("u1", tt.entity, tt.size)
+			if tt.wantScope == "" {
+				if err != nil {
+					t.Fatalf("Reserve: %v", err)
+				}
+				return
+			}
+
+			var exceeded *ExceededError
+			if !errors.As(err, &exceeded) {
+				t.Fatalf("err = %v, want ExceededError", err)
+			}
+			if exceeded.Scope != tt.wantScope || exceeded.Kind != tt.wantKind {
+				t.Errorf("exceeded %s %s, want %s %s", exceeded.Scope, exceeded.Kind, tt.wantScope, tt.wantKind)
+			}
+			if after := s.Usage(ScopeUser, "u1"); after != before {
+				t.Errorf("usage = %+v after a refused reservation, want %+v", after, before)
+			}
+		})
+	}
+}
+
+func TestCompleteAndRelease(t *testing.T) {
+	s := openTestStore(t, Config{})
+
+	first, err := s.Reserve("u1", "e1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.Reserve("u1", "e1", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := s.Usage(ScopeEntity, "e1"), (Usage{Bytes: 15, Files: 2, InProgress: 2}); got != want {
+		t.Fatalf("entity usage = %+v, want %+v", got, want)
+	}
+
+	// Завершенная загрузка остается в квоте, прерванная возвращает все
+	if err := s.Complete(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Release(second); err != nil {
+		t.Fatal(err)
+	}
+
+	want := Usage{Bytes: 10, Files: 1}
+	if got := s.Usage(ScopeUser, "u1"); got != want {
+		t.Errorf("user usage = %+v, want %+v", got, want)
+	}
+	if got := s.Usage(ScopeEntity, "e1"); got != want {
+		t.Errorf("entity usage = %+v, want %+v", got, want)
+	}
+
+	// Повторный и неизвестный резерв ничего не меняют
+	for _, id := range []string{first, second, "unknown"} {
+		if err := s.Release(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := s.Usage(ScopeUser, "u1"); got != want {
+		t.Errorf("user usage after repeated release = %+v, want %+v", got, want)
+	}
+}
+
+func TestReleaseRemovesEmptyUsage(t *testing.T) {
+	s := openTestStore(t, Config{})
+
+	id, err := s.Reserve("u1", "e1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Release(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.state.Users) != 0 || len(s.state.Entities) != 0 {
+		t.Errorf("state = %+v, want empty usages removed", s.state)
+	}
+}
+
+func TestReservationsPersisted(t *testing.T) {
+	s := openTestStore(t, Config{User: Limits{Files: 1}})
+
+	id, err := s.Reserve("u1", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(s.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.Reserve("u1", "", 1); err == nil {
+		t.Error("limit isn't kept after reopening")
+	}
+
+	if err := reopened.Release(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.Reserve("u1", "", 1); err != nil {
+		t.Errorf("Reserve after release: %v", err)
+	}
+}
+
+func TestReservationExpires(t *testing.T) {
+	s := openTestStore(t, Config{User: Limits{InProgress: 1}, ReservationTTL: time.Hour})
+
+	if _, err := s.Reserve("u1", "", 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Reserve("u1", "", 10); err == nil {
+		t.Fatal("second upload in progress allowed")
+	}
+
+	// Загрузку бросили, резерв устарел
+	for id, reservation := range s.state.Reservations {
+		reservation.CreatedAt = reservation.CreatedAt.Add(-2 * time.Hour)
+		s.state.Reservations[id] = reservation
+	}
+
+	if _, err := s.Reserve("u1", "", 10); err != nil {
+		t.Errorf("Reserve after expiry: %v", err)
+	}
+	if got := s.Usage(ScopeUser, "u1"); got != (Usage{Bytes: 10, Files: 1, InProgress: 1}) {
+		t.Errorf("usage = %+v, want only the new reservation", got)
+	}
+}
+
+func TestTouchKeepsReservation(t *testing.T) {
+	s := openTestStore(t, Config{User: Limits{InProgress: 1}, ReservationTTL: time.Hour})
+
+	id, err := s.Reserve("u1", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Загрузка идет давно, но данные продолжают приходить
+	reservation := s.state.Reservations[id]
+	reservation.CreatedAt = reservation.CreatedAt.Add(-2 * time.Hour)
+	s.state.Reservations[id] = reservation
+
+	if err := s.Touch(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Reserve("u1", "", 10); err == nil {
+		t.Fatal("active reservation expired")
+	}
+
+	// Частые вызовы не переписывают файл
+	touched := s.state.Reservations[id].ActiveAt
+	if err := s.Touch(id); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.state.Reservations[id].ActiveAt; !got.Equal(touched) {
+		t.Errorf("activeAt = %s, want %s kept within the interval", got, touched)
+	}
+
+	reopened, err := Open(s.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.state.Reservations[id].ActiveAt; !got.Equal(touched) {
+		t.Errorf("activeAt after reopening = %s, want %s", got, touched)
+	}
+
+	if err := s.Touch("unknown"); err != nil {
+		t.Errorf("Touch of an unknown reservation: %v", err)
+	}
+}
+
+func TestMetricsWithoutIds(t *testing.T) {
+	s := openTestStore(t, Config{})
+
+	before := testutil.ToFloat64(MetricsQuotaUsage.WithLabelValues(ScopeUser, "bytes"))
+	first, err := s.Reserve("u1", "e1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Reserve("u2", "e1", 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := testutil.ToFloat64(MetricsQuotaUsage.WithLabelValues(ScopeUser, "bytes")) - before; got != 15 {
+		t.Errorf("user bytes grew by %v, want 15", got)
+	}
+
+	if err := s.Release(first); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(MetricsQuotaUsage.WithLabelValues(ScopeUser, "bytes")) - before; got != 5 {
+		t.Errorf("user bytes grew by %v after release, want 5", got)
+	}
+
+	if series := testutil.CollectAndCount(MetricsQuotaUsage); series != 6 {
+		t.Errorf("series = %d, want one per scope and kind", series)
+	}
+}
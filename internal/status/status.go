@@ -0,0 +1,259 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"codiewuploader/internal/model"
+	"codiewuploader/internal/utils"
+
+	"golang.org/x/exp/slog"
+)
+
+// Upload is the processing state of an upload, one entry per stage.
+type Upload struct {
+	UploadId  string              `json:"uploadId"`
+	UserId    string              `json:"userId,omitempty"`
+	EntityId  string              `json:"entityId,omitempty"`
+	Stages    []model.StageStatus `json:"stages"`
+	UpdatedAt time.Time           `json:"updatedAt"`
+}
+
+// Owner identifies whom the upload belongs to
+type Owner struct {
+	UserId   string
+	EntityId string
+}
+
+var reUnsafeId = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+type Config struct {
+	// Dir keeps one JSON file per upload, so a change only rewrites the file
+	// of its upload. An empty dir keeps the state in memory only.
+	Dir string
+	// MaxAge drops uploads untouched for longer, zero keeps them forever
+	MaxAge time.Duration
+	// ExpireInterval is how often Start looks for expired uploads, a minute
+	// by default
+	ExpireInterval time.Duration
+	// OnChange is called after a stage status is stored
+	OnChange func(upload Upload, stage model.StageStatus)
+}
+
+// Store keeps the stage results of the uploads, so they survive restarts and
+// the background jobs which finish after one.
+type Store struct {
+	config Config
+
+	mu      sync.Mutex
+	uploads map[string]*Upload
+}
+
+func Open(config Config) (*Store, error) {
+	if config.ExpireInterval <= 0 {
+		config.ExpireInterval = time.Minute
+	}
+
+	s := &Store{
+		config:  config,
+		uploads: make(map[string]*Upload),
+	}
+
+	if config.Dir == "" {
+		return s, nil
+	}
+
+	if err := os.MkdirAll(config.Dir, os.FileMode(0774)); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		path := filepath.Join(config.Dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		upload := &Upload{}
+		if err := json.Unmarshal(data, upload); err != nil {
+			return nil, fmt.Errorf("invalid status file %s: %w", path, err)
+		}
+		s.uploads[upload.UploadId] = upload
+	}
+
+	// Пока сервис стоял, часть загрузок могла устареть
+	s.expire(time.Now().UTC())
+
+	return s, nil
+}
+
+// Start drops the expired uploads every ExpireInterval until ctx is
+// cancelled.
+func (s *Store) Start(ctx context.Context) {
+	if s.config.MaxAge <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(s.config.ExpireInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.mu.Lock()
+				s.expire(time.Now().UTC())
+				s.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// Set replaces the status of the stage, stages keep the order they were
+// first reported in. OnChange is only called once the status is saved.
+func (s *Store) Set(uploadId string, owner Owner, stage model.StageStatus) error {
+	upload, stage, err := s.set(uploadId, owner, stage)
+	if err != nil {
+		return err
+	}
+
+	if s.config.OnChange != nil {
+		s.config.OnChange(upload, stage)
+	}
+
+	return nil
+}
+
+func (s *Store) set(uploadId string, owner Owner, stage model.StageStatus) (Upload, model.StageStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+
+	upload, ok := s.uploads[uploadId]
+	if !ok {
+		upload = &Upload{UploadId: uploadId}
+		s.uploads[uploadId] = upload
+	}
+	if owner.UserId != "" {
+		upload.UserId = owner.UserId
+	}
+	if owner.EntityId != "" {
+		upload.EntityId = owner.EntityId
+	}
+	upload.UpdatedAt = now
+	stage.UpdatedAt = now
+
+	replaced := false
+	for i := range upload.Stages {
+		if upload.Stages[i].Stage == stage.Stage {
+			upload.Stages[i] = stage
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		upload.Stages = append(upload.Stages, stage)
+	}
+
+	return upload.copy(), stage, s.save(upload)
+}
+
+// Get returns a copy of the upload state
+func (s *Store) Get(uploadId string) (Upload, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, ok := s.uploads[uploadId]
+	if !ok {
+		return Upload{}, false
+	}
+
+	return upload.copy(), true
+}
+
+// Entity returns the uploads of the entity, the recently updated first
+func (s *Store) Entity(entityId string) []Upload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	uploads := []Upload{}
+	for _, upload := range s.uploads {
+		if upload.EntityId == entityId {
+			uploads = append(uploads, upload.copy())
+		}
+	}
+
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].UpdatedAt.After(uploads[j].UpdatedAt)
+	})
+
+	return uploads
+}
+
+func (u *Upload) copy() Upload {
+	copied := *u
+	copied.Stages = append([]model.StageStatus(nil), u.Stages...)
+
+	return copied
+}
+
+func (s *Store) expire(now time.Time) {
+	if s.config.MaxAge <= 0 {
+		return
+	}
+
+	for id, upload := range s.uploads {
+		if now.Sub(upload.UpdatedAt) > s.config.MaxAge {
+			delete(s.uploads, id)
+			s.remove(id)
+		}
+	}
+}
+
+func (s *Store) path(uploadId string) string {
+	return filepath.Join(s.config.Dir, reUnsafeId.ReplaceAllString(uploadId, "_")+".json")
+}
+
+func (s *Store) save(upload *Upload) error {
+	if s.config.Dir == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+
+	return utils.WriteFileAtomic(s.path(upload.UploadId), data)
+}
+
+func (s *Store) remove(uploadId string) {
+	if s.config.Dir == "" {
+		return
+	}
+
+	if err := os.Remove(s.path(uploadId)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("StatusRemoveError", "uploadId", uploadId, "err", err.Error())
+	}
+}
@@ -0,0 +1,177 @@
+package status
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"codiewuploader/internal/model"
+)
+
+func TestSetAndReload(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open(Config{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owner := Owner{UserId: "u1", EntityId: "e1"}
+	for _, stage := range []model.StageStatus{
+		{Stage: "antivirus", Status: model.StatusRunning},
+		{Stage: "move", Status: model.StatusPending},
+		{Stage: "antivirus", Status: model.StatusDone},
+	} {
+		if err := s.Set("upl/1", owner, stage); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Id с небезопасными символами не выходит за пределы каталога
+	if _, err := os.Stat(filepath.Join(dir, "upl_1.json")); err != nil {
+		t.Fatalf("status file: %v", err)
+	}
+
+	reopened, err := Open(Config{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, store := range map[string]*Store{"memory": s, "reloaded": reopened} {
+		upload, ok := store.Get("upl/1")
+		if !ok {
+			t.Fatalf("%s: upload missing", name)
+		}
+		if upload.UserId != "u1" || upload.EntityId != "e1" {
+			t.Errorf("%s: owner = %s/%s, want u1/e1", name, upload.UserId, upload.EntityId)
+		}
+		// Стадия сохраняет место первого появления, статус берется последний
+		if len(upload.Stages) != 2 || upload.Stages[0].Stage != "antivirus" || upload.Stages[0].Status != model.StatusDone || upload.Stages[1].Stage != "move" {
+			t.Errorf("%s: stages = %+v", name, upload.Stages)
+		}
+
+		if uploads := store.Entity("e1"); len(uploads) != 1 || uploads[0].UploadId != "upl/1" {
+			t.Errorf("%s: entity uploads = %+v", name, uploads)
+		}
+	}
+}
+
+func TestOpenRejectsInvalidFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "upl1.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(Config{Dir: dir}); err == nil {
+		t.Error("invalid status file accepted")
+	}
+}
+
+func TestOnChangeOnlyAfterSave(t *testing.T) {
+	dir := t.TempDir()
+
+	var changes []model.StageStatus
+	s, err := Open(Config{Dir: dir, OnChange: func(upload Upload, stage model.StageStatus) {
+		changes = append(changes, stage)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Set("upl1", Owner{}, model.StageStatus{Stage: "move", Status: model.StatusRunning}); err != nil {
+		t.Fatal(err)
+	}
+
+	// На месте файла каталог, сохранить статус уже нельзя
+	path := filepath.Join(dir, "upl1.json")
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(path, "blocked"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("upl1", Owner{}, model.StageStatus{Stage: "move", Status: model.StatusDone}); err == nil {
+		t.Fatal("save over a directory succeeded")
+	}
+
+	if len(changes) != 1 || changes[0].Status != model.StatusRunning {
+		t.Errorf("changes = %+v, want only the saved one", changes)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open(Config{Dir: dir, MaxAge: time.Hour, ExpireInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"old", "fresh"} {
+		if err := s.Set(id, Owner{EntityId: "e1"}, model.StageStatus{Stage: "move", Status: model.StatusDone}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Делаем вид, что old не обновлялся два часа
+	s.mu.Lock()
+	s.uploads["old"].UpdatedAt = time.Now().UTC().Add(-2 * time.Hour)
+	if err := s.save(s.uploads["old"]); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Unlock()
+
+	// Устаревшая загрузка не переживает перезапуск
+	reopened, err := Open(Config{Dir: dir, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.Get("old"); ok {
+		t.Error("expired upload loaded on open")
+	}
+	if _, ok := reopened.Get("fresh"); !ok {
+		t.Error("fresh upload dropped on open")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := s.Get("old"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expired upload wasn't dropped by the ticker")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if _, ok := s.Get("fresh"); !ok {
+		t.Error("fresh upload dropped")
+	}
+	if _, err := os.Stat(s.path("old")); !os.IsNotExist(err) {
+		t.Errorf("expired status file kept: %v", err)
+	}
+}
+
+func TestSetDoesNotExpire(t *testing.T) {
+	s, err := Open(Config{MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("old", Owner{}, model.StageStatus{Stage: "move"}); err != nil {
+		t.Fatal(err)
+	}
+	s.uploads["old"].UpdatedAt = time.Now().UTC().Add(-2 * time.Hour)
+
+	// Set больше не перебирает все загрузки, этим занимается Start
+	if err := s.Set("new", Owner{}, model.StageStatus{Stage: "move"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get("old"); !ok {
+		t.Error("Set expired an upload")
+	}
+}
@@ -0,0 +1,33 @@
+package utils
+
+import "testing"
+
+func TestAcceptsMediaType(t *testing.T) {
+	tests := []struct {
+		accept    string
+		mediaType string
+		want      bool
+	}{
+		{accept: "image/avif,image/webp,*/*", mediaType: "image/webp", want: true},
+		{accept: "image/avif,image/webp,*/*", mediaType: "image/avif", want: true},
+		{accept: "image/webp;q=0.8, image/png", mediaType: "image/webp", want: true},
+		{accept: "IMAGE/WEBP", mediaType: "image/webp", want: true},
+		{accept: " image/webp ; q=1", mediaType: "image/webp", want: true},
+		{accept: "image/webp;q=0", mediaType: "image/webp", want: false},
+		{accept: "image/webp;q=0.0", mediaType: "image/webp", want: false},
+		{accept: "image/webp;q=bad", mediaType: "image/webp", want: true},
+		{accept: "*/*", mediaType: "image/webp", want: false},
+		{accept: "image/*", mediaType: "image/webp", want: false},
+		{accept: "image/png", mediaType: "image/webp", want: false},
+		{accept: "image/webpx", mediaType: "image/webp", want: false},
+		{accept: "", mediaType: "image/webp", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept+"|"+tt.mediaType, func(t *testing.T) {
+			if got := AcceptsMediaType(tt.accept, tt.mediaType); got != tt.want {
+				t.Errorf("AcceptsMediaType(%q, %q) = %v, want %v", tt.accept, tt.mediaType, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes into a temporary file next to path first and renames
+// it, so a crash never leaves a half-written file behind. Missing directories
+// are created.
+func WriteFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0774)); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, os.FileMode(0664)); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"strings"
+)
+
+// SniffLength is how many leading bytes DetectContentType looks at
+const SniffLength = 512
+
+// executableSignatures are the magic bytes of native executables, these are
+// never accepted whatever the client claims. Windows executables are checked
+// by isPortableExecutable, "MZ" alone is too common at the start of text.
+var executableSignatures = []struct {
+	magic       []byte
+	contentType string
+}{
+	{[]byte("\x7fELF"), "application/x-executable"},
+	{[]byte("\xfe\xed\xfa\xce"), "application/x-mach-binary"},
+	{[]byte("\xfe\xed\xfa\xcf"), "application/x-mach-binary"},
+	{[]byte("\xce\xfa\xed\xfe"), "application/x-mach-binary"},
+	{[]byte("\xcf\xfa\xed\xfe"), "application/x-mach-binary"},
+	{[]byte("\xca\xfe\xba\xbe"), "application/x-mach-binary"},
+	// Только шебанг с путем к интерпретатору, а не любой текст с "#!"
+	{[]byte("#!/"), "application/x-sh"},
+	{[]byte("#! /"), "application/x-sh"},
+}
+
+// peHeaderOffset is where the DOS header keeps e_lfanew, the offset of the
+// "PE\0\0" signature.
+const peHeaderOffset = 0x3c
+
+// isPortableExecutable checks the DOS header and the PE signature it points
+// to. A signature beyond the head can't be confirmed and isn't reported.
+func isPortableExecutable(head []byte) bool {
+	if len(head) < peHeaderOffset+4 || !bytes.HasPrefix(head, []byte("MZ")) {
+		return false
+	}
+
+	offset := binary.LittleEndian.Uint32(head[peHeaderOffset:])
+	if offset < peHeaderOffset+4 || uint64(offset)+4 > uint64(len(head)) {
+		return false
+	}
+
+	return bytes.Equal(head[offset:offset+4], []byte("PE\x00\x00"))
+}
+
+// ftypBrands maps ISOBMFF major brands to their content type, the rest of the
+// ftyp family is treated as MP4.
+var ftypBrands = map[string]string{
+	"qt  ": "video/quicktime",
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"heim": "image/heic",
+	"heis": "image/heic",
+	"hevc": "image/heic",
+	"hevx": "image/heic",
+	"hevm": "image/heic",
+	"hevs": "image/heic",
+	"mif1": "image/heif",
+	"msf1": "image/heif",
+	"avif": "image/avif",
+	"avis": "image/avif",
+}
+
+var executableTypes = map[string]struct{}{
+	"application/x-msdownload":  {},
+	"application/x-executable":  {},
+	"application/x-mach-binary": {},
+	"application/x-sh":          {},
+}
+
+// DetectContentType returns the content type by the magic bytes of the file
+// head. It extends http.DetectContentType with executables and the ISOBMFF
+// family (HEIC, QuickTime, MP4), parameters like charset are dropped.
+func DetectContentType(head []byte) string {
+	if isPortableExecutable(head) {
+		return "application/x-msdownload"
+	}
+
+	for _, signature := range executableSignatures {
+		if bytes.HasPrefix(head, signature.magic) {
+			return signature.contentType
+		}
+	}
+
+	if len(head) >= 12 && string(head[4:8]) == "ftyp" {
+		if contentType, ok := ftypBrands[string(head[8:12])]; ok {
+			return contentType
+		}
+		return "video/mp4"
+	}
+
+	contentType, _, _ := strings.Cut(http.DetectContentType(head), ";")
+
+	return contentType
+}
+
+// IsExecutableType reports whether the detected type is a native executable or script
+func IsExecutableType(contentType string) bool {
+	_, ok := executableTypes[contentType]
+	return ok
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func ftyp(brand string) []byte {
+	return append([]byte("\x00\x00\x00\x18ftyp"+brand), make([]byte, 16)...)
+}
+
+// portableExecutable builds a DOS header whose e_lfanew points to signature
+func portableExecutable(offset uint32, signature string) []byte {
+	head := make([]byte, 256)
+	copy(head, "MZ\x90\x00\x03")
+	binary.LittleEndian.PutUint32(head[0x3c:], offset)
+	if int(offset)+len(signature) <= len(head) {
+		copy(head[offset:], signature)
+	}
+
+	return head
+}
+
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		name       string
+		head       []byte
+		want       string
+		executable bool
+	}{
+		{name: "jpeg", head: []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00"), want: "image/jpeg"},
+		{name: "png", head: []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), want: "image/png"},
+		{name: "text drops charset", head: []byte("hello world"), want: "text/plain"},
+		{name: "heic", head: ftyp("heic"), want: "image/heic"},
+		{name: "heif", head: ftyp("mif1"), want: "image/heif"},
+		{name: "avif", head: ftyp("avif"), want: "image/avif"},
+		{name: "quicktime", head: ftyp("qt  "), want: "video/quicktime"},
+		{name: "other ftyp is mp4", head: ftyp("isom"), want: "video/mp4"},
+		{name: "short ftyp", head: []byte("\x00\x00\x00\x18ftyp"), want: "application/octet-stream"},
+		{name: "windows", head: portableExecutable(0x80, "PE\x00\x00"), want: "application/x-msdownload", executable: true},
+		{name: "dos header without pe", head: portableExecutable(0x80, "NE\x00\x00"), want: "application/octet-stream"},
+		{name: "pe offset beyond head", head: portableExecutable(0x1000, "PE\x00\x00"), want: "application/octet-stream"},
+		{name: "pe offset inside dos header", head: portableExecutable(0x10, ""), want: "application/octet-stream"},
+		{name: "short mz", head: []byte("MZ\x90\x00\x03"), want: "application/octet-stream"},
+		{name: "text starting with mz", head: []byte("MZ: notes about the listing"), want: "text/plain"},
+		{name: "elf", head: []byte("\x7fELF\x02\x01\x01"), want: "application/x-executable", executable: true},
+		{name: "mach-o", head: []byte("\xcf\xfa\xed\xfe\x07\x00"), want: "application/x-mach-binary", executable: true},
+		{name: "script", head: []byte("#!/bin/sh\nrm -rf /"), want: "application/x-sh", executable: true},
+		{name: "script with space", head: []byte("#! /usr/bin/env python\n"), want: "application/x-sh", executable: true},
+		{name: "text starting with #!", head: []byte("#!important note"), want: "text/plain"},
+		{name: "empty", head: nil, want: "text/plain"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DetectContentType(tt.head)
+			if got != tt.want {
+				t.Errorf("DetectContentType = %q, want %q", got, tt.want)
+			}
+			if IsExecutableType(got) != tt.executable {
+				t.Errorf("IsExecutableType(%q) = %v, want %v", got, !tt.executable, tt.executable)
+			}
+		})
+	}
+}